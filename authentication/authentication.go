@@ -77,3 +77,12 @@ func DecryptPacket(pkt []byte, key [32]byte) packets.SerializedPacket {
 	}
 	return output
 }
+
+// Encrypts an arbitrary value with the swarm key, e.g. for storing secrets at rest
+func Seal(raw []byte, key [32]byte) ([]byte, error) {
+	return encrypt(raw, key[:])
+}
+
+func Open(sealed []byte, key [32]byte) ([]byte, error) {
+	return decrypt(sealed, key[:])
+}
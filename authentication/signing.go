@@ -0,0 +1,103 @@
+package authentication
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"bytes"
+)
+
+// Detached signature over a module manifest
+type PackageSignature struct {
+	PublicKey []byte
+	Signature []byte
+}
+
+// Loads a publisher's private key, stored as a base64 seed. If the file doesn't exist and create is set, a new key is
+// generated and saved.
+func LoadSigningKey(path string, create bool) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && create {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(key.Seed())
+		if err := ioutil.WriteFile(path, []byte(encoded+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	} else if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not a valid signing key", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func EncodePublicKey(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// Loads the publisher keys a node accepts modules from. The file holds one base64 public key per line, optionally
+// followed by a comment. Blank lines and lines starting with # are ignored.
+func LoadTrustStore(path string) ([]ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	keys := make([]ed25519.PublicKey, 0)
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s:%d: invalid public key", path, i+1)
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+	return keys, nil
+}
+
+func SignManifest(manifest []byte, key ed25519.PrivateKey) ([]byte, error) {
+	signature := PackageSignature{
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(key, manifest),
+	}
+	return json.MarshalIndent(signature, "", "  ")
+}
+
+// Checks that the manifest was signed by one of the trusted publishers
+func VerifyManifest(manifest []byte, signatureData []byte, trusted []ed25519.PublicKey) error {
+	if len(trusted) == 0 {
+		return errors.New("no trusted publishers are configured")
+	}
+	if signatureData == nil {
+		return errors.New("package is not signed")
+	}
+	signature := PackageSignature{}
+	if err := json.Unmarshal(signatureData, &signature); err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	for _, key := range trusted {
+		if bytes.Equal(key, signature.PublicKey) {
+			if !ed25519.Verify(key, manifest, signature.Signature) {
+				return errors.New("signature does not match manifest")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("publisher %s is not trusted", base64.StdEncoding.EncodeToString(signature.PublicKey))
+}
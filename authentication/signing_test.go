@@ -0,0 +1,87 @@
+package authentication
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestVerifyManifest(t *testing.T) {
+	publisher, other := newKey(t), newKey(t)
+	manifest := []byte(`{"Module":"web","Files":{"install.sh":"00"}}`)
+	signature, err := SignManifest(manifest, publisher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := []ed25519.PublicKey{publisher.Public().(ed25519.PublicKey)}
+	if err := VerifyManifest(manifest, signature, trusted); err != nil {
+		t.Errorf("signed manifest: %v", err)
+	}
+
+	if VerifyManifest([]byte(`{"Module":"db","Files":{"install.sh":"00"}}`), signature, trusted) == nil {
+		t.Error("accepted a changed manifest")
+	}
+	if VerifyManifest(manifest, nil, trusted) == nil {
+		t.Error("accepted an unsigned manifest")
+	}
+	if VerifyManifest(manifest, signature, nil) == nil {
+		t.Error("accepted a manifest with no trusted publishers")
+	}
+	otherSignature, _ := SignManifest(manifest, other)
+	if VerifyManifest(manifest, otherSignature, trusted) == nil {
+		t.Error("accepted an untrusted publisher")
+	}
+
+	// A trusted key attached to a signature made by someone else
+	forged := PackageSignature{}
+	json.Unmarshal(otherSignature, &forged)
+	forged.PublicKey = trusted[0]
+	forgedData, _ := json.Marshal(forged)
+	if VerifyManifest(manifest, forgedData, trusted) == nil {
+		t.Error("accepted a signature from another key")
+	}
+	if VerifyManifest(manifest, []byte("not json"), trusted) == nil {
+		t.Error("accepted an invalid signature")
+	}
+}
+
+func TestSigningKeyAndTrustStore(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "publisher.key")
+	key, err := LoadSigningKey(keyPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadSigningKey(keyPath, false)
+	if err != nil || !loaded.Equal(key) {
+		t.Fatalf("reloaded key differs: %v", err)
+	}
+
+	storePath := filepath.Join(dir, "trusted_publishers")
+	store := "# publishers\n\n" + EncodePublicKey(key) + " build server\n"
+	if err := os.WriteFile(storePath, []byte(store), 0600); err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := LoadTrustStore(storePath)
+	if err != nil || len(trusted) != 1 || !trusted[0].Equal(key.Public()) {
+		t.Fatalf("trust store = %v, %v", trusted, err)
+	}
+	if err := os.WriteFile(storePath, []byte("not-a-key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTrustStore(storePath); err == nil {
+		t.Error("accepted an invalid key")
+	}
+}
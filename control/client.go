@@ -0,0 +1,185 @@
+package control
+
+import (
+	"swarmd/node"
+	"swarmd/packets"
+	"swarmd/authentication"
+	"swarmd/util"
+	"swarmd/tasks"
+	"net"
+	"fmt"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+	"crypto/rand"
+	"encoding/binary"
+	"sort"
+)
+
+// Default time to wait for nodes to answer
+const DefaultTimeout = 3 * time.Second
+
+// Module names double as share file names and directory names on the nodes
+var targetRegex = regexp.MustCompile("^[a-zA-Z0-9][-_a-zA-Z0-9]*$")
+
+// Config keys become environment variables on the nodes
+var configKeyRegex = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// A connection to the node running on this machine, through which the rest of the swarm is reached
+type Client struct {
+	conn      net.PacketConn
+	key       [32]uint8
+	localAddr net.Addr
+	// How long to wait for nodes to answer queries and acknowledge commands
+	Timeout time.Duration
+}
+
+// Connects to the local node listening on the given port and checks that it answers
+func Connect(port int, key string, timeout time.Duration) (*Client, error) {
+	localAddress := tasks.GetOutboundIP()
+	localNode := node.Node{
+		Address: localAddress.String(),
+		Port:    uint16(port),
+	}
+	// Listen on any free port
+	conn, err := net.ListenPacket("udp", "[::]:0")
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		conn:      conn,
+		key:       authentication.MakeKey(key),
+		localAddr: util.GetAddr(localNode),
+		Timeout:   timeout,
+	}
+	// Ping the local node
+	c.send("__PING_REQ")
+	if _, err := c.readMessage("__PING_ACK"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to connect to node at %s: %v", c.localAddr, err)
+	}
+	return c, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) send(msg string) {
+	pkt := new(packets.MessageHeader)
+	pkt.Initialize(msg)
+	util.SendPacket(c.conn, c.localAddr, c.key, pkt)
+}
+
+// Waits for a message from the node starting with one of the given prefixes, skipping anything else that arrives
+func (c *Client) readMessage(prefixes ...string) (string, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+	buffer := make(packets.SerializedPacket, 65536)
+	for {
+		length, _, err := c.conn.ReadFrom(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return "", errors.New("no response from node")
+			}
+			return "", err
+		}
+		data := authentication.DecryptPacket(buffer[:length], c.key)
+		if data == nil || len(data) < packets.CommonHeaderSize || data[2] != packets.PacketTypeMessageHeader {
+			continue
+		}
+		response := new(packets.MessageHeader)
+		if !response.Deserialize(data) || !response.IsValid() {
+			continue
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(response.Message, prefix) {
+				return response.Message, nil
+			}
+		}
+	}
+}
+
+// Asks every node in the swarm a question and collects the answers that arrive in time. Stops early once the wanted
+// number of nodes have answered, or waits out the timeout if wanted is 0.
+func (c *Client) Query(query string, wanted int) []*packets.QueryResponseHeader {
+	queryID := newQueryID()
+	c.send(fmt.Sprintf("__QUERY %d %s", queryID, query))
+	return c.collect(queryID, wanted)
+}
+
+// Asks only the local node a question and decodes its answer
+func (c *Client) QueryLocal(query string, answer interface{}) error {
+	queryID := newQueryID()
+	c.send(fmt.Sprintf("__QUERY_LOCAL %d %s", queryID, query))
+	responses := c.collect(queryID, 1)
+	if len(responses) == 0 {
+		return errors.New("no response from node")
+	}
+	if failure := decodeAnswer(responses[0], answer); failure != "" {
+		return errors.New(failure)
+	}
+	return nil
+}
+
+// Lists the peers the local node currently knows about as address:port
+func (c *Client) ListPeers() ([]string, error) {
+	c.send("__LIST_PEERS")
+	response, err := c.readMessage("__LIST_RSP")
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]string, 0)
+	for _, peer := range strings.Split(strings.TrimPrefix(response, "__LIST_RSP"), ",") {
+		if peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return peers, nil
+}
+
+// Query IDs are shared by the whole swarm, so they have to be random
+func newQueryID() uint64 {
+	var idBytes [8]uint8
+	rand.Read(idBytes[:])
+	return binary.BigEndian.Uint64(idBytes[:])
+}
+
+// Collects answers to a query until the wanted number of nodes have answered or the timeout passes
+func (c *Client) collect(queryID uint64, wanted int) []*packets.QueryResponseHeader {
+	responses := make(map[string]*packets.QueryResponseHeader)
+	c.conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+	buffer := make(packets.SerializedPacket, 65536)
+	for wanted == 0 || len(responses) < wanted {
+		length, _, err := c.conn.ReadFrom(buffer)
+		if err != nil {
+			break
+		}
+		data := authentication.DecryptPacket(buffer[:length], c.key)
+		if data == nil || len(data) < packets.CommonHeaderSize || data[2] != packets.PacketTypeQueryResponse {
+			continue
+		}
+		response := new(packets.QueryResponseHeader)
+		if !response.Deserialize(data) || !response.IsValid() || response.QueryID != queryID {
+			continue
+		}
+		responses[response.Node] = response
+	}
+	sorted := make([]*packets.QueryResponseHeader, 0, len(responses))
+	for _, response := range responses {
+		sorted = append(sorted, response)
+	}
+	sort.Slice(sorted, func(a, b int) bool {
+		return sorted[a].Node < sorted[b].Node
+	})
+	return sorted
+}
+
+func ValidTarget(target string) error {
+	if !targetRegex.MatchString(target) {
+		return fmt.Errorf("invalid target %q: must match %s", target, targetRegex.String())
+	}
+	return nil
+}
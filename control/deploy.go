@@ -0,0 +1,221 @@
+package control
+
+import (
+	"swarmd/authentication"
+	"swarmd/util"
+	"crypto/ed25519"
+	"path/filepath"
+	"io"
+	"io/ioutil"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A setting sent along with a deployment
+type Setting struct {
+	Pair   string
+	Secret bool
+}
+
+type Deployment struct {
+	Target string
+	// A directory holding the module's hooks and files, a gzipped tarball of them or a module archive that has
+	// already been built
+	Source string
+	// Patterns choosing what is archived from a directory or tarball, see util.ModuleFilter
+	Include []string
+	Exclude []string
+	// Replication policy, see ReplicasPolicy and LabelsPolicy. Empty means every node keeps a copy.
+	Policy     string
+	Settings   []Setting
+	SigningKey ed25519.PrivateKey
+}
+
+func ReplicasPolicy(replicas int) string {
+	return fmt.Sprintf("replicas:%d", replicas)
+}
+
+func LabelsPolicy(labels []string) string {
+	return fmt.Sprintf("labels:%s", strings.Join(labels, ","))
+}
+
+// Archives a module, leaves it in share for the local node to pick up and starts its deployment to the swarm
+func (c *Client) Deploy(deployment Deployment) error {
+	if err := checkDeployment(deployment); err != nil {
+		return err
+	}
+
+	// Settings travel separately from the archive so that secrets never end up in share
+	for _, setting := range deployment.Settings {
+		if err := c.SetConfig(deployment.Target, "*", setting.Secret, setting.Pair); err != nil {
+			return err
+		}
+	}
+
+	targetPath := filepath.Join(util.GetBasePath(), "share", fmt.Sprintf("%s.swm", deployment.Target))
+	os.RemoveAll(targetPath)
+	if err := writeArchive(targetPath, deployment); err != nil {
+		os.Remove(targetPath)
+		return fmt.Errorf("unable to create archive: %v", err)
+	}
+
+	if deployment.Policy != "" {
+		c.send(fmt.Sprintf("__DEPLOY %s %s", deployment.Target, deployment.Policy))
+	} else {
+		c.send(fmt.Sprintf("__DEPLOY %s", deployment.Target))
+	}
+	response, err := c.readMessage("__DEPLOY_ACK", "__DEPLOY_ERROR")
+	if err != nil {
+		return err
+	}
+	if response != "__DEPLOY_ACK" {
+		return errors.New("node was unable to start the deployment")
+	}
+	return nil
+}
+
+// Checks a deployment before anything is sent
+func checkDeployment(deployment Deployment) error {
+	if err := ValidTarget(deployment.Target); err != nil {
+		return err
+	}
+	filter := util.ModuleFilter{Include: deployment.Include, Exclude: deployment.Exclude}
+	if err := filter.Validate(); err != nil {
+		return err
+	}
+	prebuilt := isPrebuilt(deployment.Source)
+	if prebuilt && (len(filter.Include) > 0 || len(filter.Exclude) > 0) {
+		return errors.New("include and exclude patterns can't be applied to a module archive")
+	}
+	info, err := os.Stat(deployment.Source)
+	if err != nil {
+		return fmt.Errorf("unable to find module source: %s", deployment.Source)
+	}
+	if !prebuilt && !info.IsDir() && !isTarball(deployment.Source) {
+		return fmt.Errorf("%s must be a directory, a .swm archive or a .tar.gz", deployment.Source)
+	}
+	if prebuilt {
+		if err := util.CheckModuleArchive(deployment.Source, deployment.Target); err != nil {
+			return fmt.Errorf("%s is not a module archive: %v", deployment.Source, err)
+		}
+	}
+	return nil
+}
+
+// Writes the module archive for a deployment, copying it if it was built beforehand
+func writeArchive(targetPath string, deployment Deployment) error {
+	if isPrebuilt(deployment.Source) {
+		return copyFile(deployment.Source, targetPath)
+	}
+	filter := util.ModuleFilter{Include: deployment.Include, Exclude: deployment.Exclude}
+	return buildArchive(targetPath, deployment.Target, deployment.Source, filter, deployment.SigningKey)
+}
+
+func isPrebuilt(source string) bool {
+	return strings.HasSuffix(source, ".swm")
+}
+
+func isTarball(source string) bool {
+	return strings.HasSuffix(source, ".tar.gz") || strings.HasSuffix(source, ".tgz")
+}
+
+// Archives a directory or tarball. Tarballs are unpacked into a scratch directory first.
+func buildArchive(targetPath string, module string, source string, filter util.ModuleFilter,
+	signingKey ed25519.PrivateKey) error {
+	root := source
+	if isTarball(source) {
+		tempPath, err := ioutil.TempDir("", "swarmd-deploy")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tempPath)
+		if err := util.ExtractTarball(source, tempPath); err != nil {
+			return err
+		}
+		root = tempPath
+	}
+	entries, err := util.ListModuleDirectory(root, filter)
+	if err != nil {
+		return err
+	}
+	platforms, err := hookPlatforms(entries)
+	if err != nil {
+		return err
+	}
+	// A module without any install hook is most likely the wrong directory, or a tarball with everything inside a
+	// folder
+	if len(platforms) == 0 {
+		return fmt.Errorf("no install hook found at the top of %s or under %s/<platform>", source,
+			util.HookDirectory)
+	}
+	return util.ZipModule(targetPath, module, entries, signingKey)
+}
+
+// Lists the platforms a module has install hooks for, "any" standing for the hooks at the top of the module. Nodes
+// on other platforms report the module as unsupported.
+func hookPlatforms(entries []util.ModuleEntry) ([]string, error) {
+	platforms := make([]string, 0)
+	for _, entry := range entries {
+		parts := strings.Split(entry.Name, "/")
+		if len(parts) >= 2 && parts[0] == util.HookDirectory && !util.ValidHookPlatform(parts[1]) {
+			return nil, fmt.Errorf("%s/%s: unknown platform, expected <os> or <os>_<arch>", util.HookDirectory,
+				parts[1])
+		}
+		if entry.Mode.IsDir() {
+			continue
+		}
+		platform := ""
+		if len(parts) == 1 && isInstallHook(parts[0]) {
+			platform = "any"
+		} else if len(parts) == 3 && parts[0] == util.HookDirectory && isInstallHook(parts[2]) {
+			platform = strings.Replace(parts[1], "_", "/", 1)
+		}
+		if platform != "" && (len(platforms) == 0 || platforms[len(platforms)-1] != platform) {
+			platforms = append(platforms, platform)
+		}
+	}
+	return platforms, nil
+}
+
+// Checks whether a file name is one a node would run as an install hook on some platform
+func isInstallHook(name string) bool {
+	for _, goos := range []string{"linux", "windows"} {
+		for _, extension := range util.HookExtensions(goos) {
+			if name == "install"+extension {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func copyFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Loads the publisher key, creating it on first use. Nodes only accept modules from publishers in their trust store,
+// so a new key has to be added there before anything signed with it will install.
+func LoadSigningKey(path string) (ed25519.PrivateKey, bool, error) {
+	_, err := os.Stat(path)
+	created := os.IsNotExist(err)
+	signingKey, err := authentication.LoadSigningKey(path, true)
+	if err != nil {
+		return nil, false, err
+	}
+	return signingKey, created, nil
+}
@@ -0,0 +1,151 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often to check on an install and how long to keep checking. Nodes give up on a download after five minutes.
+const outcomePollInterval = 2 * time.Second
+const OutcomeTimeout = 6 * time.Minute
+
+// Commands that can be signalled to a module
+var SignalCommands = []string{"install", "uninstall", "start", "stop", "delete"}
+
+// What a node did with a signal
+type Outcome struct {
+	Node     string
+	Command  string
+	Status   string
+	Detail   string
+	Revision uint64
+}
+
+// Nodes that can't run a module aren't counted as failures, a module only has to support the platforms it targets
+func (o Outcome) Failed() bool {
+	return o.Status != "fetching" && o.Status != "done" && o.Status != "unsupported"
+}
+
+// Signals a module on the nodes given as a comma separated list, or on every node if there are none. Returns the
+// revision of the desired state the signal created, which is 0 for delete as it isn't tracked.
+func (c *Client) Signal(target string, command string, nodes string) (uint64, error) {
+	if err := checkSignal(target, command); err != nil {
+		return 0, err
+	}
+	signal := fmt.Sprintf("__MODULE_%s %s", strings.ToUpper(command), target)
+	if nodes != "" {
+		signal = fmt.Sprintf("%s %s", signal, nodes)
+	}
+	c.send(signal)
+	if command == "delete" {
+		return 0, nil
+	}
+	// The node answers with the revision of the desired state it created
+	response, err := c.readMessage("__MODULE_ACK ")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimPrefix(response, "__MODULE_ACK "), 10, 64)
+}
+
+func checkSignal(target string, command string) error {
+	if err := ValidTarget(target); err != nil {
+		return err
+	}
+	for _, known := range SignalCommands {
+		if command == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid command %q, must be one of %s", command, strings.Join(SignalCommands, ", "))
+}
+
+// Follows what each node does with an install, including archives that have to be fetched first, until no node is
+// still waiting on a download. Each new outcome is passed to report as it comes in.
+func (c *Client) WaitForOutcome(target string, revision uint64, report func(Outcome)) ([]Outcome, error) {
+	reported := make(map[string]Outcome)
+	deadline := time.Now().Add(OutcomeTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(outcomePollInterval)
+		fetching := false
+		for _, response := range c.Query(fmt.Sprintf("outcome %s", target), 0) {
+			var outcome Outcome
+			// Outcomes of earlier signals are left over on nodes that haven't acted on this one
+			if err := json.Unmarshal([]byte(response.Response), &outcome); err != nil || outcome.Revision < revision {
+				continue
+			}
+			outcome.Node = response.Node
+			if outcome.Status == "fetching" {
+				fetching = true
+			}
+			if reported[outcome.Node] == outcome {
+				continue
+			}
+			reported[outcome.Node] = outcome
+			if report != nil {
+				report(outcome)
+			}
+		}
+		if !fetching {
+			return outcomeList(reported), nil
+		}
+	}
+	return outcomeList(reported), fmt.Errorf("gave up waiting for %s to be installed", target)
+}
+
+func outcomeList(outcomes map[string]Outcome) []Outcome {
+	list := make([]Outcome, 0, len(outcomes))
+	for _, outcome := range outcomes {
+		list = append(list, outcome)
+	}
+	return list
+}
+
+// A module setting scope: "*" for every node, "node:<address>[:<port>]" or "label:<name>"
+func ConfigScope(nodeAddress string, label string) string {
+	if nodeAddress != "" {
+		return fmt.Sprintf("node:%s", nodeAddress)
+	}
+	if label != "" {
+		return fmt.Sprintf("label:%s", label)
+	}
+	return "*"
+}
+
+// Sets a key=value setting for a module
+func (c *Client) SetConfig(target string, scope string, secret bool, pair string) error {
+	if err := ValidTarget(target); err != nil {
+		return err
+	}
+	parts := strings.SplitN(pair, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid setting %q: must be key=value", pair)
+	}
+	if !configKeyRegex.MatchString(parts[0]) {
+		return fmt.Errorf("invalid key %q: must match %s", parts[0], configKeyRegex.String())
+	}
+	if len(parts[1]) > 1024 {
+		return fmt.Errorf("value for %s is too long", parts[0])
+	}
+	secretFlag := "0"
+	if secret {
+		secretFlag = "1"
+	}
+	c.send(fmt.Sprintf("__CONFIG_SET %s %s %s %s", target, scope, secretFlag, pair))
+	return nil
+}
+
+// Removes a setting for a module
+func (c *Client) UnsetConfig(target string, scope string, key string) error {
+	if err := ValidTarget(target); err != nil {
+		return err
+	}
+	if !configKeyRegex.MatchString(key) {
+		return fmt.Errorf("invalid key %q: must match %s", key, configKeyRegex.String())
+	}
+	c.send(fmt.Sprintf("__CONFIG_UNSET %s %s %s", target, scope, key))
+	return nil
+}
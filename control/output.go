@@ -0,0 +1,145 @@
+package control
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Output formats for machine readable results
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+	FormatYAML  = "yaml"
+)
+
+// Strings that can be written in YAML without quotes
+var plainYAMLRegex = regexp.MustCompile(`^[A-Za-z_./][-A-Za-z0-9_./:@]*[-A-Za-z0-9_./@]$|^[A-Za-z_./]$`)
+
+// Writes a result as JSON or YAML. Tables are laid out by the caller as each result needs its own columns.
+func WriteOutput(w io.Writer, format string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	switch format {
+	case FormatJSON:
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	case FormatYAML:
+		// Go through JSON so that YAML uses the same field names and values
+		var generic interface{}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&generic); err != nil {
+			return err
+		}
+		var b strings.Builder
+		writeYAML(&b, generic, 0)
+		_, err = io.WriteString(w, b.String())
+		return err
+	}
+	return fmt.Errorf("unknown output format: %s", format)
+}
+
+func writeYAML(b *strings.Builder, value interface{}, indent int) {
+	pad := strings.Repeat(" ", indent)
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			b.WriteString(pad + "{}\n")
+			return
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if yamlNested(v[key]) {
+				b.WriteString(fmt.Sprintf("%s%s:\n", pad, yamlString(key)))
+				writeYAML(b, v[key], indent+2)
+			} else {
+				b.WriteString(fmt.Sprintf("%s%s: %s\n", pad, yamlString(key), yamlScalar(v[key])))
+			}
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString(pad + "[]\n")
+			return
+		}
+		for _, item := range v {
+			if yamlNested(item) {
+				// Write the item one level in, then put the dash in front of its first line
+				var sub strings.Builder
+				writeYAML(&sub, item, indent+2)
+				b.WriteString(pad + "- " + sub.String()[indent+2:])
+			} else {
+				b.WriteString(fmt.Sprintf("%s- %s\n", pad, yamlScalar(item)))
+			}
+		}
+	default:
+		b.WriteString(pad + yamlScalar(v) + "\n")
+	}
+}
+
+// Checks whether a value is written over several lines
+func yamlNested(value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return len(v) > 0
+	case []interface{}:
+		return len(v) > 0
+	}
+	return false
+}
+
+func yamlScalar(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case string:
+		return yamlString(v)
+	case map[string]interface{}:
+		return "{}"
+	case []interface{}:
+		return "[]"
+	}
+	return fmt.Sprint(value)
+}
+
+// Quotes strings that YAML would otherwise read as something else
+func yamlString(s string) string {
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "null", "y", "n":
+		return strconv.Quote(s)
+	}
+	if plainYAMLRegex.MatchString(s) {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+// Writes a size in bytes with a K/M/G/T suffix
+func FormatSize(size int64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit += 1
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
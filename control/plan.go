@@ -0,0 +1,114 @@
+package control
+
+import (
+	"swarmd/util"
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// What a node would do with a signal or deployment. Actions lists the steps in order and is empty when nothing would
+// change. For a deployment Targeted means the node would keep a copy of the archive.
+type Plan struct {
+	Node      string
+	Error     string `json:",omitempty"`
+	Module    string
+	Command   string
+	Targeted  bool
+	Installed bool
+	Active    bool
+	Version   string
+	Actions   []string
+	Detail    string `json:",omitempty"`
+}
+
+// What a deployment would send out and what each node would do with it
+type DeployPlan struct {
+	Target    string
+	Archive   string
+	Size      int64
+	Files     int
+	Platforms []string
+	Policy    string
+	Nodes     []Plan
+}
+
+// Asks every node what it would do if a module were signalled, without anything being changed
+func (c *Client) PlanSignal(target string, command string, nodes string) ([]Plan, error) {
+	if err := checkSignal(target, command); err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("plan %s %s", command, target)
+	if nodes != "" {
+		query = fmt.Sprintf("%s %s", query, nodes)
+	}
+	return c.plan(query), nil
+}
+
+// Builds the archive for a deployment without putting it in share, and asks every node whether it would keep a copy
+func (c *Client) PlanDeploy(deployment Deployment) (DeployPlan, error) {
+	result := DeployPlan{Target: deployment.Target, Policy: deployment.Policy}
+	if result.Policy == "" {
+		result.Policy = "all"
+	}
+	if err := checkDeployment(deployment); err != nil {
+		return result, err
+	}
+	archive, err := ioutil.TempFile("", "swarmd-plan")
+	if err != nil {
+		return result, err
+	}
+	archive.Close()
+	defer os.Remove(archive.Name())
+	if err := writeArchive(archive.Name(), deployment); err != nil {
+		return result, fmt.Errorf("unable to create archive: %v", err)
+	}
+	if result.Archive, err = util.HashFile(archive.Name()); err != nil {
+		return result, err
+	}
+	info, err := os.Stat(archive.Name())
+	if err != nil {
+		return result, err
+	}
+	result.Size = info.Size()
+	if result.Files, result.Platforms, err = archiveContents(archive.Name()); err != nil {
+		return result, err
+	}
+	result.Nodes = c.plan(fmt.Sprintf("plan deploy %s %s %s", deployment.Target, result.Archive, result.Policy))
+	return result, nil
+}
+
+func (c *Client) plan(query string) []Plan {
+	results := make([]Plan, 0)
+	for _, response := range c.Query(query, 0) {
+		result := Plan{Node: response.Node}
+		result.Error = decodeAnswer(response, &result)
+		result.Node = response.Node
+		results = append(results, result)
+	}
+	return results
+}
+
+// Counts the files in a module archive and lists the platforms it has install hooks for
+func archiveContents(archive string) (int, []string, error) {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer r.Close()
+	files := 0
+	entries := make([]util.ModuleEntry, 0, len(r.File))
+	for _, f := range r.File {
+		if f.Name == util.ModuleManifestFile || f.Name == util.ModuleSignatureFile {
+			continue
+		}
+		if !f.Mode().IsDir() {
+			files += 1
+		}
+		entries = append(entries, util.ModuleEntry{Name: strings.TrimSuffix(f.Name, "/"), Mode: f.Mode()})
+	}
+	platforms, err := hookPlatforms(entries)
+	return files, platforms, err
+}
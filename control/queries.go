@@ -0,0 +1,166 @@
+package control
+
+import (
+	"swarmd/packets"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Answers from each node. Error is set instead of the rest when the node couldn't answer. Durations are in
+// nanoseconds when written out as JSON or YAML.
+
+type Peer struct {
+	Peer        string
+	LastSeen    time.Time
+	RTT         time.Duration
+	MissedPings int
+}
+
+type NodePeers struct {
+	Node  string
+	Error string `json:",omitempty"`
+	Peers []Peer
+}
+
+type Module struct {
+	Name      string
+	Installed bool
+	Active    bool
+	Version   string
+	Desired   string
+}
+
+type NodeModules struct {
+	Node    string
+	Error   string `json:",omitempty"`
+	Modules []Module
+}
+
+type Transfer struct {
+	File      string
+	Name      string
+	Size      uint64
+	Parts     uint64
+	PartsHave uint64
+	Peers     int
+}
+
+type NodeTransfers struct {
+	Node      string
+	Error     string `json:",omitempty"`
+	Transfers []Transfer
+}
+
+type ShareUsage struct {
+	Files       int
+	Bytes       int64
+	PinnedFiles int
+	PinnedBytes int64
+	Quota       int64
+}
+
+type NodeUsage struct {
+	Node  string
+	Error string `json:",omitempty"`
+	ShareUsage
+}
+
+type NodeStatus struct {
+	Node    string
+	Error   string `json:",omitempty"`
+	Version  string
+	Platform string
+	Uptime   time.Duration
+	Labels   []string
+	Peers    int
+	Modules  int
+	Active   int
+	Share    ShareUsage
+}
+
+type PingResult struct {
+	Node string
+	RTT  time.Duration
+}
+
+// Decodes a node's answer, returning the error the node sent back instead if there was one
+func decodeAnswer(response *packets.QueryResponseHeader, answer interface{}) string {
+	var failure struct {
+		Error string
+	}
+	if json.Unmarshal([]byte(response.Response), &failure) == nil && failure.Error != "" {
+		return failure.Error
+	}
+	if err := json.Unmarshal([]byte(response.Response), answer); err != nil {
+		return fmt.Sprintf("bad answer: %v", err)
+	}
+	return ""
+}
+
+// Lists each node's peers, when they were last heard from and how long their last ping took
+func (c *Client) Peers() []NodePeers {
+	results := make([]NodePeers, 0)
+	for _, response := range c.Query("peers", 0) {
+		result := NodePeers{Node: response.Node}
+		result.Error = decodeAnswer(response, &result.Peers)
+		results = append(results, result)
+	}
+	return results
+}
+
+// Lists the modules installed on or meant for each node
+func (c *Client) Modules() []NodeModules {
+	results := make([]NodeModules, 0)
+	for _, response := range c.Query("modules", 0) {
+		result := NodeModules{Node: response.Node}
+		result.Error = decodeAnswer(response, &result.Modules)
+		results = append(results, result)
+	}
+	return results
+}
+
+// Lists the downloads in progress on each node
+func (c *Client) Transfers() []NodeTransfers {
+	results := make([]NodeTransfers, 0)
+	for _, response := range c.Query("transfers", 0) {
+		result := NodeTransfers{Node: response.Node}
+		result.Error = decodeAnswer(response, &result.Transfers)
+		results = append(results, result)
+	}
+	return results
+}
+
+// Reports how much space share takes up on each node
+func (c *Client) Usage() []NodeUsage {
+	results := make([]NodeUsage, 0)
+	for _, response := range c.Query("usage", 0) {
+		result := NodeUsage{Node: response.Node}
+		result.Error = decodeAnswer(response, &result.ShareUsage)
+		results = append(results, result)
+	}
+	return results
+}
+
+// Gives an overview of each node
+func (c *Client) Status() []NodeStatus {
+	results := make([]NodeStatus, 0)
+	for _, response := range c.Query("status", 0) {
+		result := NodeStatus{Node: response.Node}
+		result.Error = decodeAnswer(response, &result)
+		result.Node = response.Node
+		results = append(results, result)
+	}
+	return results
+}
+
+// Times a query through the swarm to one node, named by address or address:port, and back
+func (c *Client) Ping(target string) (PingResult, error) {
+	started := time.Now()
+	responses := c.Query(fmt.Sprintf("ping %s", target), 1)
+	if len(responses) == 0 {
+		return PingResult{}, errors.New("no reply")
+	}
+	return PingResult{Node: responses[0].Node, RTT: time.Since(started)}, nil
+}
@@ -0,0 +1,219 @@
+package lineedit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Most lines kept in the history file
+const maxHistory = 1000
+
+// Returned by ReadLine when the user presses Ctrl-C
+var ErrInterrupt = errors.New("interrupted")
+
+// Reads lines from the terminal with editing, history and tab completion. When stdin isn't a terminal lines are read
+// as they come, which keeps piped input working.
+type Editor struct {
+	input       *bufio.Reader
+	fd          int
+	history     []string
+	historyPath string
+	// Returns the possible completions of the last word of the line, given everything before the cursor
+	Complete func(line string) []string
+}
+
+// Creates an editor that keeps its history in the given file, or only in memory if the path is empty
+func New(historyPath string) *Editor {
+	e := &Editor{
+		input:       bufio.NewReader(os.Stdin),
+		fd:          int(os.Stdin.Fd()),
+		historyPath: historyPath,
+	}
+	if historyPath != "" {
+		if data, err := ioutil.ReadFile(historyPath); err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				if line != "" {
+					e.history = append(e.history, line)
+				}
+			}
+		}
+	}
+	return e
+}
+
+func (e *Editor) addHistory(line string) {
+	if strings.TrimSpace(line) == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+	}
+	if e.historyPath != "" {
+		ioutil.WriteFile(e.historyPath, []byte(strings.Join(e.history, "\n")+"\n"), 0600)
+	}
+}
+
+// Reads one line. Returns io.EOF when the input ends or the user presses Ctrl-D on an empty line.
+func (e *Editor) ReadLine(prompt string) (string, error) {
+	fmt.Print(prompt)
+	if !isTerminal(e.fd) {
+		line, err := e.input.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		e.addHistory(line)
+		return line, nil
+	}
+	state, err := makeRaw(e.fd)
+	if err != nil {
+		return "", err
+	}
+	defer restore(e.fd, state)
+
+	line := []rune{}
+	cursor := 0
+	// Position in the history while scrolling through it, with the line being typed kept aside
+	historyIndex := len(e.history)
+	pending := ""
+	redraw := func() {
+		fmt.Printf("\r%s%s\x1b[K", prompt, string(line))
+		if back := len(line) - cursor; back > 0 {
+			fmt.Printf("\x1b[%dD", back)
+		}
+	}
+	for {
+		r, _, err := e.input.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Print("\r\n")
+			e.addHistory(string(line))
+			return string(line), nil
+		case 3: // Ctrl-C
+			fmt.Print("^C\r\n")
+			return "", ErrInterrupt
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				fmt.Print("\r\n")
+				return "", io.EOF
+			}
+			if cursor < len(line) {
+				line = append(line[:cursor], line[cursor+1:]...)
+			}
+		case 127, 8: // Backspace
+			if cursor > 0 {
+				line = append(line[:cursor-1], line[cursor:]...)
+				cursor -= 1
+			}
+		case 1: // Ctrl-A
+			cursor = 0
+		case 5: // Ctrl-E
+			cursor = len(line)
+		case 11: // Ctrl-K
+			line = line[:cursor]
+		case 21: // Ctrl-U
+			line = line[cursor:]
+			cursor = 0
+		case 23: // Ctrl-W
+			start := cursor
+			for start > 0 && line[start-1] == ' ' {
+				start -= 1
+			}
+			for start > 0 && line[start-1] != ' ' {
+				start -= 1
+			}
+			line = append(line[:start], line[cursor:]...)
+			cursor = start
+		case '\t':
+			line, cursor = e.complete(prompt, line, cursor)
+		case 27: // Escape sequences for the arrow keys and friends
+			if next, _, _ := e.input.ReadRune(); next != '[' && next != 'O' {
+				continue
+			}
+			code, _, _ := e.input.ReadRune()
+			switch code {
+			case 'A', 'B':
+				if historyIndex == len(e.history) {
+					pending = string(line)
+				}
+				if code == 'A' && historyIndex > 0 {
+					historyIndex -= 1
+				} else if code == 'B' && historyIndex < len(e.history) {
+					historyIndex += 1
+				}
+				if historyIndex == len(e.history) {
+					line = []rune(pending)
+				} else {
+					line = []rune(e.history[historyIndex])
+				}
+				cursor = len(line)
+			case 'C':
+				if cursor < len(line) {
+					cursor += 1
+				}
+			case 'D':
+				if cursor > 0 {
+					cursor -= 1
+				}
+			case 'H':
+				cursor = 0
+			case 'F':
+				cursor = len(line)
+			case '3':
+				// Delete is sent as ESC [ 3 ~
+				e.input.ReadRune()
+				if cursor < len(line) {
+					line = append(line[:cursor], line[cursor+1:]...)
+				}
+			}
+		default:
+			if r < 32 {
+				continue
+			}
+			line = append(line[:cursor], append([]rune{r}, line[cursor:]...)...)
+			cursor += 1
+		}
+		redraw()
+	}
+}
+
+// Completes the word before the cursor as far as the candidates agree, listing them if that doesn't get any further
+func (e *Editor) complete(prompt string, line []rune, cursor int) ([]rune, int) {
+	if e.Complete == nil {
+		return line, cursor
+	}
+	before := string(line[:cursor])
+	candidates := e.Complete(before)
+	if len(candidates) == 0 {
+		return line, cursor
+	}
+	word := before[strings.LastIndex(before, " ")+1:]
+	prefix := candidates[0]
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(candidate, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if len(candidates) == 1 {
+		prefix += " "
+	}
+	if len(prefix) > len(word) && strings.HasPrefix(prefix, word) {
+		insert := []rune(prefix[len(word):])
+		line = append(line[:cursor], append(insert, line[cursor:]...)...)
+		return line, cursor + len(insert)
+	}
+	sorted := append([]string(nil), candidates...)
+	sort.Strings(sorted)
+	fmt.Printf("\r\n%s\r\n", strings.Join(sorted, "  "))
+	return line, cursor
+}
@@ -0,0 +1,6 @@
+package lineedit
+
+import "syscall"
+
+const ioctlGetTermios = syscall.TIOCGETA
+const ioctlSetTermios = syscall.TIOCSETA
@@ -0,0 +1,22 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package lineedit
+
+import "errors"
+
+// Line editing needs raw terminal input, which is only implemented for Linux and macOS. Elsewhere lines are read as
+// typed, without history or completion.
+type terminalState struct{}
+
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (*terminalState, error) {
+	return nil, errors.New("raw terminal input not supported")
+}
+
+func restore(fd int, state *terminalState) error {
+	return nil
+}
@@ -5,12 +5,37 @@ import (
 	"swarmd/tasks"
 	"flag"
 	"log"
+	"strings"
+	"swarmd/packets"
+	"swarmd/util"
 )
 
 func main() {
 	hostPtr := flag.String("host", "", "The address of the bootstrapping host")
 	portPtr := flag.Int("port", 51234, "The port to connect to on the bootstrapping host")
 	keyPtr := flag.String("key", "", "The encryption key")
+	labelsPtr := flag.String("labels", "", "Comma separated labels describing this node")
+	partSizePtr := flag.Int("partSize", packets.DefaultPartSize, "The number of bytes in each part when sharing files")
+	uploadRatePtr := flag.String("uploadRate", "", "Limit on total file upload speed in bytes per second, e.g. 10M")
+	downloadRatePtr := flag.String("downloadRate", "", "Limit on total file download speed in bytes per second")
+	peerUploadRatePtr := flag.String("peerUploadRate", "", "Limit on file upload speed to each peer in bytes per second")
+	peerDownloadRatePtr := flag.String("peerDownloadRate", "",
+		"Limit on file download speed from each peer in bytes per second")
+	shareQuotaPtr := flag.String("shareQuota", "", "Most disk space shared files may use, e.g. 20G")
+	noCompressionPtr := flag.Bool("noCompression", false, "Don't compress file parts sent to or received from peers")
+	sandboxUserPtr := flag.String("sandboxUser", "", "User to run module hooks as when their module doesn't name "+
+		"one. Hooks run as another user always get private mounts.")
+	sandboxCPUPtr := flag.Float64("sandboxCPU", 0, "Most CPUs a module's hooks may use")
+	sandboxMemoryPtr := flag.String("sandboxMemory", "", "Most memory a module's hooks may use, e.g. 512M")
+	sandboxPidsPtr := flag.Int("sandboxPids", 0, "Most processes a module's hooks may run")
+	sandboxMountsPtr := flag.Bool("sandboxPrivateMounts", false, "Hide everything in the swarmd directory from "+
+		"module hooks except their own module")
+	sandboxNetworkPtr := flag.Bool("sandboxPrivateNetwork", false, "Give module hooks no network access")
+	sandboxEnvPtr := flag.Bool("sandboxNoInheritEnv", false, "Don't pass the node's environment on to module hooks")
+	extractFilesPtr := flag.Int("extractMaxFiles", util.DefaultExtractLimits.MaxFiles,
+		"Most files a module archive may hold")
+	extractFileSizePtr := flag.String("extractMaxFileSize", "", "Most a single file in a module may unpack to, e.g. 1G")
+	extractTotalSizePtr := flag.String("extractMaxTotalSize", "", "Most a whole module may unpack to, e.g. 4G")
 	flag.Parse()
 	log.Printf("Starting node with configuration: ")
 	if *hostPtr != "" {
@@ -19,7 +44,35 @@ func main() {
 
 	killFlag := false
 
-	tasks.Run(&killFlag, *hostPtr, *portPtr, *keyPtr)
+	options := tasks.Options{
+		BootstrapHost:       *hostPtr,
+		BootstrapPort:       *portPtr,
+		Key:                 *keyPtr,
+		PartSize:            *partSizePtr,
+		UploadRate:          *uploadRatePtr,
+		DownloadRate:        *downloadRatePtr,
+		PeerUploadRate:      *peerUploadRatePtr,
+		PeerDownloadRate:    *peerDownloadRatePtr,
+		DisableCompression:  *noCompressionPtr,
+		ShareQuota:          *shareQuotaPtr,
+		ExtractMaxFiles:     *extractFilesPtr,
+		ExtractMaxFileSize:  *extractFileSizePtr,
+		ExtractMaxTotalSize: *extractTotalSizePtr,
+		Sandbox: tasks.SandboxPolicy{
+			User:                   *sandboxUserPtr,
+			CPU:                    *sandboxCPUPtr,
+			Memory:                 *sandboxMemoryPtr,
+			Pids:                   *sandboxPidsPtr,
+			PrivateMounts:          *sandboxMountsPtr,
+			PrivateNetwork:         *sandboxNetworkPtr,
+			DenyInheritEnvironment: *sandboxEnvPtr,
+		},
+	}
+	if *labelsPtr != "" {
+		options.Labels = strings.Split(*labelsPtr, ",")
+	}
+
+	tasks.Run(&killFlag, options)
 
 	os.Exit(0)
 }
@@ -3,103 +3,97 @@ package main
 import (
 	"flag"
 	"time"
+	"swarmd/control"
+	"swarmd/reporter"
 	"swarmd/tasks"
-	"swarmd/authentication"
-	"swarmd/node"
-	"net"
-	"swarmd/util"
 	"fmt"
 	"log"
-	"swarmd/packets"
+	"os"
 	"strings"
 	"encoding/json"
-	"net/http"
-	"bytes"
 )
 
+// A flag that can be given several times
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
-	hostPtr := flag.String("host", "", "The host to check into")
+	var sinkURLs, headers listFlag
+	flag.Var(&sinkURLs, "sink", "Where to send reports: an http:// or https:// URL, file:///path or unix:///path. "+
+		"May be given several times.")
+	hostPtr := flag.String("host", "", "The host to check into, same as -sink http://host:port/checkIn")
 	portPtr := flag.Int("port", 0, "The port on which the check-in service is running")
 	keyPtr := flag.String("key", "", "The key to use when communicating with the local node")
 	localPortPtr := flag.Int("localPort", 51234, "The port on which the local service is running")
+	intervalPtr := flag.Duration("interval", 30*time.Second, "How often to report")
+	timeoutPtr := flag.Duration("timeout", control.DefaultTimeout, "How long to wait for the local node to answer")
+	flag.Var(&headers, "header", "A header to send with HTTP reports, e.g. \"Authorization: Bearer token\". "+
+		"May be given several times.")
+	caCertPtr := flag.String("caCert", "", "CA certificate to verify HTTPS sinks with instead of the system's")
+	clientCertPtr := flag.String("clientCert", "", "Client certificate to present to HTTPS sinks")
+	clientKeyPtr := flag.String("clientKey", "", "Key for the client certificate")
+	insecurePtr := flag.Bool("insecure", false, "Don't verify the certificates of HTTPS sinks")
 
 	flag.Parse()
 
-	localAddress := tasks.GetOutboundIP()
-	key := authentication.MakeKey(*keyPtr)
-
-	localNode := node.Node{
-		Address: localAddress.String(),
-		Port:    uint16(*localPortPtr),
+	if *hostPtr != "" {
+		sinkURLs = append(sinkURLs, fmt.Sprintf("http://%s:%d/checkIn", *hostPtr, *portPtr))
 	}
-
-	checkInServer := node.Node{
-		Address: *hostPtr,
-		Port:    uint16(*portPtr),
+	if len(sinkURLs) == 0 {
+		fmt.Fprintln(os.Stderr, "No sinks given, use -sink or -host and -port")
+		flag.Usage()
+		os.Exit(2)
 	}
-
-	self := node.Node{
-		Address: localAddress.String(),
-		Port:    0,
+	tlsConfig, err := reporter.NewTLSConfig(*caCertPtr, *clientCertPtr, *clientKeyPtr, *insecurePtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid TLS settings: %v\n", err)
+		os.Exit(2)
 	}
-
-	localAddr := util.GetAddr(localNode)
-	//checkInAddr := util.GetAddr(checkInServer)
-
-	conn, err := net.ListenPacket("udp", fmt.Sprintf("[::]:%d", self.Port))
+	headerMap, err := reporter.ParseHeaders(headers)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	loop(conn, key, localNode, localAddr, fmt.Sprintf("%s:%d", checkInServer.Address, checkInServer.Port))
-}
 
-func loop(conn net.PacketConn, key [32]uint8, localNode node.Node, localAddr net.Addr, checkInAddr string) {
-	timer := time.After(0 * time.Second)
-	for {
-		select {
-		case <-timer:
-			// Get the list of peers
-			listPkt := new(packets.MessageHeader)
-			listPkt.Initialize("__LIST_PEERS")
-			util.SendPacket(conn, localAddr, key, listPkt)
-			responseBody := getResponse(conn, key)
-			if !strings.HasPrefix(responseBody, "__LIST_RSP") {
-				continue
-			}
-			peers := strings.TrimPrefix(responseBody, "__LIST_RSP")
-			peerList := strings.Split(peers, ",")
-			myAddress := fmt.Sprintf("%s:%d", localNode.Address, localNode.Port)
-			values := map[string]interface{}{
-				"peers": peerList,
-				"self":  myAddress,
-			}
-			jsonValue, _ := json.Marshal(values)
+	// Each sink has its own queue so one that is down doesn't hold up the others
+	queues := make([]chan []byte, 0, len(sinkURLs))
+	for _, sinkURL := range sinkURLs {
+		sink, err := reporter.NewSink(sinkURL, headerMap, tlsConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid sink %q: %v\n", sinkURL, err)
+			os.Exit(2)
+		}
+		queue := make(chan []byte, 1)
+		queues = append(queues, queue)
+		go reporter.RunSink(sink, queue)
+	}
 
-			response, err := http.Post(fmt.Sprintf("http://%s/checkIn", checkInAddr), "application/json",
-				bytes.NewBuffer(jsonValue))
-			log.Print(response)
+	self := fmt.Sprintf("%s:%d", tasks.GetOutboundIP().String(), *localPortPtr)
+	var client *control.Client
+	for {
+		// The node may not be up yet, or may have gone away, in which case that is what gets reported
+		if client == nil {
+			client, err = control.Connect(*localPortPtr, *keyPtr, *timeoutPtr)
 			if err != nil {
-				log.Fatal(err)
+				log.Print(err)
 			}
-			timer = time.After(30 * time.Second)
 		}
+		report, err := json.Marshal(reporter.Collect(client, self))
+		if err != nil {
+			log.Print(err)
+		} else {
+			for _, queue := range queues {
+				reporter.Publish(queue, report)
+			}
+		}
+		time.Sleep(*intervalPtr)
 	}
 }
-
-func getResponse(conn net.PacketConn, key [32]uint8) string {
-	// Wait for the response
-	buffer := make(packets.SerializedPacket, 2048)
-	length, _, err := conn.ReadFrom(buffer)
-	if err != nil {
-		log.Fatal(err)
-	}
-	// Deserialize/validate the response packet
-	data := authentication.DecryptPacket(buffer[:length], key)
-	pkt := new(packets.Packet)
-	packets.InitializePacket(pkt, data[2])
-	if !(*pkt).Deserialize(data) || !(*pkt).IsValid() || (*pkt).PacketType() != packets.PacketTypeMessageHeader {
-		log.Fatal("Received bad packet from node")
-	}
-	respPkt := (*pkt).(*packets.MessageHeader)
-	return respPkt.Message
-}
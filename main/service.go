@@ -9,19 +9,30 @@ import (
 	"errors"
 	"encoding/json"
 	"swarmd/tasks"
+	"strings"
 )
 
 type program struct {
 	killFlag bool
-	bootstrapHost string
-	bootstrapPort int
-	encryptionKey string
+	options  tasks.Options
 }
 
 type jsonConfig struct {
 	BoostrapHost string
 	BootstrapPort int
 	EncryptionKey string
+	Labels []string
+	PartSize int
+	UploadRate string
+	DownloadRate string
+	PeerUploadRate string
+	PeerDownloadRate string
+	DisableCompression bool
+	ShareQuota string
+	Sandbox tasks.SandboxPolicy
+	ExtractMaxFiles int
+	ExtractMaxFileSize string
+	ExtractMaxTotalSize string
 }
 
 func (p *program) Start(s service.Service) error {
@@ -37,12 +48,29 @@ func (p *program) Start(s service.Service) error {
 	config := new(jsonConfig)
 	json.Unmarshal(file, config)
 	// Copy the config values over to the program struct
-	p.bootstrapHost = config.BoostrapHost
-	p.bootstrapPort = config.BootstrapPort
-	p.encryptionKey = config.EncryptionKey
+	p.options = tasks.Options{
+		BootstrapHost:       config.BoostrapHost,
+		BootstrapPort:       config.BootstrapPort,
+		Key:                 config.EncryptionKey,
+		Labels:              config.Labels,
+		PartSize:            config.PartSize,
+		UploadRate:          config.UploadRate,
+		DownloadRate:        config.DownloadRate,
+		PeerUploadRate:      config.PeerUploadRate,
+		PeerDownloadRate:    config.PeerDownloadRate,
+		DisableCompression:  config.DisableCompression,
+		ShareQuota:          config.ShareQuota,
+		Sandbox:             config.Sandbox,
+		ExtractMaxFiles:     config.ExtractMaxFiles,
+		ExtractMaxFileSize:  config.ExtractMaxFileSize,
+		ExtractMaxTotalSize: config.ExtractMaxTotalSize,
+	}
 	log.Printf("Starting node with configuration:")
-	if p.bootstrapHost != "" {
-		log.Printf("\tBootstrap node: %s:%d", p.bootstrapHost, p.bootstrapPort)
+	if p.options.BootstrapHost != "" {
+		log.Printf("\tBootstrap node: %s:%d", p.options.BootstrapHost, p.options.BootstrapPort)
+	}
+	if len(p.options.Labels) > 0 {
+		log.Printf("\tLabels: %s", strings.Join(p.options.Labels, ","))
 	}
 	// Initialize non-config values in the program struct
 	p.killFlag = false
@@ -53,7 +81,7 @@ func (p *program) Start(s service.Service) error {
 
 func (p *program) run() {
 	// Use this as a wrapper around tasks.Run
-	tasks.Run(&p.killFlag, p.bootstrapHost, p.bootstrapPort, p.encryptionKey)
+	tasks.Run(&p.killFlag, p.options)
 }
 
 func (p *program) Stop(s service.Service) error {
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"flag"
+	"swarmd/authentication"
+	"swarmd/control"
+	"swarmd/lineedit"
+	"swarmd/util"
+	"fmt"
+	"os"
+	"io"
+	"net"
+	"io/ioutil"
+	"errors"
+	"strings"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes
+const (
+	exitOK     = 0
+	exitFailed = 1
+	exitUsage  = 2
+)
+
+var commandUsage = map[string]string{
+	"deploy": "deploy target directory|archive.swm|archive.tar.gz [--include pattern]... [--exclude pattern]...\n" +
+		"       [--replicas count | --labels name[,name...]] [--set key=value]... [--secret key=value]... [--dry-run]",
+	"signal":    "signal target command [node,...] [--no-wait] [--dry-run]",
+	"config":    "config target set [--secret] [--node address | --label name] key=value\n" +
+		"       config target unset [--node address | --label name] key",
+	"peers":     "peers",
+	"modules":   "modules [--node address]",
+	"transfers": "transfers",
+	"status":    "status",
+	"usage":     "usage",
+	"ping":      "ping address[:port]",
+	"shell":     "shell",
+}
+
+// Commands in the order they are listed in help
+var commandNames = []string{"deploy", "signal", "config", "peers", "modules", "transfers", "status", "usage", "ping",
+	"shell"}
+
+// Marks a mistake in how a command was called, as opposed to a failure carrying it out
+type usageError struct {
+	command string
+	message string
+}
+
+func (e usageError) Error() string {
+	if _, ok := commandUsage[e.command]; !ok {
+		return e.message
+	}
+	if e.message != "" {
+		return fmt.Sprintf("%s\nUsage: %s", e.message, commandUsage[e.command])
+	}
+	return fmt.Sprintf("Usage: %s", commandUsage[e.command])
+}
+
+type swarmctl struct {
+	port           int
+	key            string
+	signingKeyPath string
+	timeout        time.Duration
+	output         string
+	client         *control.Client
+	// Module names seen in the swarm, for completion in the shell
+	moduleNames []string
+}
+
+func main() {
+	ctl := new(swarmctl)
+	flag.IntVar(&ctl.port, "port", 51234, "The port on which the local instance is running")
+	flag.StringVar(&ctl.key, "key", "", "The encryption key to use for communications")
+	flag.StringVar(&ctl.signingKeyPath, "signingKey", filepath.Join(util.GetBasePath(), "publisher.key"),
+		"The publisher key used to sign deployed modules, created if it doesn't exist")
+	flag.DurationVar(&ctl.timeout, "timeout", control.DefaultTimeout, "How long to wait for nodes to answer")
+	flag.StringVar(&ctl.output, "o", control.FormatTable, "Output format: table, json or yaml")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: swarmctl [flags] command [arguments]\n\nCommands:\n")
+		for _, name := range commandNames {
+			fmt.Fprintf(os.Stderr, "  %s\n", strings.Replace(commandUsage[name], "\n       ", "\n  ", -1))
+		}
+		fmt.Fprintf(os.Stderr, "\nFlags, which may also follow the command:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	code := ctl.run(flag.Args())
+	if ctl.client != nil {
+		ctl.client.Close()
+	}
+	os.Exit(code)
+}
+
+// Runs a command and reports how it went as an exit code
+func (ctl *swarmctl) run(args []string) int {
+	err := ctl.dispatch(args)
+	if err == nil {
+		return exitOK
+	}
+	fmt.Fprintln(os.Stderr, err)
+	if _, ok := err.(usageError); ok {
+		return exitUsage
+	}
+	return exitFailed
+}
+
+func (ctl *swarmctl) dispatch(args []string) error {
+	command := args[0]
+	if _, ok := commandUsage[command]; !ok {
+		return usageError{command: command, message: fmt.Sprintf("unknown command: %s, run swarmctl -h for a list",
+			command)}
+	}
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	// The common flags can be given after the command too, e.g. swarmctl peers -o json
+	output := ctl.output
+	timeout := ctl.timeout
+	fs.StringVar(&output, "o", output, "")
+	fs.DurationVar(&timeout, "timeout", timeout, "")
+	switch command {
+	case "deploy":
+		return ctl.deploy(fs, args[1:], &output, &timeout)
+	case "signal":
+		return ctl.signal(fs, args[1:], &output, &timeout)
+	case "config":
+		return ctl.config(fs, args[1:], &timeout)
+	case "modules":
+		nodeFilter := fs.String("node", "", "")
+		positional, err := parseArgs(fs, args[1:])
+		if err != nil || len(positional) != 0 {
+			return usageError{command: command}
+		}
+		return ctl.query(command, output, timeout, *nodeFilter)
+	case "ping":
+		positional, err := parseArgs(fs, args[1:])
+		if err != nil || len(positional) != 1 {
+			return usageError{command: command}
+		}
+		return ctl.ping(positional[0], output, timeout)
+	case "shell":
+		if positional, err := parseArgs(fs, args[1:]); err != nil || len(positional) != 0 {
+			return usageError{command: command}
+		}
+		return ctl.shell()
+	}
+	if positional, err := parseArgs(fs, args[1:]); err != nil || len(positional) != 0 {
+		return usageError{command: command}
+	}
+	return ctl.query(command, output, timeout, "")
+}
+
+// Parses flags wherever they appear among the arguments, returning the rest in order
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := make([]string, 0)
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// A flag that can be given several times
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func checkFormat(output string) error {
+	if output != control.FormatTable && output != control.FormatJSON && output != control.FormatYAML {
+		return fmt.Errorf("unknown output format %q: must be table, json or yaml", output)
+	}
+	return nil
+}
+
+// Connects to the local node the first time it is needed
+func (ctl *swarmctl) connect(timeout time.Duration) (*control.Client, error) {
+	if ctl.client == nil {
+		client, err := control.Connect(ctl.port, ctl.key, timeout)
+		if err != nil {
+			return nil, err
+		}
+		ctl.client = client
+	}
+	ctl.client.Timeout = timeout
+	return ctl.client, nil
+}
+
+func (ctl *swarmctl) deploy(fs *flag.FlagSet, args []string, output *string, timeout *time.Duration) error {
+	replicas := fs.Int("replicas", 0, "")
+	dryRun := fs.Bool("dry-run", false, "")
+	labels := fs.String("labels", "", "")
+	var settings, secrets, include, exclude listFlag
+	fs.Var(&settings, "set", "")
+	fs.Var(&secrets, "secret", "")
+	fs.Var(&include, "include", "")
+	fs.Var(&exclude, "exclude", "")
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 2 {
+		return usageError{command: "deploy"}
+	}
+	if err := checkFormat(*output); err != nil {
+		return usageError{command: "deploy", message: err.Error()}
+	}
+	deployment := control.Deployment{Target: positional[0], Source: positional[1], Include: include, Exclude: exclude}
+	if *replicas < 0 || (*replicas > 0 && *labels != "") {
+		return usageError{command: "deploy", message: "Give either a replica count or labels"}
+	}
+	// Only nodes covered by the replication policy keep a copy, the rest fetch it when they need it
+	if *replicas > 0 {
+		deployment.Policy = control.ReplicasPolicy(*replicas)
+	} else if *labels != "" {
+		deployment.Policy = control.LabelsPolicy(strings.Split(*labels, ","))
+	}
+	for _, pair := range settings {
+		deployment.Settings = append(deployment.Settings, control.Setting{Pair: pair})
+	}
+	for _, pair := range secrets {
+		deployment.Settings = append(deployment.Settings, control.Setting{Pair: pair, Secret: true})
+	}
+	signingKey, created, err := control.LoadSigningKey(ctl.signingKeyPath)
+	if err != nil {
+		return fmt.Errorf("unable to load signing key: %v", err)
+	}
+	if created {
+		fmt.Fprintf(os.Stderr, "Created new signing key: %s\n", ctl.signingKeyPath)
+		fmt.Fprintf(os.Stderr, "Add this line to the trusted_publishers file on each node:\n%s\n",
+			authentication.EncodePublicKey(signingKey))
+	}
+	deployment.SigningKey = signingKey
+
+	client, err := ctl.connect(*timeout)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		// Nothing is put in share or sent, the nodes only say what they would do
+		plan, err := client.PlanDeploy(deployment)
+		if err != nil {
+			return err
+		}
+		if *output != control.FormatTable {
+			if err := control.WriteOutput(os.Stdout, *output, plan); err != nil {
+				return err
+			}
+		} else {
+			printDeployPlan(plan)
+		}
+		if len(plan.Nodes) == 0 {
+			return errors.New("no nodes responded")
+		}
+		return nil
+	}
+	if err := client.Deploy(deployment); err != nil {
+		return err
+	}
+	if *output != control.FormatTable {
+		return control.WriteOutput(os.Stdout, *output, map[string]string{"Target": deployment.Target,
+			"Policy": deployment.Policy})
+	}
+	fmt.Println("Deployment initiated successfully")
+	return nil
+}
+
+func (ctl *swarmctl) signal(fs *flag.FlagSet, args []string, output *string, timeout *time.Duration) error {
+	noWait := fs.Bool("no-wait", false, "")
+	dryRun := fs.Bool("dry-run", false, "")
+	positional, err := parseArgs(fs, args)
+	if err != nil || (len(positional) != 2 && len(positional) != 3) {
+		return usageError{command: "signal"}
+	}
+	if err := checkFormat(*output); err != nil {
+		return usageError{command: "signal", message: err.Error()}
+	}
+	target, command := positional[0], positional[1]
+	nodes := ""
+	if len(positional) == 3 {
+		// Restrict the module to a comma separated list of nodes
+		nodes = positional[2]
+	}
+	client, err := ctl.connect(*timeout)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		plans, err := client.PlanSignal(target, command, nodes)
+		if err != nil {
+			return err
+		}
+		if *output != control.FormatTable {
+			if err := control.WriteOutput(os.Stdout, *output, plans); err != nil {
+				return err
+			}
+		} else {
+			printPlans(plans)
+		}
+		if len(plans) == 0 {
+			return errors.New("no nodes responded")
+		}
+		return nil
+	}
+	revision, err := client.Signal(target, command, nodes)
+	if err != nil {
+		return err
+	}
+	outcomes := make([]control.Outcome, 0)
+	if !*noWait && (command == "install" || command == "start") {
+		report := func(outcome control.Outcome) {
+			if *output == control.FormatTable {
+				printOutcome(target, outcome)
+			}
+		}
+		outcomes, err = client.WaitForOutcome(target, revision, report)
+	}
+	if *output != control.FormatTable {
+		if writeErr := control.WriteOutput(os.Stdout, *output, outcomes); writeErr != nil {
+			return writeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, outcome := range outcomes {
+		if outcome.Failed() {
+			return fmt.Errorf("%s of %s failed on %s", outcome.Command, target, outcome.Node)
+		}
+	}
+	return nil
+}
+
+func printOutcome(target string, outcome control.Outcome) {
+	switch outcome.Status {
+	case "fetching":
+		fmt.Printf("%s: fetching archive %s for %s\n", outcome.Node, outcome.Detail, outcome.Command)
+	case "done":
+		fmt.Printf("%s: %s of %s succeeded\n", outcome.Node, outcome.Command, target)
+	case "unsupported":
+		fmt.Printf("%s: %s is not supported on this node: %s\n", outcome.Node, target, outcome.Detail)
+	default:
+		fmt.Printf("%s: %s of %s failed: %s\n", outcome.Node, outcome.Command, target, outcome.Detail)
+	}
+}
+
+func printDeployPlan(plan control.DeployPlan) {
+	platforms := strings.Join(plan.Platforms, ", ")
+	if platforms == "" {
+		platforms = "no platform"
+	}
+	fmt.Printf("Archive %s: %s, %d files, hooks for %s\n", plan.Archive[:12], control.FormatSize(plan.Size), plan.Files,
+		platforms)
+	fmt.Printf("Replication: %s\n\n", plan.Policy)
+	printPlans(plan.Nodes)
+}
+
+// Lays out what each node would do, followed by a summary of the changes across the swarm
+func printPlans(plans []control.Plan) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NODE\tTARGETED\tINSTALLED\tACTIVE\tVERSION\tACTIONS\tDETAIL")
+	counts := make(map[string]int)
+	order := make([]string, 0)
+	changing := 0
+	for _, plan := range plans {
+		if plan.Error != "" {
+			fmt.Fprintf(writer, "%s\terror: %s\n", plan.Node, plan.Error)
+			continue
+		}
+		version := plan.Version
+		if version == "" {
+			version = "-"
+		} else if len(version) > 12 {
+			version = version[:12]
+		}
+		actions := strings.Join(plan.Actions, ", ")
+		if actions == "" {
+			actions = "none"
+		} else {
+			changing += 1
+		}
+		for _, action := range plan.Actions {
+			if counts[action] == 0 {
+				order = append(order, action)
+			}
+			counts[action] += 1
+		}
+		fmt.Fprintf(writer, "%s\t%t\t%t\t%t\t%s\t%s\t%s\n", plan.Node, plan.Targeted, plan.Installed, plan.Active,
+			version, actions, plan.Detail)
+	}
+	writer.Flush()
+	summary := make([]string, 0, len(order))
+	for _, action := range order {
+		summary = append(summary, fmt.Sprintf("%s on %d", action, counts[action]))
+	}
+	fmt.Printf("%d of %d nodes would change", changing, len(plans))
+	if len(summary) > 0 {
+		fmt.Printf(": %s", strings.Join(summary, ", "))
+	}
+	fmt.Println()
+}
+
+func (ctl *swarmctl) config(fs *flag.FlagSet, args []string, timeout *time.Duration) error {
+	secret := fs.Bool("secret", false, "")
+	nodeAddress := fs.String("node", "", "")
+	label := fs.String("label", "", "")
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 3 || (*nodeAddress != "" && *label != "") {
+		return usageError{command: "config"}
+	}
+	target, action, setting := positional[0], positional[1], positional[2]
+	scope := control.ConfigScope(*nodeAddress, *label)
+	if action != "set" && action != "unset" {
+		return usageError{command: "config"}
+	}
+	client, err := ctl.connect(*timeout)
+	if err != nil {
+		return err
+	}
+	if action == "set" {
+		return client.SetConfig(target, scope, *secret, setting)
+	}
+	return client.UnsetConfig(target, scope, setting)
+}
+
+// Runs one of the read-only commands and prints its results
+func (ctl *swarmctl) query(command string, output string, timeout time.Duration, nodeFilter string) error {
+	if err := checkFormat(output); err != nil {
+		return usageError{command: command, message: err.Error()}
+	}
+	client, err := ctl.connect(timeout)
+	if err != nil {
+		return err
+	}
+	var result interface{}
+	var count int
+	var table func(w io.Writer)
+	switch command {
+	case "peers":
+		peers := client.Peers()
+		result, count, table = peers, len(peers), func(w io.Writer) { peersTable(w, peers) }
+	case "modules":
+		modules := make([]control.NodeModules, 0)
+		for _, node := range client.Modules() {
+			if nodeFilter == "" || matchesNode(node.Node, nodeFilter) {
+				modules = append(modules, node)
+			}
+		}
+		ctl.rememberModules(modules)
+		result, count, table = modules, len(modules), func(w io.Writer) { modulesTable(w, modules) }
+	case "transfers":
+		transfers := client.Transfers()
+		result, count, table = transfers, len(transfers), func(w io.Writer) { transfersTable(w, transfers) }
+	case "status":
+		status := client.Status()
+		result, count, table = status, len(status), func(w io.Writer) { statusTable(w, status) }
+	case "usage":
+		usage := client.Usage()
+		result, count, table = usage, len(usage), func(w io.Writer) { usageTable(w, usage) }
+	}
+	if output != control.FormatTable {
+		if err := control.WriteOutput(os.Stdout, output, result); err != nil {
+			return err
+		}
+	} else {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		table(writer)
+		writer.Flush()
+		fmt.Printf("%d nodes responded\n", count)
+	}
+	if count == 0 {
+		return errors.New("no nodes responded")
+	}
+	return nil
+}
+
+// Whether a node given as address:port is the one named, either by address and port or just by address
+func matchesNode(nodeAddr string, name string) bool {
+	if nodeAddr == name {
+		return true
+	}
+	host, _, err := net.SplitHostPort(nodeAddr)
+	return err == nil && host == name
+}
+
+func (ctl *swarmctl) ping(target string, output string, timeout time.Duration) error {
+	if err := checkFormat(output); err != nil {
+		return usageError{command: "ping", message: err.Error()}
+	}
+	client, err := ctl.connect(timeout)
+	if err != nil {
+		return err
+	}
+	result, err := client.Ping(target)
+	if err != nil {
+		return fmt.Errorf("no reply from %s", target)
+	}
+	if output != control.FormatTable {
+		return control.WriteOutput(os.Stdout, output, result)
+	}
+	fmt.Printf("Reply from %s in %s\n", result.Node, result.RTT.Round(time.Millisecond))
+	return nil
+}
+
+func peersTable(w io.Writer, nodes []control.NodePeers) {
+	fmt.Fprintln(w, "NODE\tPEER\tLAST SEEN\tRTT\tMISSED PINGS")
+	for _, node := range nodes {
+		if node.Error != "" {
+			fmt.Fprintf(w, "%s\terror: %s\n", node.Node, node.Error)
+			continue
+		}
+		for _, peer := range node.Peers {
+			lastSeen := "never"
+			if !peer.LastSeen.IsZero() {
+				lastSeen = fmt.Sprintf("%s ago", time.Since(peer.LastSeen).Round(time.Second))
+			}
+			rtt := "-"
+			if peer.RTT > 0 {
+				rtt = peer.RTT.Round(time.Millisecond).String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", node.Node, peer.Peer, lastSeen, rtt, peer.MissedPings)
+		}
+	}
+}
+
+func modulesTable(w io.Writer, nodes []control.NodeModules) {
+	fmt.Fprintln(w, "NODE\tMODULE\tINSTALLED\tACTIVE\tVERSION\tDESIRED")
+	for _, node := range nodes {
+		if node.Error != "" {
+			fmt.Fprintf(w, "%s\terror: %s\n", node.Node, node.Error)
+			continue
+		}
+		for _, module := range node.Modules {
+			version := module.Version
+			if len(version) > 12 {
+				version = version[:12]
+			}
+			desired := module.Desired
+			if desired == "" {
+				desired = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%t\t%t\t%s\t%s\n", node.Node, module.Name, module.Installed, module.Active,
+				version, desired)
+		}
+	}
+}
+
+func transfersTable(w io.Writer, nodes []control.NodeTransfers) {
+	fmt.Fprintln(w, "NODE\tFILE\tSIZE\tPROGRESS\tPEERS")
+	for _, node := range nodes {
+		if node.Error != "" {
+			fmt.Fprintf(w, "%s\terror: %s\n", node.Node, node.Error)
+			continue
+		}
+		for _, transfer := range node.Transfers {
+			name := transfer.Name
+			if name == "" && len(transfer.File) > 12 {
+				name = transfer.File[:12]
+			}
+			progress := 100.0
+			if transfer.Parts > 0 {
+				progress = 100 * float64(transfer.PartsHave) / float64(transfer.Parts)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%.1f%%\t%d\n", node.Node, name, control.FormatSize(int64(transfer.Size)),
+				progress, transfer.Peers)
+		}
+	}
+}
+
+func statusTable(w io.Writer, nodes []control.NodeStatus) {
+	fmt.Fprintln(w, "NODE\tVERSION\tPLATFORM\tUPTIME\tLABELS\tPEERS\tMODULES\tACTIVE\tSHARE")
+	for _, node := range nodes {
+		if node.Error != "" {
+			fmt.Fprintf(w, "%s\terror: %s\n", node.Node, node.Error)
+			continue
+		}
+		labels := strings.Join(node.Labels, ",")
+		if labels == "" {
+			labels = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n", node.Node, node.Version, node.Platform,
+			node.Uptime.Round(time.Second), labels, node.Peers, node.Modules, node.Active,
+			control.FormatSize(node.Share.Bytes))
+	}
+}
+
+func usageTable(w io.Writer, nodes []control.NodeUsage) {
+	fmt.Fprintln(w, "NODE\tFILES\tSIZE\tPINNED\tQUOTA")
+	for _, node := range nodes {
+		if node.Error != "" {
+			fmt.Fprintf(w, "%s\terror: %s\n", node.Node, node.Error)
+			continue
+		}
+		quota := "none"
+		if node.Quota > 0 {
+			quota = control.FormatSize(node.Quota)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", node.Node, node.Files, control.FormatSize(node.Bytes),
+			control.FormatSize(node.PinnedBytes), quota)
+	}
+}
+
+// Keeps track of module names for completion
+func (ctl *swarmctl) rememberModules(nodes []control.NodeModules) {
+	seen := make(map[string]bool)
+	for _, name := range ctl.moduleNames {
+		seen[name] = true
+	}
+	for _, node := range nodes {
+		for _, module := range node.Modules {
+			if !seen[module.Name] {
+				seen[module.Name] = true
+				ctl.moduleNames = append(ctl.moduleNames, module.Name)
+			}
+		}
+	}
+}
+
+// Runs commands interactively, with history kept between sessions
+func (ctl *swarmctl) shell() error {
+	if _, err := ctl.connect(ctl.timeout); err != nil {
+		return err
+	}
+	editor := lineedit.New(filepath.Join(util.GetBasePath(), "swarmctl_history"))
+	editor.Complete = ctl.complete
+	for {
+		line, err := editor.ReadLine("> ")
+		if err == lineedit.ErrInterrupt {
+			continue
+		} else if err != nil {
+			return nil
+		}
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			continue
+		}
+		switch words[0] {
+		case "quit", "exit":
+			return nil
+		case "help":
+			for _, name := range commandNames {
+				if name != "shell" {
+					fmt.Println(commandUsage[name])
+				}
+			}
+			continue
+		case "shell":
+			continue
+		}
+		if code := ctl.run(words); code != exitOK {
+			fmt.Printf("(exit %d)\n", code)
+		}
+	}
+}
+
+// Suggests commands, signal names, config actions, flags and module names
+func (ctl *swarmctl) complete(line string) []string {
+	words := strings.Fields(line)
+	// A trailing space starts a new word
+	if len(words) == 0 || strings.HasSuffix(line, " ") {
+		words = append(words, "")
+	}
+	word := words[len(words)-1]
+	var options []string
+	switch {
+	case len(words) == 1:
+		options = append([]string{"help", "quit"}, commandNames...)
+	case strings.HasPrefix(word, "-"):
+		options = commandFlags[words[0]]
+	case len(words) == 2 && (words[0] == "deploy" || words[0] == "signal" || words[0] == "config"):
+		if ctl.moduleNames == nil && ctl.client != nil {
+			ctl.rememberModules(ctl.client.Modules())
+		}
+		options = ctl.moduleNames
+	case len(words) == 3 && words[0] == "signal":
+		options = control.SignalCommands
+	case len(words) == 3 && words[0] == "config":
+		options = []string{"set", "unset"}
+	}
+	matches := make([]string, 0)
+	for _, option := range options {
+		if strings.HasPrefix(option, word) {
+			matches = append(matches, option)
+		}
+	}
+	return matches
+}
+
+// Flags each command takes, for completion
+var commandFlags = map[string][]string{
+	"deploy":  {"--include", "--exclude", "--replicas", "--labels", "--set", "--secret", "--dry-run", "-o", "-timeout"},
+	"signal":  {"--no-wait", "--dry-run", "-o", "-timeout"},
+	"config":  {"--secret", "--node", "--label", "-timeout"},
+	"modules": {"--node", "-o", "-timeout"},
+	"peers":     {"-o", "-timeout"},
+	"transfers": {"-o", "-timeout"},
+	"status":    {"-o", "-timeout"},
+	"usage":     {"-o", "-timeout"},
+	"ping":      {"-o", "-timeout"},
+}
@@ -0,0 +1,92 @@
+package packets
+
+import (
+	"fmt"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// Most bitfield bytes sent in one packet, larger files are advertised over several packets
+const MaxBitfieldSize = 8192
+
+// Advertises which parts of a file a node has while it is still downloading it. Bits cover the parts starting at
+// FirstPart, lowest part in the lowest bit of each byte.
+type BitfieldHeader struct {
+	Common     CommonHeader
+	FileHash   [HashSize]uint8
+	PartSize   uint16
+	FirstPart  uint64
+	BitsLength uint16
+	Bits       []uint8
+}
+
+func (h *BitfieldHeader) Initialize(FileHash [HashSize]uint8, PartSize uint16, FirstPart uint64, Bits []uint8) {
+	var bitsLength uint16
+	if len(Bits) < MaxBitfieldSize {
+		bitsLength = uint16(len(Bits))
+	} else {
+		bitsLength = MaxBitfieldSize
+	}
+	h.FileHash = FileHash
+	h.PartSize = PartSize
+	h.FirstPart = FirstPart
+	h.BitsLength = bitsLength
+	h.Bits = make([]uint8, bitsLength)
+	copy(h.Bits, Bits)
+
+	h.Common.Initialize(uint16(CommonHeaderSize)+HashSize+12+bitsLength, h.PacketType())
+}
+
+func (h *BitfieldHeader) Serialize() SerializedPacket {
+	raw := make(SerializedPacket, h.Common.PacketLength)
+
+	offset := raw.PutCommonHeader(h.Common)
+	offset = raw.PutArray(offset, h.FileHash[:], HashSize)
+	offset = raw.PutUint16(offset, h.PartSize)
+	offset = raw.PutUint64(offset, h.FirstPart)
+	offset = raw.PutUint16(offset, h.BitsLength)
+	offset = raw.PutArray(offset, h.Bits, h.BitsLength)
+
+	raw.CalculateChecksum()
+
+	return raw
+}
+
+func (h *BitfieldHeader) Deserialize(raw SerializedPacket) bool {
+	if !h.Common.Deserialize(raw) {
+		return false
+	}
+
+	offset := CommonHeaderSize
+	if offset+HashSize+12 > int(h.Common.PacketLength) {
+		return false
+	}
+	copy(h.FileHash[:], raw[offset:offset+HashSize])
+	offset += HashSize
+	h.PartSize = binary.BigEndian.Uint16(raw[offset : offset+2])
+	offset += 2
+	h.FirstPart = binary.BigEndian.Uint64(raw[offset : offset+8])
+	offset += 8
+	h.BitsLength = binary.BigEndian.Uint16(raw[offset : offset+2])
+	offset += 2
+	if offset+int(h.BitsLength) > int(h.Common.PacketLength) {
+		return false
+	}
+	h.Bits = make([]uint8, h.BitsLength)
+	copy(h.Bits, raw[offset:offset+int(h.BitsLength)])
+
+	return true
+}
+
+func (h *BitfieldHeader) ToString() string {
+	return fmt.Sprintf("%sFile Hash: %s\nPart Size: %d\nFirst Part: %d\nBits: %d bytes\n", h.Common.ToString(),
+		hex.Dump(h.FileHash[:]), h.PartSize, h.FirstPart, h.BitsLength)
+}
+
+func (h *BitfieldHeader) PacketType() uint8 {
+	return PacketTypeBitfield
+}
+
+func (h *BitfieldHeader) IsValid() bool {
+	return h.Common.IsValid() && h.FirstPart%8 == 0
+}
@@ -7,6 +7,7 @@ import (
 	"swarmd/node"
 	"log"
 	"crypto/sha1"
+	"crypto/sha256"
 	"time"
 	"crypto/rand"
 	"math/big"
@@ -26,6 +27,7 @@ type PeerPacket struct {
 }
 
 const ChecksumSize = 4
+const HashSize = sha256.Size
 const NonceSize = 20
 const CommonHeaderSize = 3 + NonceSize + ChecksumSize
 
@@ -40,6 +42,15 @@ const PacketTypeDeployment = 7
 const PacketTypeConnectionRequest = 8
 const PacketTypeConnectionShare = 9
 const PacketTypeConnectionAck = 10
+const PacketTypeDesiredState = 11
+const PacketTypeModuleConfig = 12
+const PacketTypeBitfield = 13
+const PacketTypeQuery = 14
+const PacketTypeQueryResponse = 15
+const PacketTypeShareSummary = 16
+const PacketTypeShareEntries = 17
+const PacketTypeFileLeavesRequest = 18
+const PacketTypeFileLeaves = 19
 
 func InitializePacket(packet *Packet, packetType uint8) {
 	switch packetType {
@@ -63,6 +74,24 @@ func InitializePacket(packet *Packet, packetType uint8) {
 		*packet = new(ConnectionAckHeader)
 	case PacketTypeConnectionShare:
 		*packet = new(ConnectionShareHeader)
+	case PacketTypeDesiredState:
+		*packet = new(DesiredStateHeader)
+	case PacketTypeModuleConfig:
+		*packet = new(ModuleConfigHeader)
+	case PacketTypeBitfield:
+		*packet = new(BitfieldHeader)
+	case PacketTypeQuery:
+		*packet = new(QueryHeader)
+	case PacketTypeQueryResponse:
+		*packet = new(QueryResponseHeader)
+	case PacketTypeShareSummary:
+		*packet = new(ShareSummaryHeader)
+	case PacketTypeShareEntries:
+		*packet = new(ShareEntriesHeader)
+	case PacketTypeFileLeavesRequest:
+		*packet = new(FileLeavesRequestHeader)
+	case PacketTypeFileLeaves:
+		*packet = new(FileLeavesHeader)
 	default:
 		log.Printf("Unknown packet type: %d", packetType)
 	}
@@ -171,9 +200,14 @@ func (s SerializedPacket) PutCommonHeader(common CommonHeader) uint16 {
 	return CommonHeaderSize
 }
 
+func (s SerializedPacket) PutUint64(offset uint16, val uint64) uint16 {
+	binary.BigEndian.PutUint64(s[offset:offset+8], val)
+	return offset + 8
+}
+
 func (s SerializedPacket) PutUint32(offset uint16, val uint32) uint16 {
-	binary.BigEndian.PutUint32(s[offset:offset+2], val)
-	return offset + 2
+	binary.BigEndian.PutUint32(s[offset:offset+4], val)
+	return offset + 4
 }
 
 func (s SerializedPacket) PutUint16(offset uint16, val uint16) uint16 {
@@ -190,3 +224,17 @@ func (s SerializedPacket) PutArray(offset uint16, arr []uint8, length uint16) ui
 	copy(s[offset:offset+length], arr)
 	return offset + length
 }
+
+// Reads a length prefixed string, checking that it fits inside the packet. Returns the string length, the string and
+// the offset following it.
+func (s SerializedPacket) GetString(offset int, packetLength uint16) (uint16, string, int, bool) {
+	if offset+2 > int(packetLength) || int(packetLength) > len(s) {
+		return 0, "", offset, false
+	}
+	length := binary.BigEndian.Uint16(s[offset : offset+2])
+	offset += 2
+	if offset+int(length) > int(packetLength) {
+		return 0, "", offset, false
+	}
+	return length, string(s[offset : offset+int(length)]), offset + int(length), true
+}
@@ -3,17 +3,26 @@ package packets
 import (
 	"fmt"
 	"encoding/hex"
+	"encoding/binary"
 )
 
 type DeploymentHeader struct {
-	Common     CommonHeader
-	FileHash     [16]uint8
+	Common       CommonHeader
+	FileHash     [HashSize]uint8
+	PolicyLength uint16
+	Policy       string
+	Revision     uint64
 }
 
-func (h *DeploymentHeader) Initialize(FileHash [16]uint8) {
+// The policy says which nodes should keep a copy of the file, empty meaning every node. The revision orders
+// deployments of the same file so that the latest policy wins everywhere.
+func (h *DeploymentHeader) Initialize(FileHash [HashSize]uint8, Policy string, Revision uint64) {
 	h.FileHash = FileHash
+	h.PolicyLength = uint16(len(Policy))
+	h.Policy = Policy
+	h.Revision = Revision
 
-	h.Common.Initialize(uint16(CommonHeaderSize)+16, h.PacketType())
+	h.Common.Initialize(uint16(CommonHeaderSize)+HashSize+10+h.PolicyLength, h.PacketType())
 }
 
 func (h *DeploymentHeader) Serialize() SerializedPacket {
@@ -21,6 +30,9 @@ func (h *DeploymentHeader) Serialize() SerializedPacket {
 
 	offset := raw.PutCommonHeader(h.Common)
 	offset = raw.PutArray(offset, h.FileHash[:], uint16(len(h.FileHash)))
+	offset = raw.PutUint16(offset, h.PolicyLength)
+	offset = raw.PutArray(offset, []uint8(h.Policy), h.PolicyLength)
+	offset = raw.PutUint64(offset, h.Revision)
 
 	raw.CalculateChecksum()
 
@@ -32,13 +44,35 @@ func (h *DeploymentHeader) Deserialize(raw SerializedPacket) bool {
 		return false
 	}
 
-	copy(h.FileHash[:], raw[CommonHeaderSize:CommonHeaderSize+16])
+	offset := CommonHeaderSize
+	if offset+HashSize > int(h.Common.PacketLength) {
+		return false
+	}
+	copy(h.FileHash[:], raw[offset:offset+HashSize])
+	offset += HashSize
+	// Announcements from nodes that predate replication policies end here
+	if offset == int(h.Common.PacketLength) {
+		return true
+	}
+	ok := false
+	if h.PolicyLength, h.Policy, offset, ok = raw.GetString(offset, h.Common.PacketLength); !ok {
+		return false
+	}
+	// As do those from nodes that predate revisions
+	if offset == int(h.Common.PacketLength) {
+		return true
+	}
+	if offset+8 > int(h.Common.PacketLength) {
+		return false
+	}
+	h.Revision = binary.BigEndian.Uint64(raw[offset : offset+8])
 
 	return true
 }
 
 func (h *DeploymentHeader) ToString() string {
-	return fmt.Sprintf("%sFile Hash: %s\n", h.Common.ToString(), hex.Dump(h.FileHash[:]))
+	return fmt.Sprintf("%sFile Hash: %s\nPolicy: %s\nRevision: %d\n", h.Common.ToString(), hex.Dump(h.FileHash[:]),
+		h.Policy, h.Revision)
 }
 
 func (h *DeploymentHeader) PacketType() uint8 {
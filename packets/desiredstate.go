@@ -0,0 +1,104 @@
+package packets
+
+import (
+	"fmt"
+	"encoding/binary"
+)
+
+// Desired module states
+const ModuleStateAbsent = 0
+const ModuleStateInstalled = 1
+const ModuleStateRunning = 2
+
+type DesiredStateHeader struct {
+	Common        CommonHeader
+	Revision      uint64
+	State         uint8
+	NameLength    uint16
+	ModuleName    string
+	VersionLength uint16
+	Version       string
+	TargetsLength uint16
+	Targets       string
+}
+
+func (h *DesiredStateHeader) Initialize(ModuleName string, State uint8, Version string, Targets string,
+	Revision uint64) {
+	dataLength := 0
+	h.Revision = Revision
+	dataLength += 8
+	h.State = State
+	dataLength += 1
+	h.NameLength = uint16(len(ModuleName))
+	dataLength += 2
+	h.ModuleName = ModuleName
+	dataLength += len(ModuleName)
+	h.VersionLength = uint16(len(Version))
+	dataLength += 2
+	h.Version = Version
+	dataLength += len(Version)
+	h.TargetsLength = uint16(len(Targets))
+	dataLength += 2
+	h.Targets = Targets
+	dataLength += len(Targets)
+
+	h.Common.Initialize(uint16(CommonHeaderSize+dataLength), h.PacketType())
+}
+
+func (h *DesiredStateHeader) Serialize() SerializedPacket {
+	raw := make(SerializedPacket, h.Common.PacketLength)
+
+	offset := raw.PutCommonHeader(h.Common)
+	offset = raw.PutUint64(offset, h.Revision)
+	offset = raw.PutUint8(offset, h.State)
+	offset = raw.PutUint16(offset, h.NameLength)
+	offset = raw.PutArray(offset, []uint8(h.ModuleName), h.NameLength)
+	offset = raw.PutUint16(offset, h.VersionLength)
+	offset = raw.PutArray(offset, []uint8(h.Version), h.VersionLength)
+	offset = raw.PutUint16(offset, h.TargetsLength)
+	offset = raw.PutArray(offset, []uint8(h.Targets), h.TargetsLength)
+
+	raw.CalculateChecksum()
+
+	return raw
+}
+
+func (h *DesiredStateHeader) Deserialize(raw SerializedPacket) bool {
+	if !h.Common.Deserialize(raw) {
+		return false
+	}
+
+	offset := CommonHeaderSize
+	if offset+9 > int(h.Common.PacketLength) {
+		return false
+	}
+	h.Revision = binary.BigEndian.Uint64(raw[offset : offset+8])
+	offset += 8
+	h.State = raw[offset]
+	offset += 1
+	ok := false
+	if h.NameLength, h.ModuleName, offset, ok = raw.GetString(offset, h.Common.PacketLength); !ok {
+		return false
+	}
+	if h.VersionLength, h.Version, offset, ok = raw.GetString(offset, h.Common.PacketLength); !ok {
+		return false
+	}
+	if h.TargetsLength, h.Targets, offset, ok = raw.GetString(offset, h.Common.PacketLength); !ok {
+		return false
+	}
+
+	return true
+}
+
+func (h *DesiredStateHeader) ToString() string {
+	return fmt.Sprintf("%sModule: %s\nState: %d\nVersion: %s\nTargets: %s\nRevision: %d\n", h.Common.ToString(),
+		h.ModuleName, h.State, h.Version, h.Targets, h.Revision)
+}
+
+func (h *DesiredStateHeader) PacketType() uint8 {
+	return PacketTypeDesiredState
+}
+
+func (h *DesiredStateHeader) IsValid() bool {
+	return h.Common.IsValid()
+}
@@ -6,28 +6,44 @@ import (
 	"encoding/hex"
 )
 
+// Set when the sender is still downloading the file and only has the parts it advertises in bitfield packets
+const FileDigestPartial = 1
+
+// Set when the sender can compress the parts it sends with deflate
+const FileDigestDeflate = 2
+
 type FileDigestHeader struct {
-	Common   CommonHeader
-	FileHash [16]uint8
-	FileSize uint32
-	FileName string
+	Common     CommonHeader
+	FileHash   [HashSize]uint8
+	FileSize   uint64
+	PartSize   uint16
+	Flags      uint8
+	MerkleRoot [HashSize]uint8
+	FileName   string
 }
 
-func (h *FileDigestHeader) Initialize(FileHash [16]uint8, FileSize uint32, FileName string) {
+func (h *FileDigestHeader) Initialize(FileHash [HashSize]uint8, FileSize uint64, PartSize uint16, Flags uint8,
+	MerkleRoot [HashSize]uint8, FileName string) {
 	h.FileHash = FileHash
 	h.FileSize = FileSize
+	h.PartSize = PartSize
+	h.Flags = Flags
+	h.MerkleRoot = MerkleRoot
 	h.FileName = FileName
 
-	h.Common.Initialize(uint16(CommonHeaderSize+20+len(FileName)), h.PacketType())
+	h.Common.Initialize(uint16(CommonHeaderSize+2*HashSize+11+len(FileName)), h.PacketType())
 }
 
 func (h *FileDigestHeader) Serialize() SerializedPacket {
 	raw := make(SerializedPacket, h.Common.PacketLength)
 
-	copy(raw[:CommonHeaderSize], h.Common.Serialize())
-	copy(raw[CommonHeaderSize:CommonHeaderSize+16], h.FileHash[:])
-	binary.BigEndian.PutUint32(raw[CommonHeaderSize+16:CommonHeaderSize+20], h.FileSize)
-	copy(raw[CommonHeaderSize+20:h.Common.PacketLength], []uint8(h.FileName))
+	offset := raw.PutCommonHeader(h.Common)
+	offset = raw.PutArray(offset, h.FileHash[:], HashSize)
+	offset = raw.PutUint64(offset, h.FileSize)
+	offset = raw.PutUint16(offset, h.PartSize)
+	offset = raw.PutUint8(offset, h.Flags)
+	offset = raw.PutArray(offset, h.MerkleRoot[:], HashSize)
+	copy(raw[offset:h.Common.PacketLength], []uint8(h.FileName))
 
 	raw.CalculateChecksum()
 
@@ -39,16 +55,45 @@ func (h *FileDigestHeader) Deserialize(raw SerializedPacket) bool {
 		return false
 	}
 
-	copy(h.FileHash[:], raw[CommonHeaderSize:CommonHeaderSize+16])
-	h.FileSize = binary.BigEndian.Uint32(raw[CommonHeaderSize+16:CommonHeaderSize+20])
-	h.FileName = string(raw[CommonHeaderSize+20:h.Common.PacketLength])
+	offset := CommonHeaderSize
+	if offset+2*HashSize+11 > int(h.Common.PacketLength) {
+		return false
+	}
+	copy(h.FileHash[:], raw[offset:offset+HashSize])
+	offset += HashSize
+	h.FileSize = binary.BigEndian.Uint64(raw[offset : offset+8])
+	offset += 8
+	h.PartSize = binary.BigEndian.Uint16(raw[offset : offset+2])
+	offset += 2
+	h.Flags = raw[offset]
+	offset += 1
+	copy(h.MerkleRoot[:], raw[offset:offset+HashSize])
+	offset += HashSize
+	h.FileName = string(raw[offset:h.Common.PacketLength])
 
 	return true
 }
 
+func (h *FileDigestHeader) IsPartial() bool {
+	return h.Flags&FileDigestPartial != 0
+}
+
+func (h *FileDigestHeader) SupportsDeflate() bool {
+	return h.Flags&FileDigestDeflate != 0
+}
+
+// Number of parts the file is split into
+func (h *FileDigestHeader) NumParts() uint64 {
+	if h.PartSize == 0 {
+		return 0
+	}
+	return (h.FileSize + uint64(h.PartSize) - 1) / uint64(h.PartSize)
+}
+
 func (h *FileDigestHeader) ToString() string {
-	return fmt.Sprintf("%sFile Name: %s\nFile Size: %d\nFile Hash: %s\n", h.Common.ToString(), h.FileName,
-		h.FileSize, hex.Dump(h.FileHash[:]))
+	return fmt.Sprintf("%sFile Name: %s\nFile Size: %d\nPart Size: %d\nFlags: %d\nFile Hash: %s\nMerkle Root: %s\n",
+		h.Common.ToString(), h.FileName, h.FileSize, h.PartSize, h.Flags, hex.Dump(h.FileHash[:]),
+		hex.Dump(h.MerkleRoot[:]))
 }
 
 func (h *FileDigestHeader) PacketType() uint8 {
@@ -57,4 +102,4 @@ func (h *FileDigestHeader) PacketType() uint8 {
 
 func (h *FileDigestHeader) IsValid() bool {
 	return h.Common.IsValid()
-}
\ No newline at end of file
+}
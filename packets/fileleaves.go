@@ -0,0 +1,182 @@
+package packets
+
+import (
+	"fmt"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// Number of leaf hashes sent in one packet. Chunks line up with subtrees of the file's Merkle tree, so each one can be
+// checked against the root as soon as it arrives.
+const LeavesPerChunk = 1024
+
+// Deepest proof a chunk can carry, enough for any file that can be described by a 64-bit part number
+const MaxProofLength = 64
+
+// Asks a peer for one chunk of a file's leaf hashes. The part size is the one the file is being downloaded with.
+type FileLeavesRequestHeader struct {
+	Common   CommonHeader
+	FileHash [HashSize]uint8
+	PartSize uint16
+	Chunk    uint64
+}
+
+func (h *FileLeavesRequestHeader) Initialize(FileHash [HashSize]uint8, PartSize uint16, Chunk uint64) {
+	h.FileHash = FileHash
+	h.PartSize = PartSize
+	h.Chunk = Chunk
+
+	h.Common.Initialize(uint16(CommonHeaderSize)+HashSize+10, h.PacketType())
+}
+
+func (h *FileLeavesRequestHeader) Serialize() SerializedPacket {
+	raw := make(SerializedPacket, h.Common.PacketLength)
+
+	offset := raw.PutCommonHeader(h.Common)
+	offset = raw.PutArray(offset, h.FileHash[:], HashSize)
+	offset = raw.PutUint16(offset, h.PartSize)
+	offset = raw.PutUint64(offset, h.Chunk)
+
+	raw.CalculateChecksum()
+
+	return raw
+}
+
+func (h *FileLeavesRequestHeader) Deserialize(raw SerializedPacket) bool {
+	if !h.Common.Deserialize(raw) {
+		return false
+	}
+
+	offset := CommonHeaderSize
+	if offset+HashSize+10 > int(h.Common.PacketLength) || int(h.Common.PacketLength) > len(raw) {
+		return false
+	}
+	copy(h.FileHash[:], raw[offset:offset+HashSize])
+	offset += HashSize
+	h.PartSize = binary.BigEndian.Uint16(raw[offset : offset+2])
+	offset += 2
+	h.Chunk = binary.BigEndian.Uint64(raw[offset : offset+8])
+
+	return true
+}
+
+func (h *FileLeavesRequestHeader) ToString() string {
+	return fmt.Sprintf("%sFile Hash: %s\nPart Size: %d\nChunk: %d\n", h.Common.ToString(), hex.Dump(h.FileHash[:]),
+		h.PartSize, h.Chunk)
+}
+
+func (h *FileLeavesRequestHeader) PacketType() uint8 {
+	return PacketTypeFileLeavesRequest
+}
+
+func (h *FileLeavesRequestHeader) IsValid() bool {
+	return h.Common.IsValid()
+}
+
+// A chunk of a file's leaf hashes, covering parts Chunk*LeavesPerChunk onwards, along with the sibling hashes leading
+// from the chunk's subtree up to the file's Merkle root
+type FileLeavesHeader struct {
+	Common      CommonHeader
+	FileHash    [HashSize]uint8
+	PartSize    uint16
+	Chunk       uint64
+	LeafCount   uint16
+	Leaves      [][HashSize]uint8
+	ProofLength uint8
+	Proof       [][HashSize]uint8
+}
+
+func (h *FileLeavesHeader) Initialize(FileHash [HashSize]uint8, PartSize uint16, Chunk uint64,
+	Leaves [][HashSize]uint8, Proof [][HashSize]uint8) {
+	if len(Leaves) > LeavesPerChunk {
+		Leaves = Leaves[:LeavesPerChunk]
+	}
+	if len(Proof) > MaxProofLength {
+		Proof = Proof[:MaxProofLength]
+	}
+	h.FileHash = FileHash
+	h.PartSize = PartSize
+	h.Chunk = Chunk
+	h.LeafCount = uint16(len(Leaves))
+	h.Leaves = make([][HashSize]uint8, len(Leaves))
+	copy(h.Leaves, Leaves)
+	h.ProofLength = uint8(len(Proof))
+	h.Proof = make([][HashSize]uint8, len(Proof))
+	copy(h.Proof, Proof)
+
+	h.Common.Initialize(uint16(CommonHeaderSize)+HashSize+13+(h.LeafCount+uint16(h.ProofLength))*HashSize,
+		h.PacketType())
+}
+
+func (h *FileLeavesHeader) Serialize() SerializedPacket {
+	raw := make(SerializedPacket, h.Common.PacketLength)
+
+	offset := raw.PutCommonHeader(h.Common)
+	offset = raw.PutArray(offset, h.FileHash[:], HashSize)
+	offset = raw.PutUint16(offset, h.PartSize)
+	offset = raw.PutUint64(offset, h.Chunk)
+	offset = raw.PutUint16(offset, h.LeafCount)
+	for _, hash := range h.Leaves {
+		offset = raw.PutArray(offset, hash[:], HashSize)
+	}
+	offset = raw.PutUint8(offset, h.ProofLength)
+	for _, hash := range h.Proof {
+		offset = raw.PutArray(offset, hash[:], HashSize)
+	}
+
+	raw.CalculateChecksum()
+
+	return raw
+}
+
+func (h *FileLeavesHeader) Deserialize(raw SerializedPacket) bool {
+	if !h.Common.Deserialize(raw) {
+		return false
+	}
+
+	offset := CommonHeaderSize
+	if offset+HashSize+12 > int(h.Common.PacketLength) || int(h.Common.PacketLength) > len(raw) {
+		return false
+	}
+	copy(h.FileHash[:], raw[offset:offset+HashSize])
+	offset += HashSize
+	h.PartSize = binary.BigEndian.Uint16(raw[offset : offset+2])
+	offset += 2
+	h.Chunk = binary.BigEndian.Uint64(raw[offset : offset+8])
+	offset += 8
+	h.LeafCount = binary.BigEndian.Uint16(raw[offset : offset+2])
+	offset += 2
+	if h.LeafCount > LeavesPerChunk || offset+int(h.LeafCount)*HashSize+1 > int(h.Common.PacketLength) {
+		return false
+	}
+	h.Leaves = make([][HashSize]uint8, h.LeafCount)
+	for i := range h.Leaves {
+		copy(h.Leaves[i][:], raw[offset:offset+HashSize])
+		offset += HashSize
+	}
+	h.ProofLength = raw[offset]
+	offset += 1
+	if h.ProofLength > MaxProofLength || offset+int(h.ProofLength)*HashSize > int(h.Common.PacketLength) {
+		return false
+	}
+	h.Proof = make([][HashSize]uint8, h.ProofLength)
+	for i := range h.Proof {
+		copy(h.Proof[i][:], raw[offset:offset+HashSize])
+		offset += HashSize
+	}
+
+	return true
+}
+
+func (h *FileLeavesHeader) ToString() string {
+	return fmt.Sprintf("%sFile Hash: %s\nPart Size: %d\nChunk: %d\nLeaves: %d\nProof Length: %d\n",
+		h.Common.ToString(), hex.Dump(h.FileHash[:]), h.PartSize, h.Chunk, h.LeafCount, h.ProofLength)
+}
+
+func (h *FileLeavesHeader) PacketType() uint8 {
+	return PacketTypeFileLeaves
+}
+
+func (h *FileLeavesHeader) IsValid() bool {
+	return h.Common.IsValid()
+}
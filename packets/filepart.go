@@ -6,38 +6,50 @@ import (
 	"encoding/hex"
 )
 
+// Default number of file bytes carried by each part
+const DefaultPartSize = 1024
+
+// Set when Data holds the part compressed with deflate
+const FilePartDeflate = 1
+
+// Largest part that still fits in a single UDP datagram once headers and encryption are added
+const MaxPartSize = 60000
+
 type FilePartHeader struct {
 	Common     CommonHeader
-	FileHash     [16]uint8
-	PartNumber uint16
-	Padding    uint16
+	FileHash   [HashSize]uint8
+	PartNumber uint64
+	Flags      uint8
+	DataLength uint16
 	Data       []uint8
 }
 
-func (h *FilePartHeader) Initialize(FileHash [16]uint8, PartNumber uint16, Data []uint8) {
+func (h *FilePartHeader) Initialize(FileHash [HashSize]uint8, PartNumber uint64, Flags uint8, Data []uint8) {
 	var dataLength uint16
-	if len(Data) < 1024 {
+	if len(Data) < MaxPartSize {
 		dataLength = uint16(len(Data))
 	} else {
-		dataLength = 1024
+		dataLength = MaxPartSize
 	}
 	h.FileHash = FileHash
 	h.PartNumber = PartNumber
-	h.Padding = 1024 - dataLength
+	h.Flags = Flags
+	h.DataLength = dataLength
 	h.Data = make([]uint8, dataLength)
 	copy(h.Data, Data)
 
-	h.Common.Initialize(uint16(CommonHeaderSize)+20+dataLength, h.PacketType())
+	h.Common.Initialize(uint16(CommonHeaderSize)+HashSize+11+dataLength, h.PacketType())
 }
 
 func (h *FilePartHeader) Serialize() SerializedPacket {
 	raw := make(SerializedPacket, h.Common.PacketLength)
 
-	copy(raw[:CommonHeaderSize], h.Common.Serialize())
-	copy(raw[CommonHeaderSize:CommonHeaderSize+16], h.FileHash[:])
-	binary.BigEndian.PutUint16(raw[CommonHeaderSize+16:CommonHeaderSize+18], h.PartNumber)
-	binary.BigEndian.PutUint16(raw[CommonHeaderSize+18:CommonHeaderSize+20], h.Padding)
-	copy(raw[CommonHeaderSize+20:], h.Data)
+	offset := raw.PutCommonHeader(h.Common)
+	offset = raw.PutArray(offset, h.FileHash[:], HashSize)
+	offset = raw.PutUint64(offset, h.PartNumber)
+	offset = raw.PutUint8(offset, h.Flags)
+	offset = raw.PutUint16(offset, h.DataLength)
+	offset = raw.PutArray(offset, h.Data, h.DataLength)
 
 	raw.CalculateChecksum()
 
@@ -49,18 +61,30 @@ func (h *FilePartHeader) Deserialize(raw SerializedPacket) bool {
 		return false
 	}
 
-	copy(h.FileHash[:], raw[CommonHeaderSize:CommonHeaderSize+16])
-	h.PartNumber = binary.BigEndian.Uint16(raw[CommonHeaderSize+16:CommonHeaderSize+18])
-	h.Padding = binary.BigEndian.Uint16(raw[CommonHeaderSize+18:CommonHeaderSize+20])
-	h.Data = make([]uint8, 1024-h.Padding)
-	copy(h.Data, raw[CommonHeaderSize+20:h.Common.PacketLength])
+	offset := CommonHeaderSize
+	if offset+HashSize+11 > int(h.Common.PacketLength) {
+		return false
+	}
+	copy(h.FileHash[:], raw[offset:offset+HashSize])
+	offset += HashSize
+	h.PartNumber = binary.BigEndian.Uint64(raw[offset : offset+8])
+	offset += 8
+	h.Flags = raw[offset]
+	offset += 1
+	h.DataLength = binary.BigEndian.Uint16(raw[offset : offset+2])
+	offset += 2
+	if offset+int(h.DataLength) > int(h.Common.PacketLength) {
+		return false
+	}
+	h.Data = make([]uint8, h.DataLength)
+	copy(h.Data, raw[offset:offset+int(h.DataLength)])
 
 	return true
 }
 
 func (h *FilePartHeader) ToString() string {
-	return fmt.Sprintf("%sFile Hash: %s\nPartNumber: %d\nPartSize: %d\n", h.Common.ToString(),
-		hex.Dump(h.FileHash[:]), h.PartNumber, 1024-h.Padding)
+	return fmt.Sprintf("%sFile Hash: %s\nPartNumber: %d\nFlags: %d\nPartSize: %d\n", h.Common.ToString(),
+		hex.Dump(h.FileHash[:]), h.PartNumber, h.Flags, h.DataLength)
 }
 
 func (h *FilePartHeader) PacketType() uint8 {
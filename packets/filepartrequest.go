@@ -8,15 +8,23 @@ import (
 
 type FilePartRequestHeader struct {
 	Common     CommonHeader
-	FileHash   [16]uint8
-	PartNumber uint16
+	FileHash   [HashSize]uint8
+	PartNumber uint64
+	PartSize   uint16
+	Flags      uint8
 }
 
-func (h *FilePartRequestHeader) Initialize(FileHash [16]uint8, PartNumber uint16) {
+// Set when the requester would like the part compressed with deflate
+const PartRequestDeflate = 1
+
+// The part size is chosen by the downloader so that every peer splits the file the same way
+func (h *FilePartRequestHeader) Initialize(FileHash [HashSize]uint8, PartNumber uint64, PartSize uint16, Flags uint8) {
 	h.FileHash = FileHash
 	h.PartNumber = PartNumber
+	h.PartSize = PartSize
+	h.Flags = Flags
 
-	h.Common.Initialize(uint16(CommonHeaderSize)+18, h.PacketType())
+	h.Common.Initialize(uint16(CommonHeaderSize)+HashSize+11, h.PacketType())
 }
 
 func (h *FilePartRequestHeader) Serialize() SerializedPacket {
@@ -24,7 +32,9 @@ func (h *FilePartRequestHeader) Serialize() SerializedPacket {
 
 	offset := raw.PutCommonHeader(h.Common)
 	offset = raw.PutArray(offset, h.FileHash[:], uint16(len(h.FileHash)))
-	offset = raw.PutUint16(offset, h.PartNumber)
+	offset = raw.PutUint64(offset, h.PartNumber)
+	offset = raw.PutUint16(offset, h.PartSize)
+	offset = raw.PutUint8(offset, h.Flags)
 
 	raw.CalculateChecksum()
 
@@ -36,15 +46,24 @@ func (h *FilePartRequestHeader) Deserialize(raw SerializedPacket) bool {
 		return false
 	}
 
-	copy(h.FileHash[:], raw[CommonHeaderSize:CommonHeaderSize+16])
-	h.PartNumber = binary.BigEndian.Uint16(raw[CommonHeaderSize+16 : h.Common.PacketLength])
+	offset := CommonHeaderSize
+	if offset+HashSize+11 > int(h.Common.PacketLength) {
+		return false
+	}
+	copy(h.FileHash[:], raw[offset:offset+HashSize])
+	offset += HashSize
+	h.PartNumber = binary.BigEndian.Uint64(raw[offset : offset+8])
+	offset += 8
+	h.PartSize = binary.BigEndian.Uint16(raw[offset : offset+2])
+	offset += 2
+	h.Flags = raw[offset]
 
 	return true
 }
 
 func (h *FilePartRequestHeader) ToString() string {
-	return fmt.Sprintf("%sFile Hash: %s\nPartNumber: %d\n", h.Common.ToString(),
-		hex.Dump(h.FileHash[:]), h.PartNumber)
+	return fmt.Sprintf("%sFile Hash: %s\nPartNumber: %d\nPartSize: %d\nFlags: %d\n", h.Common.ToString(),
+		hex.Dump(h.FileHash[:]), h.PartNumber, h.PartSize, h.Flags)
 }
 
 func (h *FilePartRequestHeader) PacketType() uint8 {
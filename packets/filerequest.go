@@ -9,16 +9,16 @@ import (
 
 type FileRequestHeader struct {
 	Common          CommonHeader
-	FileHash        [16]uint8
+	FileHash        [HashSize]uint8
 	RequesterLength uint16
 	Requester       string
 	RequesterPort   uint16
 }
 
-func (h *FileRequestHeader) Initialize(FileHash [16]uint8, self node.Node) {
+func (h *FileRequestHeader) Initialize(FileHash [HashSize]uint8, self node.Node) {
 	dataLength := 0
 	h.FileHash = FileHash
-	dataLength += 16
+	dataLength += HashSize
 	h.RequesterLength = uint16(len(self.Address))
 	dataLength += 2
 	h.Requester = self.Address
@@ -49,8 +49,8 @@ func (h *FileRequestHeader) Deserialize(raw SerializedPacket) bool {
 	}
 
 	offset := CommonHeaderSize
-	copy(h.FileHash[:], raw[offset:offset+16])
-	offset += 16
+	copy(h.FileHash[:], raw[offset:offset+HashSize])
+	offset += HashSize
 	h.RequesterLength = binary.BigEndian.Uint16(raw[offset:offset+2])
 	offset += 2
 	h.Requester = string(raw[offset:offset+int(h.RequesterLength)])
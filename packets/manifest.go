@@ -1,22 +1,22 @@
 package packets
 
 type FileDigest struct {
-	FileSize         uint32
+	FileSize         uint64
 	RelativeFilePath string
 }
 
-type FileManifest map[[16]uint8]FileDigest
+type FileManifest map[[HashSize]uint8]FileDigest
 
 type ManifestHeader struct {
 	Common     CommonHeader
-	FileHashes [][16]uint8
+	FileHashes [][HashSize]uint8
 }
 
 func (h *ManifestHeader) Initialize(manifest FileManifest) {
 	dataLength := 0
 
 	for checksum := range manifest {
-		dataLength += 16
+		dataLength += HashSize
 		h.FileHashes = append(h.FileHashes, checksum)
 	}
 
@@ -28,7 +28,7 @@ func (h *ManifestHeader) Serialize() SerializedPacket {
 
 	copy(raw[:CommonHeaderSize], h.Common.Serialize())
 	for i, hash := range h.FileHashes {
-		copy(raw[CommonHeaderSize+i*16:CommonHeaderSize+(i+1)*16], hash[:])
+		copy(raw[CommonHeaderSize+i*HashSize:CommonHeaderSize+(i+1)*HashSize], hash[:])
 	}
 
 	raw.CalculateChecksum()
@@ -41,12 +41,12 @@ func (h *ManifestHeader) Deserialize(raw SerializedPacket) bool {
 	if !h.Common.Deserialize(raw) {
 		return false
 	}
-	h.FileHashes = make([][16]uint8, 0)
+	h.FileHashes = make([][HashSize]uint8, 0)
 
-	numHashes := (h.Common.PacketLength - CommonHeaderSize) / 16
+	numHashes := (h.Common.PacketLength - CommonHeaderSize) / HashSize
 	for i := uint16(0); i < numHashes; i++ {
-		var hash [16]uint8
-		copy(hash[:], raw[CommonHeaderSize+i*16:CommonHeaderSize+(i+1)*16])
+		var hash [HashSize]uint8
+		copy(hash[:], raw[CommonHeaderSize+i*HashSize:CommonHeaderSize+(i+1)*HashSize])
 		h.FileHashes = append(h.FileHashes, hash)
 	}
 
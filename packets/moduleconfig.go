@@ -0,0 +1,115 @@
+package packets
+
+import (
+	"fmt"
+	"encoding/binary"
+)
+
+// Module config flags
+const ModuleConfigSecret = 1
+const ModuleConfigDeleted = 2
+
+type ModuleConfigHeader struct {
+	Common      CommonHeader
+	Revision    uint64
+	Flags       uint8
+	NameLength  uint16
+	ModuleName  string
+	ScopeLength uint16
+	Scope       string
+	KeyLength   uint16
+	Key         string
+	ValueLength uint16
+	Value       string
+}
+
+func (h *ModuleConfigHeader) Initialize(ModuleName string, Scope string, Key string, Value string, Flags uint8,
+	Revision uint64) {
+	dataLength := 0
+	h.Revision = Revision
+	dataLength += 8
+	h.Flags = Flags
+	dataLength += 1
+	h.NameLength = uint16(len(ModuleName))
+	h.ModuleName = ModuleName
+	dataLength += 2 + len(ModuleName)
+	h.ScopeLength = uint16(len(Scope))
+	h.Scope = Scope
+	dataLength += 2 + len(Scope)
+	h.KeyLength = uint16(len(Key))
+	h.Key = Key
+	dataLength += 2 + len(Key)
+	h.ValueLength = uint16(len(Value))
+	h.Value = Value
+	dataLength += 2 + len(Value)
+
+	h.Common.Initialize(uint16(CommonHeaderSize+dataLength), h.PacketType())
+}
+
+func (h *ModuleConfigHeader) Serialize() SerializedPacket {
+	raw := make(SerializedPacket, h.Common.PacketLength)
+
+	offset := raw.PutCommonHeader(h.Common)
+	offset = raw.PutUint64(offset, h.Revision)
+	offset = raw.PutUint8(offset, h.Flags)
+	offset = raw.PutUint16(offset, h.NameLength)
+	offset = raw.PutArray(offset, []uint8(h.ModuleName), h.NameLength)
+	offset = raw.PutUint16(offset, h.ScopeLength)
+	offset = raw.PutArray(offset, []uint8(h.Scope), h.ScopeLength)
+	offset = raw.PutUint16(offset, h.KeyLength)
+	offset = raw.PutArray(offset, []uint8(h.Key), h.KeyLength)
+	offset = raw.PutUint16(offset, h.ValueLength)
+	offset = raw.PutArray(offset, []uint8(h.Value), h.ValueLength)
+
+	raw.CalculateChecksum()
+
+	return raw
+}
+
+func (h *ModuleConfigHeader) Deserialize(raw SerializedPacket) bool {
+	if !h.Common.Deserialize(raw) {
+		return false
+	}
+
+	offset := CommonHeaderSize
+	if offset+9 > int(h.Common.PacketLength) {
+		return false
+	}
+	h.Revision = binary.BigEndian.Uint64(raw[offset : offset+8])
+	offset += 8
+	h.Flags = raw[offset]
+	offset += 1
+	ok := false
+	if h.NameLength, h.ModuleName, offset, ok = raw.GetString(offset, h.Common.PacketLength); !ok {
+		return false
+	}
+	if h.ScopeLength, h.Scope, offset, ok = raw.GetString(offset, h.Common.PacketLength); !ok {
+		return false
+	}
+	if h.KeyLength, h.Key, offset, ok = raw.GetString(offset, h.Common.PacketLength); !ok {
+		return false
+	}
+	if h.ValueLength, h.Value, offset, ok = raw.GetString(offset, h.Common.PacketLength); !ok {
+		return false
+	}
+
+	return true
+}
+
+// Secret values are never printed
+func (h *ModuleConfigHeader) ToString() string {
+	value := h.Value
+	if h.Flags&ModuleConfigSecret != 0 {
+		value = "<secret>"
+	}
+	return fmt.Sprintf("%sModule: %s\nScope: %s\nKey: %s\nValue: %s\nRevision: %d\n", h.Common.ToString(),
+		h.ModuleName, h.Scope, h.Key, value, h.Revision)
+}
+
+func (h *ModuleConfigHeader) PacketType() uint8 {
+	return PacketTypeModuleConfig
+}
+
+func (h *ModuleConfigHeader) IsValid() bool {
+	return h.Common.IsValid()
+}
@@ -0,0 +1,181 @@
+package packets
+
+import (
+	"fmt"
+	"encoding/binary"
+	"swarmd/node"
+)
+
+// Largest response body that fits in a single packet
+const MaxQueryResponseSize = 60000
+
+// A question for every node in the swarm, such as "usage". It is flooded like a file request and each node answers
+// directly to the requester with a QueryResponseHeader carrying the same QueryID.
+type QueryHeader struct {
+	Common          CommonHeader
+	QueryID         uint64
+	RequesterLength uint16
+	Requester       string
+	RequesterPort   uint16
+	QueryLength     uint16
+	Query           string
+}
+
+func (h *QueryHeader) Initialize(QueryID uint64, requester node.Node, Query string) {
+	dataLength := 0
+	h.QueryID = QueryID
+	dataLength += 8
+	h.RequesterLength = uint16(len(requester.Address))
+	dataLength += 2
+	h.Requester = requester.Address
+	dataLength += len(requester.Address)
+	h.RequesterPort = requester.Port
+	dataLength += 2
+	h.QueryLength = uint16(len(Query))
+	dataLength += 2
+	h.Query = Query
+	dataLength += len(Query)
+
+	h.Common.Initialize(uint16(CommonHeaderSize+dataLength), h.PacketType())
+}
+
+func (h *QueryHeader) Serialize() SerializedPacket {
+	raw := make(SerializedPacket, h.Common.PacketLength)
+
+	offset := raw.PutCommonHeader(h.Common)
+	offset = raw.PutUint64(offset, h.QueryID)
+	offset = raw.PutUint16(offset, h.RequesterLength)
+	offset = raw.PutArray(offset, []uint8(h.Requester), h.RequesterLength)
+	offset = raw.PutUint16(offset, h.RequesterPort)
+	offset = raw.PutUint16(offset, h.QueryLength)
+	offset = raw.PutArray(offset, []uint8(h.Query), h.QueryLength)
+
+	raw.CalculateChecksum()
+
+	return raw
+}
+
+func (h *QueryHeader) Deserialize(raw SerializedPacket) bool {
+	if !h.Common.Deserialize(raw) {
+		return false
+	}
+
+	offset := CommonHeaderSize
+	if offset+8 > int(h.Common.PacketLength) {
+		return false
+	}
+	h.QueryID = binary.BigEndian.Uint64(raw[offset : offset+8])
+	offset += 8
+	ok := false
+	if h.RequesterLength, h.Requester, offset, ok = raw.GetString(offset, h.Common.PacketLength); !ok {
+		return false
+	}
+	if offset+2 > int(h.Common.PacketLength) {
+		return false
+	}
+	h.RequesterPort = binary.BigEndian.Uint16(raw[offset : offset+2])
+	offset += 2
+	if h.QueryLength, h.Query, offset, ok = raw.GetString(offset, h.Common.PacketLength); !ok {
+		return false
+	}
+
+	return true
+}
+
+func (h *QueryHeader) ToString() string {
+	return fmt.Sprintf("%sQuery ID: %d\nRequester: %s:%d\nQuery: %s\n", h.Common.ToString(), h.QueryID, h.Requester,
+		h.RequesterPort, h.Query)
+}
+
+func (h *QueryHeader) PacketType() uint8 {
+	return PacketTypeQuery
+}
+
+func (h *QueryHeader) IsValid() bool {
+	return h.Common.IsValid()
+}
+
+func (h *QueryHeader) GetRequester() node.Node {
+	return node.Node{Address: h.Requester, Port: h.RequesterPort}
+}
+
+// One node's answer to a query. The response is JSON whose shape depends on the query.
+type QueryResponseHeader struct {
+	Common         CommonHeader
+	QueryID        uint64
+	NodeLength     uint16
+	Node           string
+	ResponseLength uint16
+	Response       string
+}
+
+// Responses larger than MaxQueryResponseSize can't be sent, cutting them short would leave invalid JSON. They are
+// replaced with an error instead.
+func (h *QueryResponseHeader) Initialize(QueryID uint64, Node string, Response string) {
+	if len(Response) > MaxQueryResponseSize {
+		Response = fmt.Sprintf(`{"Error":"response too large: %d bytes"}`, len(Response))
+	}
+	dataLength := 0
+	h.QueryID = QueryID
+	dataLength += 8
+	h.NodeLength = uint16(len(Node))
+	dataLength += 2
+	h.Node = Node
+	dataLength += len(Node)
+	h.ResponseLength = uint16(len(Response))
+	dataLength += 2
+	h.Response = Response
+	dataLength += len(Response)
+
+	h.Common.Initialize(uint16(CommonHeaderSize+dataLength), h.PacketType())
+}
+
+func (h *QueryResponseHeader) Serialize() SerializedPacket {
+	raw := make(SerializedPacket, h.Common.PacketLength)
+
+	offset := raw.PutCommonHeader(h.Common)
+	offset = raw.PutUint64(offset, h.QueryID)
+	offset = raw.PutUint16(offset, h.NodeLength)
+	offset = raw.PutArray(offset, []uint8(h.Node), h.NodeLength)
+	offset = raw.PutUint16(offset, h.ResponseLength)
+	offset = raw.PutArray(offset, []uint8(h.Response), h.ResponseLength)
+
+	raw.CalculateChecksum()
+
+	return raw
+}
+
+func (h *QueryResponseHeader) Deserialize(raw SerializedPacket) bool {
+	if !h.Common.Deserialize(raw) {
+		return false
+	}
+
+	offset := CommonHeaderSize
+	if offset+8 > int(h.Common.PacketLength) {
+		return false
+	}
+	h.QueryID = binary.BigEndian.Uint64(raw[offset : offset+8])
+	offset += 8
+	ok := false
+	if h.NodeLength, h.Node, offset, ok = raw.GetString(offset, h.Common.PacketLength); !ok {
+		return false
+	}
+	if h.ResponseLength, h.Response, offset, ok = raw.GetString(offset, h.Common.PacketLength); !ok {
+		return false
+	}
+
+	return true
+}
+
+func (h *QueryResponseHeader) ToString() string {
+	return fmt.Sprintf("%sQuery ID: %d\nNode: %s\nResponse: %s\n", h.Common.ToString(), h.QueryID, h.Node,
+		h.Response)
+}
+
+func (h *QueryResponseHeader) PacketType() uint8 {
+	return PacketTypeQueryResponse
+}
+
+func (h *QueryResponseHeader) IsValid() bool {
+	return h.Common.IsValid()
+}
@@ -0,0 +1,24 @@
+package packets
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestQueryResponseTooLarge(t *testing.T) {
+	response := new(QueryResponseHeader)
+	response.Initialize(1, "10.0.0.1:51234", `"`+strings.Repeat("a", MaxQueryResponseSize)+`"`)
+
+	parsed := new(QueryResponseHeader)
+	if !parsed.Deserialize(response.Serialize()) {
+		t.Fatal("unable to deserialize the response")
+	}
+	var answer map[string]string
+	if err := json.Unmarshal([]byte(parsed.Response), &answer); err != nil {
+		t.Fatalf("expected valid JSON, got %v", err)
+	}
+	if !strings.HasPrefix(answer["Error"], "response too large") {
+		t.Errorf("expected a size error, got %q", parsed.Response)
+	}
+}
@@ -0,0 +1,178 @@
+package packets
+
+import (
+	"fmt"
+	"encoding/binary"
+)
+
+// Files are split into buckets by the top bits of their hash, so that peers only swap the buckets they disagree on
+const ShareSummaryBuckets = 16
+
+// Set on a summary sent in answer to another, so that the exchange stops there
+const ShareSummaryReply = 1
+
+// Most entry bytes sent in one packet, larger buckets are sent over several packets
+const MaxShareEntriesSize = 60000
+
+// A compact description of every file a node knows the swarm holds, along with its replication policy. Each bucket is
+// a hash over the bucket's entries in order, so two nodes that know the same files send identical summaries.
+type ShareSummaryHeader struct {
+	Common  CommonHeader
+	Flags   uint8
+	Count   uint32
+	Buckets [ShareSummaryBuckets][HashSize]uint8
+}
+
+func (h *ShareSummaryHeader) Initialize(Flags uint8, Count uint32, Buckets [ShareSummaryBuckets][HashSize]uint8) {
+	h.Flags = Flags
+	h.Count = Count
+	h.Buckets = Buckets
+
+	h.Common.Initialize(uint16(CommonHeaderSize)+5+ShareSummaryBuckets*HashSize, h.PacketType())
+}
+
+func (h *ShareSummaryHeader) Serialize() SerializedPacket {
+	raw := make(SerializedPacket, h.Common.PacketLength)
+
+	offset := raw.PutCommonHeader(h.Common)
+	offset = raw.PutUint8(offset, h.Flags)
+	offset = raw.PutUint32(offset, h.Count)
+	for _, bucket := range h.Buckets {
+		offset = raw.PutArray(offset, bucket[:], HashSize)
+	}
+
+	raw.CalculateChecksum()
+
+	return raw
+}
+
+func (h *ShareSummaryHeader) Deserialize(raw SerializedPacket) bool {
+	if !h.Common.Deserialize(raw) {
+		return false
+	}
+
+	offset := CommonHeaderSize
+	if offset+5+ShareSummaryBuckets*HashSize > int(h.Common.PacketLength) {
+		return false
+	}
+	h.Flags = raw[offset]
+	offset += 1
+	h.Count = binary.BigEndian.Uint32(raw[offset : offset+4])
+	offset += 4
+	for i := range h.Buckets {
+		copy(h.Buckets[i][:], raw[offset:offset+HashSize])
+		offset += HashSize
+	}
+
+	return true
+}
+
+func (h *ShareSummaryHeader) ToString() string {
+	return fmt.Sprintf("%sFlags: %d\nCount: %d\n", h.Common.ToString(), h.Flags, h.Count)
+}
+
+func (h *ShareSummaryHeader) PacketType() uint8 {
+	return PacketTypeShareSummary
+}
+
+func (h *ShareSummaryHeader) IsValid() bool {
+	return h.Common.IsValid()
+}
+
+// A file and the replication policy it was last deployed with
+type ShareEntry struct {
+	FileHash [HashSize]uint8
+	Policy   string
+	Revision uint64
+}
+
+// The entries of the buckets a peer's summary disagreed on
+type ShareEntriesHeader struct {
+	Common  CommonHeader
+	Count   uint16
+	Entries []ShareEntry
+}
+
+// Entries that don't fit in MaxShareEntriesSize are left off, callers split larger lists over several packets
+func (h *ShareEntriesHeader) Initialize(Entries []ShareEntry) {
+	dataLength := 2
+	h.Entries = make([]ShareEntry, 0, len(Entries))
+	for _, entry := range Entries {
+		if dataLength+ShareEntrySize(entry) > MaxShareEntriesSize {
+			break
+		}
+		h.Entries = append(h.Entries, entry)
+		dataLength += ShareEntrySize(entry)
+	}
+	h.Count = uint16(len(h.Entries))
+
+	h.Common.Initialize(uint16(CommonHeaderSize+dataLength), h.PacketType())
+}
+
+// Bytes an entry takes up in a ShareEntriesHeader
+func ShareEntrySize(entry ShareEntry) int {
+	return HashSize + 10 + len(entry.Policy)
+}
+
+func (h *ShareEntriesHeader) Serialize() SerializedPacket {
+	raw := make(SerializedPacket, h.Common.PacketLength)
+
+	offset := raw.PutCommonHeader(h.Common)
+	offset = raw.PutUint16(offset, h.Count)
+	for _, entry := range h.Entries {
+		offset = raw.PutArray(offset, entry.FileHash[:], HashSize)
+		offset = raw.PutUint16(offset, uint16(len(entry.Policy)))
+		offset = raw.PutArray(offset, []uint8(entry.Policy), uint16(len(entry.Policy)))
+		offset = raw.PutUint64(offset, entry.Revision)
+	}
+
+	raw.CalculateChecksum()
+
+	return raw
+}
+
+func (h *ShareEntriesHeader) Deserialize(raw SerializedPacket) bool {
+	if !h.Common.Deserialize(raw) {
+		return false
+	}
+
+	offset := CommonHeaderSize
+	if offset+2 > int(h.Common.PacketLength) {
+		return false
+	}
+	h.Count = binary.BigEndian.Uint16(raw[offset : offset+2])
+	offset += 2
+	h.Entries = make([]ShareEntry, 0, h.Count)
+	for i := uint16(0); i < h.Count; i++ {
+		var entry ShareEntry
+		if offset+HashSize > int(h.Common.PacketLength) {
+			return false
+		}
+		copy(entry.FileHash[:], raw[offset:offset+HashSize])
+		offset += HashSize
+		ok := false
+		if _, entry.Policy, offset, ok = raw.GetString(offset, h.Common.PacketLength); !ok {
+			return false
+		}
+		if offset+8 > int(h.Common.PacketLength) {
+			return false
+		}
+		entry.Revision = binary.BigEndian.Uint64(raw[offset : offset+8])
+		offset += 8
+		h.Entries = append(h.Entries, entry)
+	}
+
+	return true
+}
+
+func (h *ShareEntriesHeader) ToString() string {
+	return fmt.Sprintf("%sCount: %d\n", h.Common.ToString(), h.Count)
+}
+
+func (h *ShareEntriesHeader) PacketType() uint8 {
+	return PacketTypeShareEntries
+}
+
+func (h *ShareEntriesHeader) IsValid() bool {
+	return h.Common.IsValid()
+}
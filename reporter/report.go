@@ -0,0 +1,94 @@
+package reporter
+
+import (
+	"swarmd/control"
+	"fmt"
+	"time"
+)
+
+// What is reported about the node each interval. self and peers are kept as they were for existing check-in
+// servers.
+type CheckIn struct {
+	Self         string             `json:"self"`
+	Peers        []string           `json:"peers"`
+	Time         time.Time          `json:"time"`
+	Health       Health             `json:"health"`
+	Version      string             `json:"version,omitempty"`
+	Platform     string             `json:"platform,omitempty"`
+	Uptime       time.Duration      `json:"uptime"`
+	Labels       []string           `json:"labels"`
+	PeerActivity []control.Peer     `json:"peerActivity"`
+	Modules      []control.Module   `json:"modules"`
+	Share        control.ShareUsage `json:"share"`
+}
+
+// Health is "ok", "degraded" when something needs a look, or "unreachable" when the node didn't answer
+type Health struct {
+	Status string   `json:"status"`
+	Issues []string `json:"issues"`
+}
+
+// Gathers what the node says about itself. Nothing here waits longer than the client's timeout.
+func Collect(client *control.Client, self string) CheckIn {
+	report := CheckIn{
+		Self:         self,
+		Peers:        make([]string, 0),
+		Time:         time.Now().UTC(),
+		Health:       Health{Status: "ok", Issues: make([]string, 0)},
+		Labels:       make([]string, 0),
+		PeerActivity: make([]control.Peer, 0),
+		Modules:      make([]control.Module, 0),
+	}
+	if client == nil {
+		report.Health = Health{Status: "unreachable", Issues: []string{"unable to connect to node"}}
+		return report
+	}
+	peers, err := client.ListPeers()
+	if err != nil {
+		report.Health = Health{Status: "unreachable", Issues: []string{fmt.Sprintf("peers: %v", err)}}
+		return report
+	}
+	report.Peers = peers
+	var status control.NodeStatus
+	if err := client.QueryLocal("status", &status); err != nil {
+		report.Health.Issues = append(report.Health.Issues, fmt.Sprintf("status: %v", err))
+	} else {
+		report.Version = status.Version
+		report.Platform = status.Platform
+		report.Uptime = status.Uptime
+		report.Share = status.Share
+		if status.Labels != nil {
+			report.Labels = status.Labels
+		}
+	}
+	if err := client.QueryLocal("peers", &report.PeerActivity); err != nil {
+		report.Health.Issues = append(report.Health.Issues, fmt.Sprintf("peer activity: %v", err))
+	}
+	if err := client.QueryLocal("modules", &report.Modules); err != nil {
+		report.Health.Issues = append(report.Health.Issues, fmt.Sprintf("modules: %v", err))
+	}
+	report.Health = assessHealth(report)
+	return report
+}
+
+// Lists what needs a look in a report the node answered
+func assessHealth(report CheckIn) Health {
+	health := report.Health
+	if len(report.Peers) == 0 {
+		health.Issues = append(health.Issues, "no peers")
+	}
+	if report.Share.Quota > 0 && report.Share.Bytes > report.Share.Quota {
+		health.Issues = append(health.Issues, "share is over its quota")
+	}
+	for _, module := range report.Modules {
+		if module.Desired == "running" && !module.Active {
+			health.Issues = append(health.Issues, fmt.Sprintf("%s should be running but isn't", module.Name))
+		} else if (module.Desired == "installed" || module.Desired == "running") && !module.Installed {
+			health.Issues = append(health.Issues, fmt.Sprintf("%s should be installed but isn't", module.Name))
+		}
+	}
+	if len(health.Issues) > 0 {
+		health.Status = "degraded"
+	}
+	return health
+}
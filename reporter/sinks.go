@@ -0,0 +1,226 @@
+package reporter
+
+import (
+	"time"
+	"fmt"
+	"log"
+	"os"
+	"net"
+	"net/http"
+	"net/url"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"crypto/tls"
+	"crypto/x509"
+	"bytes"
+	"errors"
+)
+
+// How long a sink waits before retrying after a failed report, doubling up to the maximum
+const minBackoff = 5 * time.Second
+const maxBackoff = 5 * time.Minute
+
+// How long a sink gets to take a report
+const sinkTimeout = 10 * time.Second
+
+// Somewhere reports are sent
+type Sink interface {
+	Send(report []byte) error
+	String() string
+}
+
+// Makes a sink from a URL: http:// or https://, file:///path or unix:///path
+func NewSink(sinkURL string, headers http.Header, tlsConfig *tls.Config) (Sink, error) {
+	parsed, err := url.Parse(sinkURL)
+	if err != nil {
+		return nil, err
+	}
+	switch parsed.Scheme {
+	case "http", "https":
+		client := &http.Client{
+			Timeout:   sinkTimeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+		}
+		return &httpSink{url: sinkURL, client: client, headers: headers}, nil
+	case "file":
+		if parsed.Path == "" {
+			return nil, errors.New("no path given")
+		}
+		return &fileSink{path: parsed.Path}, nil
+	case "unix":
+		if parsed.Path == "" {
+			return nil, errors.New("no path given")
+		}
+		return &unixSink{path: parsed.Path}, nil
+	}
+	return nil, fmt.Errorf("unknown scheme %q", parsed.Scheme)
+}
+
+// Builds the TLS settings for HTTPS sinks
+func NewTLSConfig(caCert string, clientCert string, clientKey string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caCert != "" {
+		data, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", caCert)
+		}
+		config.RootCAs = pool
+	}
+	if clientCert != "" || clientKey != "" {
+		certificate, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+// Parses headers given as "Name: value"
+func ParseHeaders(headers []string) (http.Header, error) {
+	parsed := make(http.Header)
+	for _, header := range headers {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid header %q: must be Name: value", header)
+		}
+		parsed.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return parsed, nil
+}
+
+// Queues a report for a sink, replacing one it hasn't got to yet so a sink that is down only ever sends the latest
+func Publish(queue chan []byte, report []byte) {
+	select {
+	case <-queue:
+	default:
+	}
+	queue <- report
+}
+
+// Sends reports to a sink as they are queued, backing off while it is failing. Returns once the queue is closed.
+func RunSink(sink Sink, queue chan []byte) {
+	runSink(sink, queue, minBackoff, maxBackoff)
+}
+
+func runSink(sink Sink, queue chan []byte, minWait time.Duration, maxWait time.Duration) {
+	backoff := minWait
+	for report := range queue {
+		for {
+			err := sink.Send(report)
+			if err == nil {
+				backoff = minWait
+				break
+			}
+			log.Printf("Unable to report to %s, retrying in %s: %v", sink, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > maxWait {
+				backoff = maxWait
+			}
+			// Retry with a newer report if one came in meanwhile
+			select {
+			case newer, ok := <-queue:
+				if !ok {
+					return
+				}
+				report = newer
+			default:
+			}
+		}
+	}
+}
+
+// The same report is handed to every sink, so each one adds its newline to a copy
+func reportLine(report []byte) []byte {
+	line := make([]byte, len(report)+1)
+	copy(line, report)
+	line[len(report)] = '\n'
+	return line
+}
+
+// POSTs each report as JSON
+type httpSink struct {
+	url     string
+	client  *http.Client
+	headers http.Header
+}
+
+func (s *httpSink) Send(report []byte) error {
+	request, err := http.NewRequest("POST", s.url, bytes.NewReader(report))
+	if err != nil {
+		return err
+	}
+	for name, values := range s.headers {
+		request.Header[name] = values
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 1<<20))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("server answered %s", response.Status)
+	}
+	return nil
+}
+
+func (s *httpSink) String() string {
+	return s.url
+}
+
+// Keeps the latest report in a file, replaced in one go so readers never see half of one
+type fileSink struct {
+	path string
+}
+
+func (s *fileSink) Send(report []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(s.path), "."+filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(reportLine(report)); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(temp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), s.path)
+}
+
+func (s *fileSink) String() string {
+	return s.path
+}
+
+// Writes each report as a line of JSON to a Unix socket, connecting for each one
+type unixSink struct {
+	path string
+}
+
+func (s *unixSink) Send(report []byte) error {
+	conn, err := net.DialTimeout("unix", s.path, sinkTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(sinkTimeout))
+	_, err = conn.Write(reportLine(report))
+	return err
+}
+
+func (s *unixSink) String() string {
+	return fmt.Sprintf("unix:%s", s.path)
+}
@@ -0,0 +1,245 @@
+package reporter
+
+import (
+	"bufio"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records the requests a stand-in check-in server gets, failing the first few with a 503
+type checkInServer struct {
+	lock     sync.Mutex
+	failures int
+	times    []time.Time
+	bodies   []string
+	headers  []http.Header
+	received chan struct{}
+}
+
+func newCheckInServer(failures int) *checkInServer {
+	return &checkInServer{failures: failures, received: make(chan struct{}, 16)}
+}
+
+func (s *checkInServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.lock.Lock()
+	s.times = append(s.times, time.Now())
+	s.bodies = append(s.bodies, string(body))
+	s.headers = append(s.headers, r.Header.Clone())
+	fail := len(s.times) <= s.failures
+	s.lock.Unlock()
+	if fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	s.received <- struct{}{}
+}
+
+func (s *checkInServer) wait(t *testing.T, requests int) {
+	t.Helper()
+	for i := 0; i < requests; i++ {
+		select {
+		case <-s.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only got %d of %d requests", i, requests)
+		}
+	}
+}
+
+func TestHTTPSinkBacksOff(t *testing.T) {
+	handler := newCheckInServer(3)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	sink, err := NewSink(server.URL+"/checkIn", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := make(chan []byte, 1)
+	Publish(queue, []byte(`{"self":"old"}`))
+	go runSink(sink, queue, 50*time.Millisecond, 80*time.Millisecond)
+	handler.wait(t, 2)
+	// A report published while the sink is failing replaces the one being retried
+	Publish(queue, []byte(`{"self":"new"}`))
+	handler.wait(t, 2)
+	close(queue)
+
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	for i, expected := range []time.Duration{50 * time.Millisecond, 80 * time.Millisecond, 80 * time.Millisecond} {
+		if gap := handler.times[i+1].Sub(handler.times[i]); gap < expected {
+			t.Errorf("retry %d came after %v, expected at least %v", i+1, gap, expected)
+		}
+	}
+	if handler.bodies[0] != `{"self":"old"}` || handler.bodies[3] != `{"self":"new"}` {
+		t.Errorf("unexpected reports %q", handler.bodies)
+	}
+}
+
+func TestHTTPSinkHeadersAndTLS(t *testing.T) {
+	handler := newCheckInServer(0)
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+	headers, err := ParseHeaders([]string{"Authorization: Bearer secret", "X-Swarm:  lab "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseHeaders([]string{"no separator"}); err == nil {
+		t.Error("expected a header without a colon to be rejected")
+	}
+
+	// The server's certificate isn't trusted by default
+	tlsConfig, err := NewTLSConfig("", "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, _ := NewSink(server.URL, headers, tlsConfig)
+	if err := sink.Send([]byte("{}")); err == nil {
+		t.Error("expected an untrusted certificate to be rejected")
+	}
+
+	// It is once its CA is given
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caCert, pemData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err = NewTLSConfig(caCert, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, _ = NewSink(server.URL, headers, tlsConfig)
+	if err := sink.Send([]byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	// Or verification is turned off
+	tlsConfig, _ = NewTLSConfig("", "", "", true)
+	sink, _ = NewSink(server.URL, headers, tlsConfig)
+	if err := sink.Send([]byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if len(handler.headers) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(handler.headers))
+	}
+	for _, header := range handler.headers {
+		if header.Get("Authorization") != "Bearer secret" || header.Get("X-Swarm") != "lab" {
+			t.Errorf("headers not passed on: %v", header)
+		}
+		if header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected content type %q", header.Get("Content-Type"))
+		}
+	}
+
+	if _, err := NewTLSConfig(filepath.Join(t.TempDir(), "missing.pem"), "", "", false); err == nil {
+		t.Error("expected a missing CA certificate to be rejected")
+	}
+	if _, err := NewTLSConfig("", "client.pem", "", false); err == nil {
+		t.Error("expected a client certificate without a key to be rejected")
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	sink, err := NewSink("file://"+path, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reports are shared between sinks, so one with room to spare must not be written into
+	buffer := []byte(`{"self":"a"}xxxx`)
+	report := buffer[:12]
+	for _, self := range []string{"a", "b"} {
+		copy(report, `{"self":"`+self+`"}`)
+		if err := sink.Send(report); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != `{"self":"`+self+`"}`+"\n" {
+			t.Errorf("unexpected report %q", data)
+		}
+	}
+	if string(buffer[12:]) != "xxxx" {
+		t.Errorf("report buffer written past its end: %q", buffer)
+	}
+	entries, _ := ioutil.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("expected only the report to be left behind, got %d files", len(entries))
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("unexpected report permissions")
+	}
+
+	if _, err := NewSink("file://", nil, nil); err == nil {
+		t.Error("expected a file sink without a path to be rejected")
+	}
+	if _, err := NewSink("ftp://example.com/report", nil, nil); err == nil {
+		t.Error("expected an unknown scheme to be rejected")
+	}
+}
+
+func TestUnixSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Socket paths are short, so the socket can't go in the test's own temporary directory
+	path := filepath.Join(dir, "s")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	defer listener.Close()
+	lines := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			conn.Close()
+			lines <- line
+		}
+	}()
+
+	sink, err := NewSink("unix://"+path, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := []byte(`{"self":"a"}xxxx`)
+	for i := 0; i < 2; i++ {
+		if err := sink.Send(buffer[:12]); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case line := <-lines:
+			if line != `{"self":"a"}`+"\n" {
+				t.Errorf("unexpected line %q", line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no report arrived")
+		}
+	}
+	if !strings.HasSuffix(string(buffer), "xxxx") {
+		t.Errorf("report buffer written past its end: %q", buffer)
+	}
+
+	listener.Close()
+	if err := sink.Send([]byte("{}")); err == nil {
+		t.Error("expected sending to a closed socket to fail")
+	}
+}
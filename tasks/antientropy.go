@@ -0,0 +1,146 @@
+package tasks
+
+import (
+	"swarmd/packets"
+	"swarmd/node"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// How often each node compares what it knows of share with a random peer
+const antiEntropyInterval = 2 * time.Minute
+
+// Lists every file this node knows the swarm holds, in hash order. Only files announced with a deployment are listed,
+// whether or not this node keeps a copy; files in share with no known policy are left to the nodes that know it.
+// Deleted files are listed with their tombstone so that nodes which missed the deletion don't fetch them again.
+func knownShareEntries(config *commonStruct) []packets.ShareEntry {
+	policies := config.Replication.All()
+	entries := make([]packets.ShareEntry, 0, len(policies))
+	for fileID, record := range policies {
+		decoded, err := hex.DecodeString(fileID)
+		if err != nil || len(decoded) != packets.HashSize {
+			continue
+		}
+		var entry packets.ShareEntry
+		copy(entry.FileHash[:], decoded)
+		// Write policies the same way on every node so that equal knowledge hashes equally
+		if record.deleted() {
+			entry.Policy = deletedPolicy
+		} else {
+			parsed, _ := parseReplicationPolicy(record.Policy)
+			entry.Policy = parsed.String()
+		}
+		entry.Revision = record.Revision
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		return hex.EncodeToString(entries[a].FileHash[:]) < hex.EncodeToString(entries[b].FileHash[:])
+	})
+	return entries
+}
+
+func shareBucket(fileHash [packets.HashSize]uint8) int {
+	return int(fileHash[0]) * packets.ShareSummaryBuckets / 256
+}
+
+func summarizeShare(entries []packets.ShareEntry) [packets.ShareSummaryBuckets][packets.HashSize]uint8 {
+	var hashers [packets.ShareSummaryBuckets][]uint8
+	for _, entry := range entries {
+		bucket := shareBucket(entry.FileHash)
+		hashers[bucket] = append(hashers[bucket], entry.FileHash[:]...)
+		hashers[bucket] = append(hashers[bucket], []uint8(entry.Policy)...)
+		hashers[bucket] = append(hashers[bucket], 0)
+		hashers[bucket] = strconv.AppendUint(hashers[bucket], entry.Revision, 10)
+		hashers[bucket] = append(hashers[bucket], 0)
+	}
+	var buckets [packets.ShareSummaryBuckets][packets.HashSize]uint8
+	for i, data := range hashers {
+		if len(data) > 0 {
+			buckets[i] = sha256.Sum256(data)
+		}
+	}
+	return buckets
+}
+
+// Starts an exchange with a random peer by sending it a summary of share
+func sendShareSummary(config *commonStruct) {
+	peers := knownPeers(config)
+	if len(peers) == 0 {
+		return
+	}
+	entries := knownShareEntries(config)
+	summary := new(packets.ShareSummaryHeader)
+	summary.Initialize(0, uint32(len(entries)), summarizeShare(entries))
+	config.Output <- packets.PeerPacket{Packet: summary, Source: peers[rand.Intn(len(peers))]}
+}
+
+// Sends the peer the entries of every bucket its summary disagrees on, and answers the first summary of an exchange
+// with one of our own so that the peer can send back what this node is missing
+func handleShareSummary(config *commonStruct, summary packets.ShareSummaryHeader, source node.Node) {
+	entries := knownShareEntries(config)
+	buckets := summarizeShare(entries)
+	differing := make([]packets.ShareEntry, 0)
+	for _, entry := range entries {
+		if bucket := shareBucket(entry.FileHash); buckets[bucket] != summary.Buckets[bucket] {
+			differing = append(differing, entry)
+		}
+	}
+	for len(differing) > 0 {
+		response := new(packets.ShareEntriesHeader)
+		response.Initialize(differing)
+		if response.Count == 0 {
+			break
+		}
+		config.Output <- packets.PeerPacket{Packet: response, Source: source}
+		differing = differing[response.Count:]
+	}
+	if summary.Flags&packets.ShareSummaryReply == 0 && buckets != summary.Buckets {
+		reply := new(packets.ShareSummaryHeader)
+		reply.Initialize(packets.ShareSummaryReply, uint32(len(entries)), buckets)
+		config.Output <- packets.PeerPacket{Packet: reply, Source: source}
+	}
+}
+
+// Records the files a peer told us about and returns the ones this node should keep a copy of
+func learnShareEntries(config *commonStruct, self node.Node, entries []packets.ShareEntry) [][packets.HashSize]uint8 {
+	for _, entry := range entries {
+		if entry.Policy == deletedPolicy {
+			config.Replication.MergeDeleted(entry.FileHash, entry.Revision)
+			continue
+		}
+		policy, err := parseReplicationPolicy(entry.Policy)
+		if err != nil {
+			continue
+		}
+		config.Replication.Merge(entry.FileHash, policy, entry.Revision)
+	}
+	return missingShareFiles(config, self, entries)
+}
+
+// Finds the files that this node should keep under their replication policy but doesn't have. While share is over its
+// quota only the files this node needs are fetched, as anything else would just be evicted again.
+func missingShareFiles(config *commonStruct, self node.Node, entries []packets.ShareEntry) [][packets.HashSize]uint8 {
+	peers := knownPeers(config)
+	pinned := pinnedShareFiles(config, self)
+	full := shareFull(config.ShareQuota, pinned)
+	missing := make([][packets.HashSize]uint8, 0)
+	for _, entry := range entries {
+		if full && !pinned[hex.EncodeToString(entry.FileHash[:])] {
+			continue
+		}
+		policy := config.Replication.Get(entry.FileHash)
+		if !blobExists(entry.FileHash) && policy.Includes(entry.FileHash, self, config.Labels, peers) {
+			missing = append(missing, entry.FileHash)
+		}
+	}
+	return missing
+}
+
+// Whether share has reached its quota
+func shareFull(quota int64, pinned map[string]bool) bool {
+	return quota > 0 && GetShareUsage(pinned, quota).Bytes >= quota
+}
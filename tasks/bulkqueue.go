@@ -0,0 +1,93 @@
+package tasks
+
+import (
+	"swarmd/packets"
+	"swarmd/node"
+	"sync"
+	"time"
+	"swarmd/authentication"
+)
+
+// Most bulk packets waiting for any one peer. Anything more is dropped, the peer asks again once its request times
+// out.
+const maxBulkQueue = 64
+
+type bulkPacket struct {
+	packet packets.PeerPacket
+	data   []uint8
+}
+
+// Bulk file data waiting to go out, queued per peer so that a peer held back by its upload limit doesn't hold up the
+// others. Pushing never blocks; the Talker takes the packets round robin as the limits allow.
+type bulkQueue struct {
+	lock   sync.Mutex
+	queues map[node.Node][]*bulkPacket
+	order  []node.Node
+	next   int
+	ready  chan struct{}
+}
+
+func newBulkQueue() *bulkQueue {
+	return &bulkQueue{
+		queues: make(map[node.Node][]*bulkPacket),
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// Queues a packet for its peer, returning false if the peer's queue is full and the packet was dropped
+func (q *bulkQueue) Push(pkt packets.PeerPacket) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	queue, ok := q.queues[pkt.Source]
+	if len(queue) >= maxBulkQueue {
+		return false
+	}
+	if !ok {
+		q.order = append(q.order, pkt.Source)
+	}
+	q.queues[pkt.Source] = append(queue, &bulkPacket{packet: pkt})
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Signalled whenever a packet is queued
+func (q *bulkQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Takes the next packet the limiter lets through, encrypted and ready to send. If every peer is being held back,
+// returns how long until the first of them might be let through instead, or 0 if nothing is queued.
+func (q *bulkQueue) Next(key [32]byte, limiter *rateLimiter) (*bulkPacket, time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	var wait time.Duration
+	for i := 0; i < len(q.order); i++ {
+		position := (q.next + i) % len(q.order)
+		peer := q.order[position]
+		queue := q.queues[peer]
+		head := queue[0]
+		if head.data == nil {
+			head.data = authentication.EncryptPacket(head.packet.Packet.Serialize(), key)
+		}
+		if delay := limiter.Reserve(peer, len(head.data)); delay > 0 {
+			if wait == 0 || delay < wait {
+				wait = delay
+			}
+			continue
+		}
+		if len(queue) > 1 {
+			q.queues[peer] = queue[1:]
+			q.next = position + 1
+		} else {
+			// Forget about peers with nothing left to send
+			delete(q.queues, peer)
+			q.order = append(q.order[:position], q.order[position+1:]...)
+			q.next = position
+		}
+		return head, 0
+	}
+	return nil, wait
+}
@@ -0,0 +1,97 @@
+package tasks
+
+import (
+	"swarmd/node"
+	"swarmd/packets"
+	"testing"
+)
+
+func testFilePart(peer node.Node, partNumber uint64) packets.PeerPacket {
+	filePart := new(packets.FilePartHeader)
+	filePart.Initialize([packets.HashSize]uint8{1}, partNumber, 0, make([]uint8, 1000))
+	return packets.PeerPacket{Packet: filePart, Source: peer}
+}
+
+func TestBulkQueueDropsWhenFull(t *testing.T) {
+	queue := newBulkQueue()
+	peer := node.Node{Address: "10.0.0.1", Port: 1}
+	for i := 0; i < maxBulkQueue; i++ {
+		if !queue.Push(testFilePart(peer, uint64(i))) {
+			t.Fatalf("packet %d dropped before the queue was full", i)
+		}
+	}
+	if queue.Push(testFilePart(peer, maxBulkQueue)) {
+		t.Error("expected a full queue to drop the packet")
+	}
+	// Other peers have queues of their own
+	if !queue.Push(testFilePart(node.Node{Address: "10.0.0.2", Port: 1}, 0)) {
+		t.Error("expected another peer's packet to be queued")
+	}
+	select {
+	case <-queue.Ready():
+	default:
+		t.Error("expected the queue to be ready")
+	}
+}
+
+func TestBulkQueueRoundRobin(t *testing.T) {
+	queue := newBulkQueue()
+	first := node.Node{Address: "10.0.0.1", Port: 1}
+	second := node.Node{Address: "10.0.0.2", Port: 1}
+	for i := uint64(0); i < 3; i++ {
+		queue.Push(testFilePart(first, i))
+	}
+	queue.Push(testFilePart(second, 0))
+
+	var order []node.Node
+	for {
+		bulk, delay := queue.Next([32]byte{}, nil)
+		if bulk == nil {
+			if delay != 0 {
+				t.Errorf("expected no delay once the queue is empty, got %v", delay)
+			}
+			break
+		}
+		if len(bulk.data) == 0 {
+			t.Error("expected the packet to be encrypted")
+		}
+		order = append(order, bulk.packet.Source)
+	}
+	expected := []node.Node{first, second, first, first}
+	if len(order) != len(expected) {
+		t.Fatalf("expected %d packets, got %d", len(expected), len(order))
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Errorf("packet %d went to %v, expected %v", i, order[i], expected[i])
+		}
+	}
+}
+
+func TestBulkQueuePacesPeersSeparately(t *testing.T) {
+	queue := newBulkQueue()
+	limiter := newRateLimiter(0, minBurst)
+	slow := node.Node{Address: "10.0.0.1", Port: 1}
+	fast := node.Node{Address: "10.0.0.2", Port: 1}
+	// Use up nearly all of the slow peer's burst
+	if limiter.Reserve(slow, minBurst-100) != 0 {
+		t.Fatal("expected the burst to be available")
+	}
+
+	queue.Push(testFilePart(slow, 0))
+	queue.Push(testFilePart(fast, 0))
+	bulk, _ := queue.Next([32]byte{}, limiter)
+	if bulk == nil || bulk.packet.Source != fast {
+		t.Fatal("expected the peer within its limit to go first")
+	}
+	bulk, delay := queue.Next([32]byte{}, limiter)
+	if bulk != nil || delay <= 0 {
+		t.Fatal("expected the slow peer to be held back")
+	}
+	if !queue.Push(testFilePart(fast, 1)) {
+		t.Fatal("expected pushing to go on while a peer is held back")
+	}
+	if bulk, _ := queue.Next([32]byte{}, limiter); bulk == nil || bulk.packet.Source != fast {
+		t.Error("expected the held back peer not to hold up the others")
+	}
+}
@@ -31,7 +31,7 @@ func Listener(conn net.PacketConn, config *commonStruct) {
 	go historyMaintainer(history, 10*time.Second)
 	for !*config.KillFlag {
 		// Read the raw byte stream
-		buffer := make(packets.SerializedPacket, 2048)
+		buffer := make(packets.SerializedPacket, 65536)
 		length, addr, err := conn.ReadFrom(buffer)
 		if err != nil {
 			log.Fatal(err)
@@ -71,8 +71,29 @@ func Listener(conn net.PacketConn, config *commonStruct) {
 	}
 }
 
+// Sends packets for the other tasks. Control traffic on Broadcast and Output always goes out first; bulk file data
+// queued on Bulk is only sent when nothing else is waiting, and is paced to the upload limits.
 func Talker(conn net.PacketConn, config *commonStruct) {
 	for !*config.KillFlag {
+		select {
+		case pkt := <-config.Broadcast:
+			SendToAll(conn, config.Key, pkt, config.PeerMap)
+			continue
+		case nodePkt := <-config.Output:
+			Talk(conn, config.Key, nodePkt.Packet, nodePkt.Source)
+			continue
+		default:
+		}
+		bulk, delay := config.Bulk.Next(config.Key, config.Upload)
+		if bulk != nil {
+			sendData(conn, bulk.data, bulk.packet.Source)
+			continue
+		}
+		// Nothing can be sent right now, wait for more packets or for the limits to let the queued ones through
+		var wait <-chan time.Time
+		if delay > 0 {
+			wait = time.After(delay)
+		}
 		select {
 		case pkt := <-config.Broadcast:
 			// Broadcast a message to all peers
@@ -80,6 +101,8 @@ func Talker(conn net.PacketConn, config *commonStruct) {
 		case nodePkt := <-config.Output:
 			// Send a message to a single peer
 			Talk(conn, config.Key, nodePkt.Packet, nodePkt.Source)
+		case <-config.Bulk.Ready():
+		case <-wait:
 		}
 	}
 }
@@ -103,6 +126,10 @@ func Talk(conn net.PacketConn, key [32]byte, pkt packets.Packet, peer node.Node)
 	// Encrypt the packet
 	//log.Printf("Sending packet type %d to %s:%d", pkt.PacketType(), peer.Address, peer.Port)
 	data := authentication.EncryptPacket(pkt.Serialize(), key)
+	return sendData(conn, data, peer)
+}
+
+func sendData(conn net.PacketConn, data []uint8, peer node.Node) bool {
 	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", peer.Address, peer.Port))
 	if err != nil {
 		log.Print(err)
@@ -0,0 +1,43 @@
+package tasks
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// Compresses a part for sending. Returns false if compression doesn't make it any smaller, which is the case for
+// anything already compressed such as module archives.
+func compressPart(data []uint8) ([]uint8, bool) {
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.BestSpeed)
+	if err != nil {
+		return nil, false
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, false
+	}
+	if err := writer.Close(); err != nil {
+		return nil, false
+	}
+	if buffer.Len() >= len(data) {
+		return nil, false
+	}
+	return buffer.Bytes(), true
+}
+
+// Decompresses a received part, refusing to produce more than maxLength bytes
+func decompressPart(data []uint8, maxLength int) ([]uint8, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+	decompressed, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxLength)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > maxLength {
+		return nil, errors.New("decompressed part is too large")
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,80 @@
+package tasks
+
+import (
+	"time"
+)
+
+// Delay based congestion control along the lines of LEDBAT (RFC 6817). Each peer's window of outstanding part
+// requests grows while round trips stay close to the lowest one seen and shrinks as they climb above it, so bulk
+// transfers make way for other traffic as soon as queues start building on the path. Lost requests halve the window
+// as in AIMD.
+
+// Queueing delay the controller aims for. Anything above it means the transfer is filling up a queue somewhere.
+const congestionTarget = 100 * time.Millisecond
+
+// Window growth per round trip when there is no queueing delay at all
+const congestionGain = 1.0
+
+const minCongestionWindow = 1.0
+const maxCongestionWindow = 256.0
+const initialCongestionWindow = 4.0
+
+// The lowest round trip is only trusted for a while, routes change and a stale minimum would throttle forever
+const baseDelayLifetime = 2 * time.Minute
+
+type congestionWindow struct {
+	cwnd       float64
+	ssthresh   float64
+	baseDelay  time.Duration
+	baseSet    time.Time
+	queueDelay time.Duration
+}
+
+func newCongestionWindow() *congestionWindow {
+	return &congestionWindow{cwnd: initialCongestionWindow, ssthresh: maxCongestionWindow}
+}
+
+// Number of requests that may be outstanding
+func (c *congestionWindow) Size() int {
+	return int(c.cwnd)
+}
+
+// Updates the window for a part that arrived. The round trip is only given when it could be measured unambiguously,
+// otherwise the last queueing delay is reused.
+func (c *congestionWindow) OnAck(rtt time.Duration, measured bool) {
+	if measured {
+		now := time.Now()
+		if c.baseDelay == 0 || rtt < c.baseDelay || now.Sub(c.baseSet) > baseDelayLifetime {
+			c.baseDelay = rtt
+			c.baseSet = now
+		}
+		c.queueDelay = rtt - c.baseDelay
+	}
+	if c.cwnd < c.ssthresh && c.queueDelay < congestionTarget/2 {
+		// Slow start until the first sign of trouble
+		c.cwnd += 1
+	} else {
+		offTarget := float64(congestionTarget-c.queueDelay) / float64(congestionTarget)
+		c.cwnd += congestionGain * offTarget / c.cwnd
+		if offTarget < 0 {
+			// Leave slow start for good once the target has been overshot
+			c.ssthresh = c.cwnd
+		}
+	}
+	c.clamp()
+}
+
+// Halves the window after requests went unanswered
+func (c *congestionWindow) OnLoss() {
+	c.cwnd /= 2
+	c.ssthresh = c.cwnd
+	c.clamp()
+}
+
+func (c *congestionWindow) clamp() {
+	if c.cwnd < minCongestionWindow {
+		c.cwnd = minCongestionWindow
+	} else if c.cwnd > maxCongestionWindow {
+		c.cwnd = maxCongestionWindow
+	}
+}
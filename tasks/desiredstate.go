@@ -0,0 +1,150 @@
+package tasks
+
+import (
+	"swarmd/packets"
+	"swarmd/node"
+	"swarmd/util"
+	"path/filepath"
+	"sync"
+	"io/ioutil"
+	"encoding/json"
+	"log"
+	"os"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type desiredModule struct {
+	Name     string
+	State    uint8
+	Version  string
+	Targets  string
+	Revision uint64
+}
+
+// Replicated record of which modules should be installed/running on which nodes. Entries are last-writer-wins on
+// their revision, so any node can merge updates from any peer in any order and still converge.
+type desiredStateStore struct {
+	lock    sync.Mutex
+	path    string
+	modules map[string]desiredModule
+}
+
+func GetDesiredStatePath() string {
+	return filepath.Join(util.GetBasePath(), "state.json")
+}
+
+func loadDesiredState() *desiredStateStore {
+	store := &desiredStateStore{
+		path:    GetDesiredStatePath(),
+		modules: make(map[string]desiredModule),
+	}
+	file, err := ioutil.ReadFile(store.path)
+	if err != nil {
+		return store
+	}
+	if err := json.Unmarshal(file, &store.modules); err != nil {
+		log.Printf("Unable to parse desired state, starting empty: %v", err)
+		store.modules = make(map[string]desiredModule)
+	}
+	return store
+}
+
+// Merges an entry into the store, returning true if it was newer than what was already known
+func (s *desiredStateStore) Update(module desiredModule) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if current, ok := s.modules[module.Name]; ok && current.Revision >= module.Revision {
+		return false
+	}
+	s.modules[module.Name] = module
+	s.save()
+	return true
+}
+
+func (s *desiredStateStore) Get(name string) (desiredModule, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	module, ok := s.modules[name]
+	return module, ok
+}
+
+func (s *desiredStateStore) All() []desiredModule {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	modules := make([]desiredModule, 0, len(s.modules))
+	for _, module := range s.modules {
+		modules = append(modules, module)
+	}
+	return modules
+}
+
+// Writes the store to disk. Must be called with the lock held.
+func (s *desiredStateStore) save() {
+	data, err := json.MarshalIndent(s.modules, "", "  ")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	// Write to a temp file first so a crash can't leave a truncated state file behind
+	tempPath := s.path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0600); err != nil {
+		log.Printf("Unable to save desired state: %v", err)
+		return
+	}
+	if err := os.Rename(tempPath, s.path); err != nil {
+		log.Printf("Unable to save desired state: %v", err)
+	}
+}
+
+// Checks whether a module is meant for the given node. An empty target list means every node.
+func (m desiredModule) TargetsNode(self node.Node) bool {
+	if m.Targets == "" {
+		return true
+	}
+	selfStr := fmt.Sprintf("%s:%d", self.Address, self.Port)
+	for _, target := range strings.Split(m.Targets, ",") {
+		if target == selfStr || target == self.Address {
+			return true
+		}
+	}
+	return false
+}
+
+func (m desiredModule) ToPacket() *packets.DesiredStateHeader {
+	pkt := new(packets.DesiredStateHeader)
+	pkt.Initialize(m.Name, m.State, m.Version, m.Targets, m.Revision)
+	return pkt
+}
+
+func desiredModuleFromPacket(pkt *packets.DesiredStateHeader) desiredModule {
+	return desiredModule{
+		Name:     pkt.ModuleName,
+		State:    pkt.State,
+		Version:  pkt.Version,
+		Targets:  pkt.Targets,
+		Revision: pkt.Revision,
+	}
+}
+
+// Picks a revision for a local change that wins over the current one, even if another node's clock is ahead of ours
+func nextRevision(current uint64) uint64 {
+	revision := uint64(time.Now().UnixNano())
+	if current >= revision {
+		revision = current + 1
+	}
+	return revision
+}
+
+func HandleDesiredState(config *commonStruct, pkt packets.PeerPacket) {
+	header := pkt.Packet.(*packets.DesiredStateHeader)
+	module := desiredModuleFromPacket(header)
+	if !config.DesiredState.Update(module) {
+		return
+	}
+	log.Printf("Desired state for %s changed to %d (revision %d)", module.Name, module.State, module.Revision)
+	// Pass the change along and bring the local node in line with it
+	config.Broadcast <- pkt.Packet
+	config.ModuleControl <- moduleCommand{ModuleName: module.Name, Command: "reconcile"}
+}
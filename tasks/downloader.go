@@ -0,0 +1,638 @@
+package tasks
+
+import (
+	"swarmd/packets"
+	"swarmd/node"
+	"swarmd/util"
+	"path/filepath"
+	"os"
+	"log"
+	"time"
+	"math/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// Number of packets that can wait for a downloader before more are dropped
+const downloadQueueSize = 64
+
+// Bounds on the retransmission timeout, which otherwise follows the measured round trip time
+const minRequestTimeout = 200 * time.Millisecond
+const maxRequestTimeout = 10 * time.Second
+
+// Peers that time out this many requests in a row without delivering anything are dropped
+const maxPeerTimeouts = 8
+
+type outstandingRequest struct {
+	sent          time.Time
+	retransmitted bool
+}
+
+// Peers that send this many parts or chunks of leaves that fail verification are blacklisted for the rest of the
+// download
+const maxBadParts = 3
+
+// If this many different peers send bad data before a single chunk of leaves verifies, the Merkle root in the digest
+// the download started from is likely wrong, so the download is abandoned to be started over with a new digest
+const maxBadPeersBeforeFirstPart = 3
+
+// Largest file and most parts a download can have. Digests come from peers, so these are checked before anything is
+// sized from them.
+const maxDownloadSize = 1 << 40
+const maxDownloadParts = 1 << 24
+
+// Checks that a file from a digest can be downloaded: it has to be within the limits above and the share quota
+func checkDownloadSize(fileInfo packets.FileDigestHeader, quota int64) error {
+	if fileInfo.PartSize == 0 || fileInfo.PartSize > packets.MaxPartSize {
+		return fmt.Errorf("invalid part size %d", fileInfo.PartSize)
+	}
+	if fileInfo.FileSize > maxDownloadSize {
+		return fmt.Errorf("%d bytes is over the limit of %d", fileInfo.FileSize, uint64(maxDownloadSize))
+	}
+	if fileInfo.NumParts() > maxDownloadParts {
+		return fmt.Errorf("%d parts is over the limit of %d", fileInfo.NumParts(), maxDownloadParts)
+	}
+	if quota > 0 && fileInfo.FileSize > uint64(quota) {
+		return fmt.Errorf("%d bytes is over the share quota of %d", fileInfo.FileSize, quota)
+	}
+	return nil
+}
+
+// Checks that a new download fits in the space left on disk. Downloads resumed after a restart already hold some of
+// their space, so they are only held to checkDownloadSize.
+func checkDownloadSpace(fileInfo packets.FileDigestHeader) error {
+	free, err := util.FreeDiskSpace(util.GetBasePath())
+	if err == nil && fileInfo.FileSize > uint64(free) {
+		return fmt.Errorf("%d bytes is more than the %d free on disk", fileInfo.FileSize, free)
+	}
+	return nil
+}
+
+// Chunks of leaves requested at once, and how long before one is asked for again
+const maxLeafRequests = 4
+const leafRequestTimeout = 2 * time.Second
+
+// A download is kept in its part directory as three files: the data itself, preallocated to the full size of the
+// file with each part written at its own offset, a bitmap of the parts that have been written, and the Merkle tree
+// nodes learned so far (see writeLeafChunk)
+const downloadDataFile = "data"
+const downloadBitmapFile = "bitmap"
+const merkleTreeFile = "tree"
+
+// How often a download advertises the parts it has to its peers
+const bitfieldInterval = 5 * time.Second
+
+// Number of candidate parts looked at when picking the rarest one to request next
+const rarestScanLimit = 1024
+
+// Download state for a single peer
+type downloadPeer struct {
+	node        node.Node
+	// Parts the peer has, or nil if it has the whole file
+	have        *partBitmap
+	window      *congestionWindow
+	outstanding map[uint64]outstandingRequest
+	srtt        time.Duration
+	rttvar      time.Duration
+	rto         time.Duration
+	received    uint64
+	timeouts    int
+	badParts    int
+}
+
+func newDownloadPeer(peer node.Node, have *partBitmap) *downloadPeer {
+	return &downloadPeer{
+		node:        peer,
+		have:        have,
+		window:      newCongestionWindow(),
+		outstanding: make(map[uint64]outstandingRequest),
+		rto:         time.Second,
+	}
+}
+
+// Updates the round trip estimate and retransmission timeout from a new sample, as in RFC 6298
+func (p *downloadPeer) sampleRTT(rtt time.Duration) {
+	if p.srtt == 0 {
+		p.srtt = rtt
+		p.rttvar = rtt / 2
+	} else {
+		delta := p.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		p.rttvar = (3*p.rttvar + delta) / 4
+		p.srtt = (7*p.srtt + rtt) / 8
+	}
+	p.rto = p.srtt + 4*p.rttvar
+	if p.rto < minRequestTimeout {
+		p.rto = minRequestTimeout
+	} else if p.rto > maxRequestTimeout {
+		p.rto = maxRequestTimeout
+	}
+}
+
+func (p *downloadPeer) Has(part uint64) bool {
+	return p.have == nil || p.have.Has(part)
+}
+
+// Whether the peer can send a chunk of leaves, which it can once it has any of the parts they cover
+func (p *downloadPeer) HasChunk(chunk uint64, numParts uint64) bool {
+	if p.have == nil {
+		return true
+	}
+	for part := chunk * packets.LeavesPerChunk; part < numParts && part < (chunk+1)*packets.LeavesPerChunk; part++ {
+		if p.have.Has(part) {
+			return true
+		}
+	}
+	return false
+}
+
+// Backs off the retransmission timeout after a request is lost
+func (p *downloadPeer) backoff() {
+	p.timeouts += 1
+	p.rto *= 2
+	if p.rto > maxRequestTimeout {
+		p.rto = maxRequestTimeout
+	}
+}
+
+func FileDownloader(outputDirected chan packets.PeerPacket, outputGeneral chan packets.Packet, self node.Node,
+	fileInfo packets.FileDigestHeader, input chan packets.PeerPacket, newPeers chan node.Node,
+	eventStream chan [packets.HashSize]uint8, limiter *rateLimiter) {
+	// Download finished notification
+	defer (func() { eventStream <- fileInfo.FileHash })()
+	defer finishTransfer(fileInfo.FileHash)
+	// Determine the temp directory for the part to be stored in
+	fileID := hex.EncodeToString(fileInfo.FileHash[:])
+	tempDir := GetPartsPath(fileID)
+	// Set up state variables for downloader
+	numParts := fileInfo.NumParts()
+	partsHave := newPartBitmap(numParts)
+	saveDownloadState(fileInfo)
+	dataPath := filepath.Join(tempDir, downloadDataFile)
+	dataFile, err := os.OpenFile(dataPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("[%s] Unable to download file: %v", fileInfo.FileName, err)
+		return
+	}
+	defer dataFile.Close()
+	// Sparse on most file systems, so space is only used as parts arrive
+	if err := dataFile.Truncate(int64(fileInfo.FileSize)); err != nil {
+		log.Printf("[%s] Unable to download file: %v", fileInfo.FileName, err)
+		return
+	}
+	bitmapFile, err := os.OpenFile(filepath.Join(tempDir, downloadBitmapFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("[%s] Unable to download file: %v", fileInfo.FileName, err)
+		return
+	}
+	defer bitmapFile.Close()
+	treePath := filepath.Join(tempDir, merkleTreeFile)
+	treeFile, err := os.OpenFile(treePath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("[%s] Unable to download file: %v", fileInfo.FileName, err)
+		return
+	}
+	defer treeFile.Close()
+	// Pick up any leaves and parts left over from before a restart
+	numChunks := numLeafChunks(numParts)
+	leavesHave := newPartBitmap(numChunks)
+	loadLeafChunks(treeFile, fileInfo, leavesHave)
+	loadDownloadedParts(dataFile, bitmapFile, treeFile, fileInfo, partsHave, leavesHave)
+	peers := make(map[node.Node]*downloadPeer)
+	blacklist := make(map[node.Node]bool)
+	badPeers := 0
+	// Parts that have been requested and which peer they were requested from
+	inFlight := make(map[uint64]*downloadPeer)
+	retransmits := make(map[uint64]bool)
+	// Chunks of leaves that have been requested and when
+	leafRequests := make(map[uint64]time.Time)
+	// Number of partial peers that have each part. Peers with the whole file are left out since they have every part.
+	availability := make([]uint16, numParts)
+	packetCount := 0
+
+	// Picks the next part to request from a peer. Of the missing parts the peer has that aren't already on their way
+	// and whose leaves have arrived, the one held by the fewest other peers is chosen so that rare parts spread through the swarm first. The scan
+	// starts at a random part so that nodes downloading at the same time fetch different parts from each other. Once
+	// every missing part has been requested, parts outstanding with other peers are handed out again so a slow peer
+	// can't hold up the end of the download.
+	nextPart := func(peer *downloadPeer) (uint64, bool) {
+		if partsHave.Complete() {
+			return 0, false
+		}
+		best, found := uint64(0), false
+		part := uint64(rand.Int63n(int64(numParts)))
+		scanned := 0
+		for i := uint64(0); i < partsHave.Missing() && scanned < rarestScanLimit; i++ {
+			part, _ = partsHave.NextMissing(part)
+			if _, ok := inFlight[part]; ok || !peer.Has(part) || !leavesHave.Has(part/packets.LeavesPerChunk) {
+				continue
+			}
+			scanned += 1
+			if !found || availability[part] < availability[best] {
+				best, found = part, true
+				if availability[best] == 0 {
+					break
+				}
+			}
+		}
+		if found {
+			return best, true
+		}
+		for part, owner := range inFlight {
+			if _, ok := peer.outstanding[part]; !ok && owner != peer && peer.Has(part) {
+				return part, true
+			}
+		}
+		return 0, false
+	}
+	// Asks a peer for chunks of leaves that are still missing, as parts can't be checked until their leaves arrive
+	requestLeaves := func(peer *downloadPeer) {
+		chunk := numChunks - 1
+		for i := uint64(0); i < leavesHave.Missing() && len(leafRequests) < maxLeafRequests; i++ {
+			chunk, _ = leavesHave.NextMissing(chunk)
+			if _, ok := leafRequests[chunk]; ok || !peer.HasChunk(chunk, numParts) {
+				continue
+			}
+			leafRequests[chunk] = time.Now()
+			request := new(packets.FileLeavesRequestHeader)
+			request.Initialize(fileInfo.FileHash, fileInfo.PartSize, chunk)
+			outputDirected <- packets.PeerPacket{Packet: request, Source: peer.node}
+		}
+	}
+	// Tops up a peer's window of outstanding requests. Requests are held back while the download limit is used up,
+	// the ticker tries again once there is room.
+	fill := func(peer *downloadPeer) {
+		requestLeaves(peer)
+		for len(peer.outstanding) < peer.window.Size() {
+			part, ok := nextPart(peer)
+			if !ok {
+				return
+			}
+			if limiter.Reserve(peer.node, int(partLength(fileInfo, part))) > 0 {
+				return
+			}
+			if _, ok := inFlight[part]; !ok {
+				inFlight[part] = peer
+			}
+			peer.outstanding[part] = outstandingRequest{sent: time.Now(), retransmitted: retransmits[part]}
+			requestPart(part, fileInfo, outputDirected, peer.node)
+		}
+	}
+	addPeer := func(peerNode node.Node) *downloadPeer {
+		if blacklist[peerNode] {
+			return nil
+		}
+		peer, ok := peers[peerNode]
+		if !ok {
+			peer = newDownloadPeer(peerNode, nil)
+			peers[peerNode] = peer
+		}
+		return peer
+	}
+	// Records that a peer has a part, for peers that only have some of the file
+	peerHas := func(peer *downloadPeer, part uint64) {
+		if peer.have != nil && part < numParts && !peer.have.Has(part) {
+			peer.have.Set(part)
+			if availability[part] < ^uint16(0) {
+				availability[part] += 1
+			}
+		}
+	}
+	// Takes back a partial peer's contribution to the availability of each part
+	forgetParts := func(peer *downloadPeer) {
+		if peer.have == nil {
+			return
+		}
+		for part := uint64(0); part < numParts; part++ {
+			if peer.have.Has(part) && availability[part] > 0 {
+				availability[part] -= 1
+			}
+		}
+		peer.have = nil
+	}
+	// Sends the parts downloaded so far to a node so that it can fetch them from here
+	sendBitfield := func(target node.Node) {
+		for firstPart := uint64(0); firstPart < numParts; firstPart += 8 * packets.MaxBitfieldSize {
+			bitfield := new(packets.BitfieldHeader)
+			bitfield.Initialize(fileInfo.FileHash, fileInfo.PartSize, firstPart,
+				partsHave.Bytes(firstPart, packets.MaxBitfieldSize))
+			outputDirected <- packets.PeerPacket{Packet: bitfield, Source: target}
+		}
+	}
+	// Forgets about a request, freeing the part up to be requested again
+	release := func(peer *downloadPeer, part uint64) {
+		delete(peer.outstanding, part)
+		if inFlight[part] == peer {
+			delete(inFlight, part)
+			for _, other := range peers {
+				if _, ok := other.outstanding[part]; ok {
+					inFlight[part] = other
+					break
+				}
+			}
+		}
+	}
+	// Stops downloading from a peer, handing its outstanding requests to the others
+	dropPeer := func(peer *downloadPeer) {
+		for part := range peer.outstanding {
+			release(peer, part)
+		}
+		forgetParts(peer)
+		delete(peers, peer.node)
+	}
+	// Counts bad data against a peer, blacklisting it if it keeps sending it. Returns false if the download should be
+	// abandoned, as no one's data matches the root it started from.
+	badData := func(peer *downloadPeer) bool {
+		peer.badParts += 1
+		if peer.badParts == 1 {
+			badPeers += 1
+		}
+		if leavesHave.Count() == 0 && badPeers >= maxBadPeersBeforeFirstPart {
+			log.Printf("[%s] No leaves match the file's Merkle root, restarting the download", fileInfo.FileName)
+			return false
+		}
+		if peer.badParts >= maxBadParts {
+			log.Printf("[%s] Blacklisting %s:%d for sending bad data", fileInfo.FileName, peer.node.Address,
+				peer.node.Port)
+			blacklist[peer.node] = true
+			dropPeer(peer)
+		} else {
+			fill(peer)
+		}
+		return true
+	}
+
+	// Makes the download's progress and per-peer congestion state available to status reports
+	publish := func() {
+		status := transferStatus{
+			FileHash:  fileInfo.FileHash,
+			FileName:  fileInfo.FileName,
+			FileSize:  fileInfo.FileSize,
+			NumParts:  numParts,
+			PartsHave: partsHave.Count(),
+		}
+		for _, peer := range peers {
+			status.Peers = append(status.Peers, transferPeerStatus{
+				Peer:        peer.node,
+				Partial:     peer.have != nil,
+				Window:      peer.window.Size(),
+				Outstanding: len(peer.outstanding),
+				RTT:         peer.srtt,
+				BaseRTT:     peer.window.baseDelay,
+				Received:    peer.received,
+			})
+		}
+		publishTransfer(status)
+	}
+
+	if partsHave.Count() > 0 {
+		log.Printf("[%s] Resuming download with %d of %d parts...", fileInfo.FileName, partsHave.Count(), numParts)
+	} else {
+		log.Printf("[%s] Starting to download %d parts...", fileInfo.FileName, numParts)
+	}
+	ticker := time.NewTicker(minRequestTimeout / 2)
+	defer ticker.Stop()
+	lastProgress := time.Now()
+	lastBitfield := time.Now()
+	lastStatus := time.Time{}
+	advertised := partsHave.Count()
+	for !partsHave.Complete() {
+		select {
+		case nodePkt := <-input:
+			switch header := nodePkt.Packet.(type) {
+			case *packets.FileRequestHeader:
+				// Someone else is looking for this file, offer them what has arrived so far
+				if partsHave.Count() > 0 {
+					requester := header.GetRequester()
+					fileDigest := new(packets.FileDigestHeader)
+					fileDigest.Initialize(fileInfo.FileHash, fileInfo.FileSize, fileInfo.PartSize,
+						packets.FileDigestPartial|fileInfo.Flags&packets.FileDigestDeflate, fileInfo.MerkleRoot,
+						fileInfo.FileName)
+					outputDirected <- packets.PeerPacket{Packet: fileDigest, Source: requester}
+					sendBitfield(requester)
+				}
+				continue
+			case *packets.BitfieldHeader:
+				// Bitfields from nodes that split the file differently can't be used
+				if header.PartSize != fileInfo.PartSize || header.FirstPart >= numParts || blacklist[nodePkt.Source] {
+					continue
+				}
+				peer, ok := peers[nodePkt.Source]
+				if !ok {
+					peer = newDownloadPeer(nodePkt.Source, newPartBitmap(numParts))
+					peers[nodePkt.Source] = peer
+				}
+				for i := uint64(0); i < 8*uint64(header.BitsLength); i++ {
+					if header.Bits[i/8]&(1<<(i%8)) != 0 {
+						peerHas(peer, header.FirstPart+i)
+					}
+				}
+				fill(peer)
+				continue
+			case *packets.FileLeavesHeader:
+				peer, ok := peers[nodePkt.Source]
+				if !ok || header.PartSize != fileInfo.PartSize || header.Chunk >= numChunks ||
+					leavesHave.Has(header.Chunk) {
+					continue
+				}
+				delete(leafRequests, header.Chunk)
+				if !verifyLeafChunk(fileInfo.MerkleRoot, numParts, header.Chunk, header.Leaves, header.Proof) {
+					if !badData(peer) {
+						treeFile.Close()
+						os.RemoveAll(tempDir)
+						return
+					}
+					continue
+				}
+				if err := writeLeafChunk(treeFile, numParts, header.Chunk, header.Leaves, header.Proof); err != nil {
+					log.Printf("[%s] Unable to save leaves: %v", fileInfo.FileName, err)
+					continue
+				}
+				leavesHave.Set(header.Chunk)
+				lastProgress = time.Now()
+				for _, other := range peers {
+					fill(other)
+				}
+				continue
+			}
+			if packetCount%50 == 0 {
+				log.Printf("[%s] %.2f%%\n", fileInfo.FileName, 100*float64(partsHave.Count())/float64(numParts))
+			}
+			packetCount += 1
+			filePartHeader, ok := nodePkt.Packet.(*packets.FilePartHeader)
+			if !ok {
+				continue
+			}
+			partNum := filePartHeader.PartNumber
+			peer := addPeer(nodePkt.Source)
+			if peer == nil {
+				continue
+			}
+			request, requested := peer.outstanding[partNum]
+			if requested {
+				release(peer, partNum)
+			}
+			if partNum >= numParts || partsHave.Has(partNum) {
+				fill(peer)
+				continue
+			}
+			leaf, known := readMerkleLeaf(treeFile, numParts, partNum)
+			if !known || !leavesHave.Has(partNum/packets.LeavesPerChunk) {
+				// Never requested, the part can't be checked yet
+				fill(peer)
+				continue
+			}
+			data, err := partData(fileInfo, *filePartHeader)
+			if err != nil || uint64(len(data)) != partLength(fileInfo, partNum) || merkleLeaf(data) != leaf {
+				// Ask for the part again, from someone else if this peer keeps getting it wrong
+				retransmits[partNum] = true
+				if !badData(peer) {
+					treeFile.Close()
+					os.RemoveAll(tempDir)
+					return
+				}
+				continue
+			}
+			// Only requests that were sent once give an unambiguous round trip time
+			if requested && !request.retransmitted {
+				rtt := time.Since(request.sent)
+				peer.sampleRTT(rtt)
+				peer.window.OnAck(rtt, true)
+			} else if requested {
+				peer.window.OnAck(0, false)
+			}
+			peer.timeouts = 0
+			peerHas(peer, partNum)
+			// The data goes in first, so a part that is marked in the bitmap can always be read back
+			if err := writeFilePart(dataFile, fileInfo, partNum, data); err != nil {
+				log.Printf("[%s] Unable to save part: %v", fileInfo.FileName, err)
+				fill(peer)
+				continue
+			}
+			partsHave.Set(partNum)
+			bitmapFile.WriteAt(partsHave.Bytes(partNum/8*8, 1), int64(partNum/8))
+			delete(inFlight, partNum)
+			delete(retransmits, partNum)
+			peer.received += 1
+			lastProgress = time.Now()
+			fill(peer)
+		case newPeer := <-newPeers:
+			// Start downloading from the new peer if they don't already exist.
+			if peer, ok := peers[newPeer]; !ok {
+				if peer := addPeer(newPeer); peer != nil {
+					fill(peer)
+				}
+			} else if peer.have != nil {
+				// A partial peer has finished its copy since it was added
+				forgetParts(peer)
+				fill(peer)
+			}
+		case now := <-ticker.C:
+			for chunk, sent := range leafRequests {
+				if now.Sub(sent) > leafRequestTimeout {
+					delete(leafRequests, chunk)
+				}
+			}
+			// Expire requests that have gone unanswered for longer than the peer's timeout
+			for peerNode, peer := range peers {
+				expired := false
+				for part, request := range peer.outstanding {
+					if now.Sub(request.sent) > peer.rto {
+						release(peer, part)
+						retransmits[part] = true
+						expired = true
+					}
+				}
+				if expired {
+					peer.backoff()
+					peer.window.OnLoss()
+				}
+				if peer.timeouts >= maxPeerTimeouts {
+					log.Printf("[%s] Dropping unresponsive peer %s:%d", fileInfo.FileName, peerNode.Address,
+						peerNode.Port)
+					dropPeer(peer)
+				}
+			}
+			for _, peer := range peers {
+				fill(peer)
+			}
+			if now.Sub(lastStatus) > time.Second {
+				publish()
+				lastStatus = now
+			}
+			if now.Sub(lastBitfield) > bitfieldInterval {
+				// Let the peers know about new parts so they can download them from here as well
+				if partsHave.Count() != advertised {
+					for peerNode := range peers {
+						sendBitfield(peerNode)
+					}
+					advertised = partsHave.Count()
+					// Keep the download from being collected as abandoned
+					saveDownloadState(fileInfo)
+				}
+				lastBitfield = now
+			}
+			if now.Sub(lastProgress) > 10*time.Second {
+				// Nothing has arrived for 10 seconds, send out a file request to get new peers
+				fileRequest := new(packets.FileRequestHeader)
+				fileRequest.Initialize(fileInfo.FileHash, self)
+				outputGeneral <- fileRequest
+				lastProgress = now
+			}
+		}
+	}
+	log.Printf("[%s] Parts downloaded", fileInfo.FileName)
+	for _, peer := range peers {
+		log.Printf("[%s] %s:%d sent %d parts, rtt %v (base %v), window %d", fileInfo.FileName, peer.node.Address,
+			peer.node.Port, peer.received, peer.srtt, peer.window.baseDelay, peer.window.Size())
+	}
+
+	// The parts were written straight into place, so the file only has to be checked and moved into the store
+	dataFile.Close()
+	if err := AddShareBlob(fileInfo.FileName, dataPath, fileInfo.FileHash); err != nil {
+		log.Printf("[%s] Discarding downloaded file: %v", fileInfo.FileName, err)
+	} else {
+		log.Printf("[%s] File assembled", fileInfo.FileName)
+	}
+	// Clean up the temporary files
+	treeFile.Close()
+	bitmapFile.Close()
+	os.RemoveAll(tempDir)
+}
+
+// Length of a part: a full part, or whatever remains for the last one
+func partLength(fileInfo packets.FileDigestHeader, partNum uint64) uint64 {
+	length := uint64(fileInfo.PartSize)
+	if remaining := fileInfo.FileSize - partNum*uint64(fileInfo.PartSize); remaining < length {
+		length = remaining
+	}
+	return length
+}
+
+// Returns the contents of a received part, decompressing it if needed
+func partData(fileInfo packets.FileDigestHeader, filePartHeader packets.FilePartHeader) ([]uint8, error) {
+	data := filePartHeader.Data[:filePartHeader.DataLength]
+	if filePartHeader.Flags&packets.FilePartDeflate != 0 {
+		return decompressPart(data, int(fileInfo.PartSize))
+	}
+	return data, nil
+}
+
+// Writes a part into place in the download's data file
+func writeFilePart(dataFile *os.File, fileInfo packets.FileDigestHeader, partNum uint64, data []uint8) error {
+	_, err := dataFile.WriteAt(data, int64(partNum*uint64(fileInfo.PartSize)))
+	return err
+}
+
+func requestPart(partNumber uint64, fileInfo packets.FileDigestHeader, outputDirected chan packets.PeerPacket,
+	peer node.Node) {
+	var flags uint8
+	if fileInfo.SupportsDeflate() {
+		flags |= packets.PartRequestDeflate
+	}
+	partRequest := new(packets.FilePartRequestHeader)
+	partRequest.Initialize(fileInfo.FileHash, partNumber, fileInfo.PartSize, flags)
+	outputDirected <- packets.PeerPacket{Packet: partRequest, Source: peer}
+}
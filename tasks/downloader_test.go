@@ -0,0 +1,29 @@
+package tasks
+
+import (
+	"swarmd/packets"
+	"testing"
+)
+
+func TestCheckDownloadSize(t *testing.T) {
+	for _, test := range []struct {
+		fileSize uint64
+		partSize uint16
+		quota    int64
+		ok       bool
+	}{
+		{fileSize: 1 << 20, partSize: packets.DefaultPartSize, ok: true},
+		{fileSize: 0, partSize: packets.DefaultPartSize, ok: true},
+		{fileSize: 1 << 20, partSize: 0},
+		{fileSize: 1 << 20, partSize: packets.MaxPartSize + 1},
+		{fileSize: 1<<64 - 1, partSize: packets.MaxPartSize},
+		{fileSize: maxDownloadParts + 1, partSize: 1},
+		{fileSize: 1 << 20, partSize: packets.DefaultPartSize, quota: 1 << 19},
+		{fileSize: 1 << 20, partSize: packets.DefaultPartSize, quota: 1 << 20, ok: true},
+	} {
+		fileInfo := packets.FileDigestHeader{FileSize: test.fileSize, PartSize: test.partSize}
+		if err := checkDownloadSize(fileInfo, test.quota); (err == nil) != test.ok {
+			t.Errorf("%d bytes in parts of %d with a quota of %d: got %v", test.fileSize, test.partSize, test.quota, err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package tasks
+
+import (
+	"swarmd/packets"
+	"swarmd/util"
+	"path/filepath"
+	"io/ioutil"
+	"encoding/json"
+	"encoding/hex"
+	"os"
+	"log"
+	"time"
+)
+
+// Written into each download's part directory so that the download can pick up where it left off after a restart
+const downloadStateFile = "download.json"
+
+// Downloads that haven't made progress for this long are given up on and their parts deleted
+const abandonedDownloadAge = 72 * time.Hour
+
+type downloadState struct {
+	FileHash   string
+	FileSize   uint64
+	PartSize   uint16
+	MerkleRoot string
+	FileName   string
+	Updated    int64
+}
+
+func GetPartsRoot() string {
+	return filepath.Join(util.GetBasePath(), "parts")
+}
+
+// Records the digest a download was started from, along with the time it last made progress
+func saveDownloadState(fileInfo packets.FileDigestHeader) {
+	fileID := hex.EncodeToString(fileInfo.FileHash[:])
+	state := downloadState{
+		FileHash:   fileID,
+		FileSize:   fileInfo.FileSize,
+		PartSize:   fileInfo.PartSize,
+		MerkleRoot: hex.EncodeToString(fileInfo.MerkleRoot[:]),
+		FileName:   fileInfo.FileName,
+		Updated:    time.Now().Unix(),
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	statePath := filepath.Join(GetPartsPath(fileID), downloadStateFile)
+	if err := ioutil.WriteFile(statePath+".tmp", data, 0600); err != nil {
+		log.Printf("[%s] Unable to save download state: %v", fileInfo.FileName, err)
+		return
+	}
+	if err := os.Rename(statePath+".tmp", statePath); err != nil {
+		log.Printf("[%s] Unable to save download state: %v", fileInfo.FileName, err)
+	}
+}
+
+func loadDownloadState(partsDir string) (packets.FileDigestHeader, time.Time, bool) {
+	var fileInfo packets.FileDigestHeader
+	var state downloadState
+	file, err := ioutil.ReadFile(filepath.Join(partsDir, downloadStateFile))
+	if err != nil || json.Unmarshal(file, &state) != nil {
+		return fileInfo, time.Time{}, false
+	}
+	// The directory name has to agree with the state, otherwise parts could end up in the wrong file
+	decoded, err := hex.DecodeString(state.FileHash)
+	if err != nil || len(decoded) != packets.HashSize || state.FileHash != filepath.Base(partsDir) {
+		return fileInfo, time.Time{}, false
+	}
+	if state.PartSize == 0 || state.PartSize > packets.MaxPartSize {
+		return fileInfo, time.Time{}, false
+	}
+	root, err := hex.DecodeString(state.MerkleRoot)
+	if err != nil || len(root) != packets.HashSize {
+		return fileInfo, time.Time{}, false
+	}
+	var fileHash, merkleRoot [packets.HashSize]uint8
+	copy(fileHash[:], decoded)
+	copy(merkleRoot[:], root)
+	fileInfo.Initialize(fileHash, state.FileSize, state.PartSize, 0, merkleRoot, state.FileName)
+	return fileInfo, time.Unix(state.Updated, 0), true
+}
+
+// Marks the chunks of leaves stored before a restart as downloaded, checking each against the root again
+func loadLeafChunks(treeFile *os.File, fileInfo packets.FileDigestHeader, leavesHave *partBitmap) {
+	numParts := fileInfo.NumParts()
+	for chunk := uint64(0); chunk < leavesHave.Len(); chunk++ {
+		leaves, proof, ok := readLeafChunk(treeFile, numParts, chunk)
+		if ok && verifyLeafChunk(fileInfo.MerkleRoot, numParts, chunk, leaves, proof) {
+			leavesHave.Set(chunk)
+		}
+	}
+}
+
+// Marks the parts recorded in the bitmap as downloaded. Each one is checked against its leaf first, since a crash can
+// leave the bitmap ahead of what actually made it to disk.
+func loadDownloadedParts(dataFile *os.File, bitmapFile *os.File, treeFile *os.File, fileInfo packets.FileDigestHeader,
+	partsHave *partBitmap, leavesHave *partBitmap) {
+	bits := make([]uint8, (partsHave.Len()+7)/8)
+	bytesRead, _ := bitmapFile.ReadAt(bits, 0)
+	buffer := make([]uint8, fileInfo.PartSize)
+	for part := uint64(0); part < 8*uint64(bytesRead) && part < partsHave.Len(); part++ {
+		if bits[part/8]&(1<<(part%8)) == 0 || !leavesHave.Has(part/packets.LeavesPerChunk) {
+			continue
+		}
+		data := buffer[:partLength(fileInfo, part)]
+		if _, err := dataFile.ReadAt(data, int64(part*uint64(fileInfo.PartSize))); err != nil {
+			continue
+		}
+		if leaf, ok := readMerkleLeaf(treeFile, partsHave.Len(), part); ok && merkleLeaf(data) == leaf {
+			partsHave.Set(part)
+		}
+	}
+	// Rewrite the bitmap without the parts that didn't check out
+	bitmapFile.Truncate(0)
+	bitmapFile.WriteAt(partsHave.Bytes(0, len(bits)), 0)
+}
+
+// Finds the downloads that were interrupted by a restart, deleting part directories that can't or shouldn't be
+// resumed along the way
+func resumableDownloads(manifest packets.FileManifest) []packets.FileDigestHeader {
+	var downloads []packets.FileDigestHeader
+	entries, _ := ioutil.ReadDir(GetPartsRoot())
+	for _, entry := range entries {
+		partsDir := filepath.Join(GetPartsRoot(), entry.Name())
+		fileInfo, updated, ok := loadDownloadState(partsDir)
+		if ok && time.Since(updated) < abandonedDownloadAge {
+			if _, done := manifest[fileInfo.FileHash]; !done {
+				downloads = append(downloads, fileInfo)
+				continue
+			}
+		}
+		log.Printf("Removing abandoned download: %s", entry.Name())
+		os.RemoveAll(partsDir)
+	}
+	return downloads
+}
+
+// Deletes part directories that no running downloader is using and that have gone stale
+func collectAbandonedDownloads(active map[[packets.HashSize]uint8]chan packets.PeerPacket) {
+	entries, _ := ioutil.ReadDir(GetPartsRoot())
+	for _, entry := range entries {
+		partsDir := filepath.Join(GetPartsRoot(), entry.Name())
+		fileInfo, updated, ok := loadDownloadState(partsDir)
+		if ok {
+			if _, running := active[fileInfo.FileHash]; running {
+				continue
+			}
+			if time.Since(updated) < abandonedDownloadAge {
+				continue
+			}
+		} else if time.Since(entry.ModTime()) < abandonedDownloadAge {
+			// Could be a download that is just starting and hasn't written its state yet
+			continue
+		}
+		log.Printf("Removing abandoned download: %s", entry.Name())
+		os.RemoveAll(partsDir)
+	}
+}
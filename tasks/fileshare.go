@@ -6,13 +6,10 @@ import (
 	"swarmd/node"
 	"path/filepath"
 	"os"
-	"crypto/md5"
 	"io"
-	"fmt"
-	"math"
 	"log"
-	"time"
 	"encoding/hex"
+	"time"
 )
 
 func GetSharePath() string {
@@ -33,54 +30,14 @@ func GetPartsPath(filehash string) string {
 	return partsPath
 }
 
-func GetFileManifest() packets.FileManifest {
-	sharePath := GetSharePath()
-	files := make(map[[16]uint8]packets.FileDigest)
-	// Build a function that will parse the relevant info from each file
-	walkFunc := func(path string, info os.FileInfo, err error) error {
-		// Check that file info could be gathered
-		if err != nil {
-			return nil
-		}
-		// Open the file for hashing
-		file, err := os.Open(path)
-		if err != nil {
-			return nil
-		}
-		defer file.Close()
-		// Generate the checksum
-		hash := md5.New()
-		if _, err := io.Copy(hash, file); err != nil {
-			return nil
-		}
-		// Determine the relative file path
-		relPath, err := filepath.Rel(sharePath, path)
-		if err != nil {
-			return nil
-		}
-		// Pack the FileDigest struct
-		f := packets.FileDigest{
-			RelativeFilePath: relPath,
-			FileSize:         uint32(info.Size()),
-		}
-		// Add the file digest to the file map
-		var checksum [16]uint8
-		copy(checksum[:], hash.Sum(nil)[:16])
-		files[checksum] = f
-		return nil
-	}
-	// Walk the directory using the above function
-	filepath.Walk(sharePath, walkFunc)
-	return files
-}
-
-func startNewDownload(fileHash [16]uint8, self node.Node, manifest packets.FileManifest,
-	downloaders map[[16]uint8]chan packets.PeerPacket, downloaderPeers map[[16]uint8]chan node.Node,
-	downloadStarted map[[16]uint8]bool, output chan packets.Packet) {
+func startNewDownload(fileHash [packets.HashSize]uint8, self node.Node, manifest packets.FileManifest,
+	downloaders map[[packets.HashSize]uint8]chan packets.PeerPacket, downloaderPeers map[[packets.HashSize]uint8]chan node.Node,
+	downloadStarted map[[packets.HashSize]uint8]bool, output chan packets.Packet) {
 	if _, ok := manifest[fileHash]; !ok {
 		if _, ok := downloaders[fileHash]; !ok {
 			// Set up the downloader
-			downloaders[fileHash] = make(chan packets.PeerPacket)
+			// Buffered so that parts arriving in a burst from several peers aren't dropped while the downloader is busy
+			downloaders[fileHash] = make(chan packets.PeerPacket, downloadQueueSize)
 			downloaderPeers[fileHash] = make(chan node.Node)
 			downloadStarted[fileHash] = false
 			// Request the file
@@ -91,26 +48,135 @@ func startNewDownload(fileHash [16]uint8, self node.Node, manifest packets.FileM
 	}
 }
 
+// Most requesters remembered while a file's tree is being built. Any more are answered when they ask again.
+const maxTreeWaiters = 32
+
+// A tree built for a file in share
+type builtTree struct {
+	fileHash [packets.HashSize]uint8
+	root     [packets.HashSize]uint8
+	err      error
+}
+
+// Builds a file's tree in the background, answering the requester once it is done. Waiters holds the requesters of
+// each tree being built.
+func awaitTree(waiters map[[packets.HashSize]uint8][]node.Node, fileHash [packets.HashSize]uint8,
+	requester *node.Node, partSize uint16, built chan builtTree) {
+	pending, building := waiters[fileHash]
+	if requester != nil && len(pending) < maxTreeWaiters {
+		for _, waiter := range pending {
+			if waiter == *requester {
+				requester = nil
+				break
+			}
+		}
+		if requester != nil {
+			pending = append(pending, *requester)
+		}
+	}
+	waiters[fileHash] = pending
+	if !building {
+		if waiters[fileHash] == nil {
+			waiters[fileHash] = make([]node.Node, 0)
+		}
+		go func() {
+			root, err := buildShareTree(fileHash, partSize)
+			built <- builtTree{fileHash: fileHash, root: root, err: err}
+		}()
+	}
+}
+
+// Makes room in share, remembering what was evicted so that replication doesn't fetch it straight back
+func collectShareGarbage(config *commonStruct, self node.Node) {
+	for _, fileHash := range CollectShareGarbage(config.ShareQuota, pinnedShareFiles(config, self)) {
+		config.Replication.Evict(fileHash)
+	}
+}
+
+// Tells a node that this one has a file in share
+func sendFileDigest(config *commonStruct, fileHash [packets.HashSize]uint8, digest packets.FileDigest,
+	root [packets.HashSize]uint8, requester node.Node) {
+	fileDigest := new(packets.FileDigestHeader)
+	var flags uint8
+	if config.Compression {
+		flags |= packets.FileDigestDeflate
+	}
+	fileDigest.Initialize(fileHash, digest.FileSize, config.PartSize, flags, root, digest.RelativeFilePath)
+	config.Output <- packets.PeerPacket{Packet: fileDigest, Source: requester}
+}
+
 func FileShare(config *commonStruct, self node.Node) {
 	manifest := GetFileManifest()
-	downloaders := make(map[[16]uint8]chan packets.PeerPacket, 10)
-	downloaderPeers := make(map[[16]uint8]chan node.Node)
-	downloadStarted := make(map[[16]uint8]bool)
-	downloaderFinished := make(chan [16]uint8)
+	downloaders := make(map[[packets.HashSize]uint8]chan packets.PeerPacket, 10)
+	downloaderPeers := make(map[[packets.HashSize]uint8]chan node.Node)
+	downloadStarted := make(map[[packets.HashSize]uint8]bool)
+	// Digests of the files being downloaded, used to serve the parts that have already arrived
+	downloadDigests := make(map[[packets.HashSize]uint8]packets.FileDigestHeader)
+	// Trees being built for files in share, and who is waiting on them
+	treeWaiters := make(map[[packets.HashSize]uint8][]node.Node)
+	treesBuilt := make(chan builtTree)
+	downloaderFinished := make(chan [packets.HashSize]uint8)
+	// Carry on with downloads that were interrupted by a restart
+	for _, fileInfo := range resumableDownloads(manifest) {
+		fileHash := fileInfo.FileHash
+		if err := checkDownloadSize(fileInfo, config.ShareQuota); err != nil {
+			log.Printf("[%s] Not resuming download: %v", fileInfo.FileName, err)
+			os.RemoveAll(filepath.Join(GetPartsRoot(), hex.EncodeToString(fileHash[:])))
+			continue
+		}
+		if config.Compression {
+			fileInfo.Flags |= packets.FileDigestDeflate
+		}
+		downloaders[fileHash] = make(chan packets.PeerPacket, downloadQueueSize)
+		downloaderPeers[fileHash] = make(chan node.Node)
+		downloadStarted[fileHash] = true
+		downloadDigests[fileHash] = fileInfo
+		go FileDownloader(config.Output, config.Broadcast, self, fileInfo, downloaders[fileHash], downloaderPeers[fileHash],
+			downloaderFinished, config.Download)
+		fileRequest := new(packets.FileRequestHeader)
+		fileRequest.Initialize(fileHash, self)
+		config.Broadcast <- fileRequest
+	}
+	collectAfter := time.After(0)
+	antiEntropyAfter := time.After(antiEntropyInterval)
 	for !*config.KillFlag {
 		select {
 		case nodePkt := <-config.FileShare:
 			switch nodePkt.Packet.PacketType() {
 			case packets.PacketTypeDeployment:
-				// Check to make sure the file hasn't already been downloaded
-				fileHash := nodePkt.Packet.(*packets.DeploymentHeader).FileHash
-				manifest = GetFileManifest()
-				startNewDownload(fileHash, self, manifest, downloaders, downloaderPeers, downloadStarted, config.Broadcast)
+				header := nodePkt.Packet.(*packets.DeploymentHeader)
+				fileHash := header.FileHash
+				policy, err := parseReplicationPolicy(header.Policy)
+				if err != nil {
+					log.Printf("Replicating %s everywhere: %v", hex.EncodeToString(fileHash[:]), err)
+				}
+				// A replayed older deployment doesn't undo a newer one
+				if !config.Replication.Merge(fileHash, policy, header.Revision) {
+					policy = config.Replication.Get(fileHash)
+				}
+				// Only fetch the file if this node is meant to keep a copy, but always pass the announcement on
+				if policy.Includes(fileHash, self, config.Labels, knownPeers(config)) {
+					// Check to make sure the file hasn't already been downloaded
+					manifest = GetFileManifest()
+					startNewDownload(fileHash, self, manifest, downloaders, downloaderPeers, downloadStarted, config.Broadcast)
+				}
 				config.Broadcast <- nodePkt.Packet
 			case packets.PacketTypeManifestHeader:
 				hashes := nodePkt.Packet.(*packets.ManifestHeader).FileHashes
 				manifest = GetFileManifest()
+				peers := knownPeers(config)
 				for _, fileHash := range hashes {
+					if !config.Replication.Get(fileHash).Includes(fileHash, self, config.Labels, peers) {
+						continue
+					}
+					startNewDownload(fileHash, self, manifest, downloaders, downloaderPeers, downloadStarted, config.Broadcast)
+				}
+			case packets.PacketTypeShareSummary:
+				handleShareSummary(config, *nodePkt.Packet.(*packets.ShareSummaryHeader), nodePkt.Source)
+			case packets.PacketTypeShareEntries:
+				entries := nodePkt.Packet.(*packets.ShareEntriesHeader).Entries
+				manifest = GetFileManifest()
+				for _, fileHash := range learnShareEntries(config, self, entries) {
 					startNewDownload(fileHash, self, manifest, downloaders, downloaderPeers, downloadStarted, config.Broadcast)
 				}
 			case packets.PacketTypeFileRequestHeader:
@@ -119,10 +185,21 @@ func FileShare(config *commonStruct, self node.Node) {
 				// Check to see if we have a copy of the requested file
 				manifest = GetFileManifest()
 				if digest, ok := manifest[fileHash]; ok {
-					// Respond that we have a copy of the packet
-					fileDigest := new(packets.FileDigestHeader)
-					fileDigest.Initialize(fileHash, digest.FileSize, digest.RelativeFilePath)
-					config.Output <- packets.PeerPacket{Packet: fileDigest, Source: requester}
+					treePath := shareTreePath(fileHash, config.PartSize)
+					if root, built := readMerkleRoot(treePath, partCount(digest.FileSize, config.PartSize)); built {
+						// Respond that we have a copy of the file
+						sendFileDigest(config, fileHash, digest, root, requester)
+					} else {
+						// Hashing the file can take a while, so the requester is answered once it is done
+						awaitTree(treeWaiters, fileHash, &requester, config.PartSize, treesBuilt)
+					}
+					TouchShareFile(fileHash)
+				} else if downloadStarted[fileHash] {
+					// Still downloading it, let the downloader offer the parts it has so far
+					select {
+					case downloaders[fileHash] <- nodePkt:
+					default:
+					}
 				}
 				// Broadcast the file request to all peers
 				config.Broadcast <- nodePkt.Packet
@@ -130,21 +207,46 @@ func FileShare(config *commonStruct, self node.Node) {
 				// Create/update the file downloader for this file to use the sender as a peer
 				header := *nodePkt.Packet.(*packets.FileDigestHeader)
 				fileHash := header.FileHash
+				if header.PartSize == 0 || header.PartSize > packets.MaxPartSize {
+					continue
+				}
 				// If a downloader for this file doesn't already exist, ignore the packet
 				if started, ok := downloadStarted[fileHash]; ok {
 					if !started {
+						// Everything the downloader sets aside is sized from the digest, so it is checked first. Another
+						// peer's digest can still start the download.
+						err := checkDownloadSize(header, config.ShareQuota)
+						if err == nil {
+							err = checkDownloadSpace(header)
+						}
+						if err != nil {
+							log.Printf("[%s] Ignoring digest from %s: %v", header.FileName, nodePkt.Source.Address, err)
+							continue
+						}
+						// Compression is only asked for when both sides have it turned on
+						if !config.Compression {
+							header.Flags &^= packets.FileDigestDeflate
+						}
 						go FileDownloader(config.Output, config.Broadcast, self, header, downloaders[fileHash], downloaderPeers[fileHash],
-							downloaderFinished)
+							downloaderFinished, config.Download)
 						downloadStarted[fileHash] = true
+						downloadDigests[fileHash] = header
+					}
+					// Provide the sender as a peer if it splits the file the same way. Partial copies are added once
+					// their bitfield arrives.
+					started := downloadDigests[fileHash]
+					if !header.IsPartial() && header.PartSize == started.PartSize && header.MerkleRoot == started.MerkleRoot {
+						downloaderPeers[fileHash] <- nodePkt.Source
 					}
-					// Provide the sender as a peer
-					downloaderPeers[fileHash] <- nodePkt.Source
 				}
 			case packets.PacketTypeFilePartHeader:
-				// Pass the file part to the appropriate downloader if it exists
-				header := *nodePkt.Packet.(*packets.FilePartHeader)
-				fileHash := header.FileHash
-				if downloader, ok := downloaders[fileHash]; ok {
+				fallthrough
+			case packets.PacketTypeFileLeaves:
+				fallthrough
+			case packets.PacketTypeBitfield:
+				// Pass the packet to the appropriate downloader if it exists
+				fileHash := downloadFileHash(nodePkt.Packet)
+				if downloader, ok := downloaders[fileHash]; ok && downloadStarted[fileHash] {
 					// Non-block write to the downloader to fix the case where the downloader is finished
 					select {
 					case downloader <- nodePkt:
@@ -153,175 +255,189 @@ func FileShare(config *commonStruct, self node.Node) {
 				}
 			case packets.PacketTypeFilePartRequestHeader:
 				header := *nodePkt.Packet.(*packets.FilePartRequestHeader)
-				fileDigest, ok := manifest[header.FileHash]
-				// Check to make sure the file exists. TODO: download the file if it doesn't exist
-				if !ok {
+				if header.PartSize == 0 || header.PartSize > packets.MaxPartSize {
 					continue
 				}
-				buffer := make([]uint8, 1024)
-				bytesRead := getFilePart(fileDigest.RelativeFilePath, header.PartNumber, buffer)
-				// Send the file part
+				buffer := make([]uint8, header.PartSize)
+				var bytesRead uint16
+				if fileDigest, ok := manifest[header.FileHash]; ok && header.PartSize == config.PartSize {
+					// The part number comes off the wire, so it is checked against the file before reading
+					fileInfo := packets.FileDigestHeader{FileSize: fileDigest.FileSize, PartSize: header.PartSize}
+					if header.PartNumber >= fileInfo.NumParts() {
+						continue
+					}
+					bytesRead, ok = getFilePart(header.FileHash, header.PartNumber, buffer)
+					if !ok {
+						continue
+					}
+				} else if digest, ok := downloadDigests[header.FileHash]; ok && digest.PartSize == header.PartSize {
+					// Serve the parts of an unfinished download, as long as the requester splits the file the same way
+					bytesRead, ok = getPartialFilePart(digest, header.PartNumber, buffer)
+					if !ok {
+						continue
+					}
+				} else {
+					continue
+				}
+				// Send the file part, compressed if the requester asked for it and it helps
+				data := buffer[:bytesRead]
+				var flags uint8
+				if config.Compression && header.Flags&packets.PartRequestDeflate != 0 {
+					if compressed, ok := compressPart(data); ok {
+						data = compressed
+						flags |= packets.FilePartDeflate
+					}
+				}
 				filePart := new(packets.FilePartHeader)
-				filePart.Initialize(header.FileHash, header.PartNumber, buffer[:bytesRead])
-				config.Output <- packets.PeerPacket{filePart, nodePkt.Source}
+				filePart.Initialize(header.FileHash, header.PartNumber, flags, data)
+				config.Bulk.Push(packets.PeerPacket{Packet: filePart, Source: nodePkt.Source})
+			case packets.PacketTypeFileLeavesRequest:
+				header := *nodePkt.Packet.(*packets.FileLeavesRequestHeader)
+				var leaves, proof [][packets.HashSize]uint8
+				ok := false
+				if digest, inShare := manifest[header.FileHash]; inShare && header.PartSize == config.PartSize {
+					leaves, proof, ok = readShareLeafChunk(header.FileHash, header.PartSize, digest.FileSize,
+						header.Chunk)
+				} else if digest, downloading := downloadDigests[header.FileHash]; downloading &&
+					digest.PartSize == header.PartSize {
+					leaves, proof, ok = getPartialLeafChunk(digest, header.Chunk)
+				}
+				if !ok {
+					continue
+				}
+				fileLeaves := new(packets.FileLeavesHeader)
+				fileLeaves.Initialize(header.FileHash, header.PartSize, header.Chunk, leaves, proof)
+				config.Bulk.Push(packets.PeerPacket{Packet: fileLeaves, Source: nodePkt.Source})
 			}
+		case result := <-treesBuilt:
+			waiters := treeWaiters[result.fileHash]
+			delete(treeWaiters, result.fileHash)
+			digest, ok := manifest[result.fileHash]
+			if result.err != nil {
+				log.Printf("Unable to hash %s: %v", hex.EncodeToString(result.fileHash[:]), result.err)
+			} else if ok {
+				for _, requester := range waiters {
+					sendFileDigest(config, result.fileHash, digest, result.root, requester)
+				}
+			}
+		case fileHash := <-config.Fetch:
+			// Something on this node needs the file, so fetch it whatever its replication policy says
+			manifest = GetFileManifest()
+			startNewDownload(fileHash, self, manifest, downloaders, downloaderPeers, downloadStarted, config.Broadcast)
+		case <-antiEntropyAfter:
+			// Catch up on files this node should have but missed, either because it was down when they were deployed
+			// or because their download never got an answer
+			manifest = GetFileManifest()
+			for _, fileHash := range missingShareFiles(config, self, knownShareEntries(config)) {
+				if started, ok := downloadStarted[fileHash]; ok && !started {
+					fileRequest := new(packets.FileRequestHeader)
+					fileRequest.Initialize(fileHash, self)
+					config.Broadcast <- fileRequest
+					continue
+				}
+				startNewDownload(fileHash, self, manifest, downloaders, downloaderPeers, downloadStarted, config.Broadcast)
+			}
+			sendShareSummary(config)
+			antiEntropyAfter = time.After(antiEntropyInterval)
+		case <-collectAfter:
+			collectAbandonedDownloads(downloaders)
+			collectShareGarbage(config, self)
+			// Pick up anything changed in share without going through the store
+			RescanShare()
+			manifest = GetFileManifest()
+			collectAfter = time.After(time.Hour)
 		case fileHash := <-downloaderFinished:
-			// Refresh the manifest and cleanup
+			// Make room for the new file if share is over its quota, then refresh the manifest and cleanup
+			collectShareGarbage(config, self)
 			manifest = GetFileManifest()
+			// Have the tree ready for the peers that will ask for the file next
+			if _, ok := manifest[fileHash]; ok {
+				awaitTree(treeWaiters, fileHash, nil, config.PartSize, treesBuilt)
+			}
+			// Install or upgrade any module that was waiting on this archive
+			version := hex.EncodeToString(fileHash[:])
+			for _, module := range config.DesiredState.All() {
+				if module.Version == version {
+					go func(name string) {
+						config.ModuleControl <- moduleCommand{ModuleName: name, Command: "reconcile"}
+					}(module.Name)
+				}
+			}
 			close(downloaders[fileHash])
 			delete(downloaders, fileHash)
 			close(downloaderPeers[fileHash])
 			delete(downloaderPeers, fileHash)
 			delete(downloadStarted, fileHash)
+			delete(downloadDigests, fileHash)
 		}
 	}
 }
 
-func FileDownloader(outputDirected chan packets.PeerPacket, outputGeneral chan packets.Packet, self node.Node,
-	fileInfo packets.FileDigestHeader, input chan packets.PeerPacket, newPeers chan node.Node,
-	eventStream chan [16]uint8) {
-	// Download finished notification
-	defer (func() { log.Print("Signalling"); eventStream <- fileInfo.FileHash; log.Print("Signalled") })()
-	// Determine the temp directory for the part to be stored in
-	fileID := hex.EncodeToString(fileInfo.FileHash[:])
-	tempDir := GetPartsPath(fileID)
-	// Set up state variables for downloader
-	numParts := uint16(math.Ceil(float64(fileInfo.FileSize) / 1024))
-	partsNeeded := make(map[uint16]bool)
-	peers := make(map[node.Node]bool)
-	sequenceNumber := numParts - 1
-	packetCount := 0
-
-	// Initialize the parts needed
-	for i := uint16(0); i < numParts; i++ {
-		partsNeeded[i] = true
+func getFilePart(fileHash [packets.HashSize]uint8, partNumber uint64, buffer []uint8) (uint16, bool) {
+	file, err := os.OpenFile(GetBlobPath(fileHash), os.O_RDONLY, 0700)
+	if err != nil {
+		return 0, false
 	}
-	log.Printf("[%s] Starting to download parts...", fileInfo.FileName)
-	done := false
-	for !done {
-		select {
-		case nodePkt := <-input:
-			if packetCount%50 == 0 {
-				log.Printf("[%s] %.2f%%\n", fileInfo.FileName, 100*(1-float32(len(partsNeeded))/float32(numParts)))
-			}
-
-			packetCount += 1
-			filePartHeader := *nodePkt.Packet.(*packets.FilePartHeader)
-			partNum := filePartHeader.PartNumber
-			peer := nodePkt.Source
-			if _, ok := peers[peer]; !ok {
-				peers[peer] = true
-			}
-			if _, ok := partsNeeded[partNum]; ok {
-				delete(partsNeeded, partNum)
-				writeFilePart(tempDir, partNum, filePartHeader)
-			}
-			// Request the next file part
-			if getNextKey(partsNeeded, numParts, &sequenceNumber) {
-				getNextPart(sequenceNumber, fileInfo, outputDirected, peer)
-			} else {
-				done = true
-			}
-		case newPeer := <-newPeers:
-			// Start downloading from the new peer if they don't already exist.
-			if _, ok := peers[newPeer]; !ok {
-				peers[newPeer] = true
-				if getNextKey(partsNeeded, numParts, &sequenceNumber) {
-					getNextPart(sequenceNumber, fileInfo, outputDirected, newPeer)
-				} else {
-					done = true
-				}
-			}
-		case <-time.After(10 * time.Second):
-			// Time out after 10 seconds of no packets/new peers, send out a file request to get new peers
-			fileRequest := new(packets.FileRequestHeader)
-			fileRequest.Initialize(fileInfo.FileHash, self)
-			outputGeneral <- fileRequest
-		}
+	defer file.Close()
+	offset := uint64(len(buffer)) * partNumber
+	// Read the part from the file
+	bytesRead, err := file.ReadAt(buffer, int64(offset))
+	if err != nil && err != io.EOF {
+		log.Printf("Unable to read part %d of %s: %v", partNumber, hex.EncodeToString(fileHash[:]), err)
+		return 0, false
 	}
-	log.Printf("[%s] Parts downloaded", fileInfo.FileName)
+	return uint16(bytesRead), true
+}
 
-	outputFile, err := os.OpenFile(filepath.Join(GetSharePath(), fileInfo.FileName), os.O_RDWR|os.O_CREATE|os.O_TRUNC,
-		0700)
-	if err != nil {
-		log.Printf("[%s] Unable to download file: %v", fileInfo.FileName, err)
-		return
+// Reads a part that has already been downloaded for a file that is still being assembled
+func getPartialFilePart(fileInfo packets.FileDigestHeader, partNumber uint64, buffer []uint8) (uint16, bool) {
+	partsDir := filepath.Join(GetPartsRoot(), hex.EncodeToString(fileInfo.FileHash[:]))
+	if partNumber >= fileInfo.NumParts() {
+		return 0, false
 	}
-	defer outputFile.Close()
-
-	partBuffer := make([]uint8, 1024)
-	assemblePart := func(i uint16) bool {
-		partFile, err := os.OpenFile(filepath.Join(tempDir, fmt.Sprintf("%d.part", i)), os.O_RDONLY, 0700)
-		if err != nil {
-			log.Printf("[%s] Unable to write parts: %v", fileInfo.FileName, err)
-			return false
-		}
-		defer partFile.Close()
-		bytesRead, err := partFile.Read(partBuffer)
-		if err != nil {
-			log.Printf("[%s] Unable to write parts: %v", fileInfo.FileName, err)
-			return false
-		}
-		outputFile.Write(partBuffer[:bytesRead])
-		return true
+	// Parts are marked in the bitmap once they have been verified and written
+	bitmapFile, err := os.Open(filepath.Join(partsDir, downloadBitmapFile))
+	if err != nil {
+		return 0, false
 	}
-	for i := uint16(0); i < numParts; i++ {
-		if !assemblePart(i) {
-			return
-		}
+	defer bitmapFile.Close()
+	bits := make([]uint8, 1)
+	if _, err := bitmapFile.ReadAt(bits, int64(partNumber/8)); err != nil || bits[0]&(1<<(partNumber%8)) == 0 {
+		return 0, false
 	}
-	// Clean up the temporary files
-	os.RemoveAll(tempDir)
-
-	log.Printf("[%s] File assembled", fileInfo.FileName)
-}
-
-func getFilePart(relativeFilePath string, partNumber uint16, buffer []uint8) uint16 {
-	file, err := os.OpenFile(filepath.Join(GetSharePath(), relativeFilePath), os.O_RDONLY, 0700)
+	file, err := os.OpenFile(filepath.Join(partsDir, downloadDataFile), os.O_RDONLY, 0700)
 	if err != nil {
-		return 0
+		return 0, false
 	}
 	defer file.Close()
-	offset := 1024 * uint32(partNumber)
-	// Read the part from the file
-	bytesRead, err := file.ReadAt(buffer, int64(offset))
-	if err != nil && err != io.EOF {
-		log.Fatal(err)
+	data := buffer[:partLength(fileInfo, partNumber)]
+	if _, err := file.ReadAt(data, int64(partNumber*uint64(fileInfo.PartSize))); err != nil {
+		return 0, false
 	}
-	return uint16(bytesRead)
+	return uint16(len(data)), true
 }
 
-func writeFilePart(tempDir string, partNum uint16, filePartHeader packets.FilePartHeader) {
-	// Write the file partNum to disk
-	partPath := filepath.Join(tempDir, fmt.Sprintf("%d.part", partNum))
-	partFile, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0700)
+// Reads a chunk of leaves that has already been downloaded for a file that is still being assembled
+func getPartialLeafChunk(fileInfo packets.FileDigestHeader, chunk uint64) ([][packets.HashSize]uint8,
+	[][packets.HashSize]uint8, bool) {
+	partsDir := filepath.Join(GetPartsRoot(), hex.EncodeToString(fileInfo.FileHash[:]))
+	treeFile, err := os.Open(filepath.Join(partsDir, merkleTreeFile))
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, false
 	}
-	defer partFile.Close()
-	partFile.Write(filePartHeader.Data[:1024-filePartHeader.Padding])
-}
-
-func getNextPart(sequenceNumber uint16, fileInfo packets.FileDigestHeader, outputDirected chan packets.PeerPacket, newPeer node.Node) {
-	partRequest := new(packets.FilePartRequestHeader)
-	partRequest.Initialize(fileInfo.FileHash, sequenceNumber)
-	outputDirected <- packets.PeerPacket{partRequest, newPeer}
+	defer treeFile.Close()
+	return readLeafChunk(treeFile, fileInfo.NumParts(), chunk)
 }
 
-func getNextKey(partsNeeded map[uint16]bool, numParts uint16, currentKey *uint16) bool {
-	*currentKey %= numParts
-	if len(partsNeeded) == 0 {
-		return false
-	}
-	for nextKey := (*currentKey + 1) % numParts; nextKey != *currentKey; nextKey = (nextKey + 1) % numParts {
-		if _, ok := partsNeeded[nextKey]; ok {
-			*currentKey = nextKey
-			return true
-		}
-	}
-	for key := range partsNeeded {
-		*currentKey = key
-		return true
+// Finds the file a packet bound for a downloader belongs to
+func downloadFileHash(pkt packets.Packet) [packets.HashSize]uint8 {
+	switch header := pkt.(type) {
+	case *packets.FilePartHeader:
+		return header.FileHash
+	case *packets.BitfieldHeader:
+		return header.FileHash
+	case *packets.FileLeavesHeader:
+		return header.FileHash
 	}
-	return false
+	return [packets.HashSize]uint8{}
 }
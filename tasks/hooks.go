@@ -0,0 +1,60 @@
+package tasks
+
+import (
+	"archive/zip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"swarmd/util"
+)
+
+// The platform hooks are chosen for, as <os>/<arch>
+func nodePlatform() string {
+	return runtime.GOOS + "/" + runtime.GOARCH
+}
+
+// Finds the hook to run on this node, preferring one built for its architecture, then its OS, then one for any
+// platform. Returns an empty string if the module has none that fits.
+func resolveHook(moduleDir string, hook string) string {
+	for _, candidate := range util.HookCandidates(hook, runtime.GOOS, runtime.GOARCH) {
+		hookPath := filepath.Join(moduleDir, filepath.FromSlash(candidate))
+		if info, err := os.Stat(hookPath); err == nil && info.Mode().IsRegular() {
+			return hookPath
+		}
+	}
+	return ""
+}
+
+// Checks whether a module archive has an install hook for this node, without unpacking it. Modules without one
+// can't run here and are reported as unsupported instead of being installed.
+func archiveSupportsPlatform(archive string) (bool, error) {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	names := make(map[string]bool)
+	for _, f := range r.File {
+		names[f.Name] = true
+	}
+	for _, candidate := range util.HookCandidates("install", runtime.GOOS, runtime.GOARCH) {
+		if names[candidate] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Builds the command that runs a hook based on its extension
+func hookCommand(hookPath string) *exec.Cmd {
+	switch filepath.Ext(hookPath) {
+	case ".sh":
+		return exec.Command("bash", hookPath)
+	case ".ps1":
+		return exec.Command("powershell", hookPath)
+	case ".cmd":
+		return exec.Command("cmd", "/c", hookPath)
+	}
+	return exec.Command(hookPath)
+}
@@ -10,10 +10,9 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"crypto/md5"
-	"io"
-	"path/filepath"
 	"sync"
+	"time"
+	"swarmd/util"
 )
 
 type moduleCommand struct {
@@ -21,18 +20,70 @@ type moduleCommand struct {
 	Command    string
 }
 
+// Node settings, read from the command line or config.json
+type Options struct {
+	BootstrapHost string
+	BootstrapPort int
+	Key           string
+	Labels        []string
+	// Bytes per part when serving files, defaults to packets.DefaultPartSize
+	PartSize int
+	// File transfer limits in bytes per second, with optional K/M/G suffixes. Empty means unlimited.
+	UploadRate       string
+	DownloadRate     string
+	PeerUploadRate   string
+	PeerDownloadRate string
+	// Turns off compression of file parts, which otherwise is used with any peer that supports it
+	DisableCompression bool
+	// Most space share may use, with optional K/M/G/T suffixes. Empty means unlimited.
+	ShareQuota string
+	// Least sandboxing every module hook gets
+	Sandbox SandboxPolicy
+	// Limits on unpacking a module, 0 or empty means util.DefaultExtractLimits. The total is lowered further to keep
+	// some disk space free.
+	ExtractMaxFiles     int
+	ExtractMaxFileSize  string
+	ExtractMaxTotalSize string
+}
+
 type commonStruct struct {
 	Input         chan packets.PeerPacket
 	Broadcast     chan packets.Packet
 	Output        chan packets.PeerPacket
+	Bulk          *bulkQueue
 	FileShare     chan packets.PeerPacket
+	Fetch         chan [packets.HashSize]uint8
 	ModuleControl chan moduleCommand
 	Peers         chan node.Node
 	PeerMap       *sync.Map
+	DesiredState  *desiredStateStore
+	ModuleConfig  *moduleConfigStore
+	Replication   *replicationStore
+	Labels        []string
+	PartSize      uint16
+	Compression   bool
+	ShareQuota    int64
+	Sandbox       SandboxPolicy
+	Extract       util.ExtractLimits
+	Upload        *rateLimiter
+	Download      *rateLimiter
 	KillFlag      *bool
 	Key           [32]byte
 }
 
+// Parses a size limit such as a transfer rate in bytes per second, 0 meaning unlimited
+func parseLimit(limit string) int64 {
+	if limit == "" {
+		return 0
+	}
+	parsed, err := util.ParseSize(limit)
+	if err != nil || parsed < 0 {
+		log.Printf("Ignoring invalid limit: %s", limit)
+		return 0
+	}
+	return parsed
+}
+
 // Get preferred outbound ip of this machine
 func GetOutboundIP() net.IP {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
@@ -46,24 +97,51 @@ func GetOutboundIP() net.IP {
 	return localAddr.IP
 }
 
-func Run(killFlag *bool, bootstrapHost string, bootstrapPort int, seed string) {
+func Run(killFlag *bool, options Options) {
 	config := new(commonStruct)
 	config.Input = make(chan packets.PeerPacket)
 	config.Broadcast = make(chan packets.Packet)
 	config.Output = make(chan packets.PeerPacket)
+	config.Bulk = newBulkQueue()
 	config.FileShare = make(chan packets.PeerPacket)
+	config.Fetch = make(chan [packets.HashSize]uint8, 16)
 	config.ModuleControl = make(chan moduleCommand)
 	config.Peers = make(chan node.Node)
 	config.PeerMap = new(sync.Map)
+	config.DesiredState = loadDesiredState()
+	config.Replication = loadReplicationPolicies()
 	config.KillFlag = killFlag
-	config.Key = authentication.MakeKey(seed)
+	config.Key = authentication.MakeKey(options.Key)
+	config.ModuleConfig = loadModuleConfig(config.Key)
+	config.Labels = options.Labels
+	config.PartSize = packets.DefaultPartSize
+	if options.PartSize > 0 && options.PartSize <= packets.MaxPartSize {
+		config.PartSize = uint16(options.PartSize)
+	} else if options.PartSize != 0 {
+		log.Printf("Ignoring part size %d, must be between 1 and %d", options.PartSize, packets.MaxPartSize)
+	}
+	config.Compression = !options.DisableCompression
+	config.ShareQuota = parseLimit(options.ShareQuota)
+	config.Sandbox = options.Sandbox
+	config.Extract = util.DefaultExtractLimits
+	if options.ExtractMaxFiles > 0 {
+		config.Extract.MaxFiles = options.ExtractMaxFiles
+	}
+	if limit := parseLimit(options.ExtractMaxFileSize); limit > 0 {
+		config.Extract.MaxFileSize = limit
+	}
+	if limit := parseLimit(options.ExtractMaxTotalSize); limit > 0 {
+		config.Extract.MaxTotalSize = limit
+	}
+	config.Upload = newRateLimiter(parseLimit(options.UploadRate), parseLimit(options.PeerUploadRate))
+	config.Download = newRateLimiter(parseLimit(options.DownloadRate), parseLimit(options.PeerDownloadRate))
 
 	// Setup the port for connections
 	var bootstrapper *node.Node
-	if bootstrapHost != "" {
+	if options.BootstrapHost != "" {
 		bootstrapper = new(node.Node)
-		bootstrapper.Address = bootstrapHost
-		bootstrapper.Port = uint16(bootstrapPort)
+		bootstrapper.Address = options.BootstrapHost
+		bootstrapper.Port = uint16(options.BootstrapPort)
 		log.Printf("Configured bootstrap node: %s:%d", bootstrapper.Address, bootstrapper.Port)
 	}
 	localAddress := GetOutboundIP()
@@ -93,16 +171,19 @@ func Run(killFlag *bool, bootstrapHost string, bootstrapPort int, seed string) {
 	go Talker(conn, config)
 	go FileShare(config, self)
 	go PeerManager(config, bootstrapper)
-	go ModuleManager(config)
+	go ModuleManager(config, self)
 
 	for !*killFlag {
 		select {
 		case nodePkt := <-config.Input:
 			//print(nodePkt.Packet.ToString())
+			if _, ok := config.PeerMap.Load(nodePkt.Source); ok {
+				markPeerSeen(nodePkt.Source)
+			}
 			switch nodePkt.Packet.PacketType() {
 			// Generic message packet
 			case packets.PacketTypeMessageHeader:
-				HandleMessage(config, nodePkt)
+				HandleMessage(config, self, nodePkt)
 				// File Share packets
 			case packets.PacketTypeFileDigestHeader:
 				fallthrough
@@ -114,6 +195,16 @@ func Run(killFlag *bool, bootstrapHost string, bootstrapPort int, seed string) {
 				fallthrough
 			case packets.PacketTypeDeployment:
 				fallthrough
+			case packets.PacketTypeBitfield:
+				fallthrough
+			case packets.PacketTypeShareSummary:
+				fallthrough
+			case packets.PacketTypeShareEntries:
+				fallthrough
+			case packets.PacketTypeFileLeavesRequest:
+				fallthrough
+			case packets.PacketTypeFileLeaves:
+				fallthrough
 			case packets.PacketTypeManifestHeader:
 				config.FileShare <- nodePkt
 			case packets.PacketTypeConnectionRequest:
@@ -122,12 +213,20 @@ func Run(killFlag *bool, bootstrapHost string, bootstrapPort int, seed string) {
 				HandleConnectionShare(config, self, *nodePkt.Packet.(*packets.ConnectionShareHeader))
 			case packets.PacketTypeConnectionAck:
 				config.Peers <- nodePkt.Source
+			case packets.PacketTypeDesiredState:
+				HandleDesiredState(config, nodePkt)
+			case packets.PacketTypeModuleConfig:
+				HandleModuleConfig(config, nodePkt)
+			case packets.PacketTypeQuery:
+				HandleQuery(config, self, *nodePkt.Packet.(*packets.QueryHeader))
+			case packets.PacketTypeQueryResponse:
+				HandleQueryResponse(*nodePkt.Packet.(*packets.QueryResponseHeader))
 			}
 		}
 	}
 }
 
-func HandleMessage(config *commonStruct, pkt packets.PeerPacket) {
+func HandleMessage(config *commonStruct, self node.Node, pkt packets.PeerPacket) {
 	msg := pkt.Packet.(*packets.MessageHeader).Message
 	if msg == "__PING_REQ" { // Ping request -- respond with ack
 		response := new(packets.MessageHeader)
@@ -136,6 +235,7 @@ func HandleMessage(config *commonStruct, pkt packets.PeerPacket) {
 		config.Output <- nodePkt
 	} else if msg == "__PING_ACK" { // Ping ack, mark peer as live
 		config.PeerMap.Store(pkt.Source, 0)
+		markPingAcked(pkt.Source)
 	} else if msg == "__LIST_PEERS" {
 		response := new(packets.MessageHeader)
 		peers := ""
@@ -152,71 +252,91 @@ func HandleMessage(config *commonStruct, pkt packets.PeerPacket) {
 		nodePkt := packets.PeerPacket{Packet: response, Source: pkt.Source}
 		config.Output <- nodePkt
 	} else if strings.HasPrefix(msg, "__DEPLOY ") {
-		if !createDeployment(msg, pkt.Source, config.Broadcast, config.Output) {
+		if !createDeployment(msg, pkt.Source, config.Replication, config.Broadcast, config.Output) {
 			response := new(packets.MessageHeader)
 			response.Initialize("__DEPLOY_ERROR")
 			nodePkt := packets.PeerPacket{Packet: response, Source: pkt.Source}
 			config.Output <- nodePkt
 		}
+	} else if strings.HasPrefix(msg, "__QUERY ") {
+		handleQueryCommand(config, self, msg, pkt.Source)
+	} else if strings.HasPrefix(msg, "__QUERY_LOCAL ") {
+		handleLocalQueryCommand(config, self, msg, pkt.Source)
+	} else if strings.HasPrefix(msg, "__CONFIG_") {
+		handleConfigCommand(config, msg)
 	} else if strings.HasPrefix(msg, "__MODULE") {
-		handleModuleCommand(msg, config.ModuleControl)
-		config.Broadcast <- pkt.Packet
+		handleModuleCommand(config, msg, pkt)
 	} else { // Other message, print it
 		log.Print(pkt.Packet.ToString())
 	}
 }
 
-func handleModuleCommand(msg string, moduleCommands chan moduleCommand) {
+func handleModuleCommand(config *commonStruct, msg string, pkt packets.PeerPacket) {
 	words := strings.Split(msg, " ")
-	if len(words) != 2 {
+	if len(words) != 2 && len(words) != 3 {
+		return
+	}
+	moduleName := words[1]
+	targets := ""
+	if len(words) == 3 {
+		targets = words[2]
+	}
+	command := strings.ToLower(strings.TrimPrefix(words[0], "__MODULE_"))
+	if command == "delete" {
+		// Deleting an archive is a one-off action rather than a state, so it is still flooded as a command
+		config.ModuleControl <- moduleCommand{ModuleName: moduleName, Command: "delete"}
+		config.Broadcast <- pkt.Packet
 		return
 	}
-	command := moduleCommand{
-		ModuleName: words[1],
-		Command:    "",
-	}
-	switch words[0] {
-	case "__MODULE_INSTALL":
-		command.Command = "install"
-	case "__MODULE_START":
-		command.Command = "start"
-	case "__MODULE_STOP":
-		command.Command = "stop"
-	case "__MODULE_UNINSTALL":
-		command.Command = "uninstall"
-	case "__MODULE_DELETE":
-		command.Command = "delete"
-	default:
+	current, _ := config.DesiredState.Get(moduleName)
+	state, ok := signalState(command, current)
+	if !ok {
 		return
 	}
-	moduleCommands <- command
+	// Pin the version to whatever archive this node currently has for the module
+	version := signalVersion(moduleName, state)
+	module := desiredModule{
+		Name:     moduleName,
+		State:    state,
+		Version:  version,
+		Targets:  targets,
+		Revision: nextRevision(current.Revision),
+	}
+	config.DesiredState.Update(module)
+	config.Broadcast <- module.ToPacket()
+	config.ModuleControl <- moduleCommand{ModuleName: moduleName, Command: "reconcile"}
+	// Tell the console which revision to follow the outcome of
+	response := new(packets.MessageHeader)
+	response.Initialize(fmt.Sprintf("__MODULE_ACK %d", module.Revision))
+	config.Output <- packets.PeerPacket{Packet: response, Source: pkt.Source}
 }
 
-func createDeployment(msg string, source node.Node, outputGeneral chan packets.Packet,
+func createDeployment(msg string, source node.Node, replication *replicationStore, outputGeneral chan packets.Packet,
 	outputDirected chan packets.PeerPacket) bool {
 	words := strings.Split(msg, " ")
-	if len(words) != 2 {
+	if len(words) != 2 && len(words) != 3 {
 		return false
 	}
-	log.Printf("Starting deployment for %s", words[1])
-	targetPath := filepath.Join(GetSharePath(), fmt.Sprintf("%s.swm", words[1]))
-	file, err := os.Open(targetPath)
-	if err != nil {
-		log.Printf("Error opening target module: %v\n", err)
-		return false
+	policy := replicationPolicy{Mode: replicateAll}
+	if len(words) == 3 {
+		var err error
+		if policy, err = parseReplicationPolicy(words[2]); err != nil {
+			log.Printf("Error starting deployment: %v", err)
+			return false
+		}
 	}
-	defer file.Close()
-	// Generate the checksum
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		log.Printf("Error getting file hash: %v\n", err)
+	log.Printf("Starting deployment for %s (replication: %s)", words[1], policy)
+	// Move the archive the console left in share into the store
+	fileHash, err := ImportShareFile(fmt.Sprintf("%s.swm", words[1]))
+	if err != nil {
+		log.Printf("Error importing target module: %v\n", err)
 		return false
 	}
+	revision := uint64(time.Now().UnixNano())
+	replication.Merge(fileHash, policy, revision)
 	// Kick off the deployment
-	var fileHash [16]uint8
-	copy(fileHash[:], hash.Sum(nil)[:16])
 	deploymentPacket := new(packets.DeploymentHeader)
-	deploymentPacket.Initialize(fileHash)
+	deploymentPacket.Initialize(fileHash, policy.String(), revision)
 	outputGeneral <- deploymentPacket
 	// Send the response to the console
 	response := new(packets.MessageHeader)
@@ -0,0 +1,344 @@
+package tasks
+
+import (
+	"swarmd/packets"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Files are split into parts and hashed into a Merkle tree so that each part can be checked on its own as it arrives.
+// Leaves are SHA-256(0x00 || part) and inner nodes SHA-256(0x01 || left || right). A node without a sibling is carried
+// up to the next level unchanged. The tree depends on the part size, so each part size has its own root.
+//
+// Rather than a proof with every part, a downloader fetches the leaves once, in chunks of packets.LeavesPerChunk. Each
+// chunk is a whole subtree, so it comes with the few hashes needed to check it against the root, after which each
+// part only has to match its leaf.
+//
+// Trees are kept in files holding every level one after the other, starting with the leaves. Nodes that aren't known
+// yet, as in the tree of a download, are left as zeroes.
+
+// Level of the tree each chunk of leaves adds up to, packets.LeavesPerChunk is 1 << merkleChunkLevel
+const merkleChunkLevel = 10
+
+// Only one tree is built at a time, since it means reading the whole file
+var merkleBuildSlot = make(chan struct{}, 1)
+
+func merkleLeaf(data []uint8) [packets.HashSize]uint8 {
+	return sha256.Sum256(append([]uint8{0}, data...))
+}
+
+func merkleNode(left [packets.HashSize]uint8, right [packets.HashSize]uint8) [packets.HashSize]uint8 {
+	buffer := make([]uint8, 0, 1+2*packets.HashSize)
+	buffer = append(buffer, 1)
+	buffer = append(buffer, left[:]...)
+	buffer = append(buffer, right[:]...)
+	return sha256.Sum256(buffer)
+}
+
+// Number of nodes on each level of the tree, starting from the leaves
+func merkleLevelSizes(numParts uint64) []uint64 {
+	sizes := []uint64{numParts}
+	for numParts > 1 {
+		numParts = (numParts + 1) / 2
+		sizes = append(sizes, numParts)
+	}
+	return sizes
+}
+
+// Position of a node in a tree file
+func merkleNodeOffset(numParts uint64, level int, index uint64) int64 {
+	offset := uint64(0)
+	for _, size := range merkleLevelSizes(numParts)[:level] {
+		offset += size
+	}
+	return int64((offset + index) * packets.HashSize)
+}
+
+func numLeafChunks(numParts uint64) uint64 {
+	return (numParts + packets.LeavesPerChunk - 1) / packets.LeavesPerChunk
+}
+
+// Number of leaves in a chunk, the last one can be short
+func leafChunkLength(numParts uint64, chunk uint64) uint64 {
+	length := uint64(packets.LeavesPerChunk)
+	if remaining := numParts - chunk*packets.LeavesPerChunk; remaining < length {
+		length = remaining
+	}
+	return length
+}
+
+// The level a chunk's subtree tops out at, lower than merkleChunkLevel when the whole tree is smaller than a chunk
+func leafChunkLevel(numParts uint64) int {
+	if top := len(merkleLevelSizes(numParts)) - 1; top < merkleChunkLevel {
+		return top
+	}
+	return merkleChunkLevel
+}
+
+// Hashes nodes up to a single root
+func merkleSubtreeRoot(nodes [][packets.HashSize]uint8) [packets.HashSize]uint8 {
+	if len(nodes) == 0 {
+		// An empty file has no parts, so its root is the hash of an empty leaf
+		return merkleLeaf(nil)
+	}
+	for len(nodes) > 1 {
+		next := make([][packets.HashSize]uint8, 0, (len(nodes)+1)/2)
+		for i := 0; i < len(nodes); i += 2 {
+			if i+1 < len(nodes) {
+				next = append(next, merkleNode(nodes[i], nodes[i+1]))
+			} else {
+				next = append(next, nodes[i])
+			}
+		}
+		nodes = next
+	}
+	return nodes[0]
+}
+
+// Walks a node and its proof up the tree, calling visit with the position and hash of every node along the way: the
+// nodes on the path to the root and their siblings. Returns the root the proof leads to, or false if the proof is the
+// wrong length.
+func walkMerkleProof(numParts uint64, level int, index uint64, hash [packets.HashSize]uint8,
+	proof [][packets.HashSize]uint8, visit func(level int, index uint64, hash [packets.HashSize]uint8)) (
+	[packets.HashSize]uint8, bool) {
+	used := 0
+	sizes := merkleLevelSizes(numParts)
+	for ; level < len(sizes)-1; level++ {
+		visit(level, index, hash)
+		if sibling := index ^ 1; sibling < sizes[level] {
+			if used >= len(proof) {
+				return hash, false
+			}
+			visit(level, sibling, proof[used])
+			if index%2 == 0 {
+				hash = merkleNode(hash, proof[used])
+			} else {
+				hash = merkleNode(proof[used], hash)
+			}
+			used += 1
+		}
+		index /= 2
+	}
+	visit(level, index, hash)
+	return hash, used == len(proof)
+}
+
+// Checks a chunk of leaves against the root of the tree
+func verifyLeafChunk(root [packets.HashSize]uint8, numParts uint64, chunk uint64, leaves [][packets.HashSize]uint8,
+	proof [][packets.HashSize]uint8) bool {
+	if chunk >= numLeafChunks(numParts) || uint64(len(leaves)) != leafChunkLength(numParts, chunk) {
+		return false
+	}
+	computed, ok := walkMerkleProof(numParts, leafChunkLevel(numParts), chunk, merkleSubtreeRoot(leaves), proof,
+		func(int, uint64, [packets.HashSize]uint8) {})
+	return ok && computed == root
+}
+
+// Stores a verified chunk of leaves along with the nodes its proof gave, so that the chunk can be passed on to others
+func writeLeafChunk(treeFile *os.File, numParts uint64, chunk uint64, leaves [][packets.HashSize]uint8,
+	proof [][packets.HashSize]uint8) error {
+	buffer := make([]uint8, 0, len(leaves)*packets.HashSize)
+	for _, leaf := range leaves {
+		buffer = append(buffer, leaf[:]...)
+	}
+	if _, err := treeFile.WriteAt(buffer, merkleNodeOffset(numParts, 0, chunk*packets.LeavesPerChunk)); err != nil {
+		return err
+	}
+	var writeErr error
+	walkMerkleProof(numParts, leafChunkLevel(numParts), chunk, merkleSubtreeRoot(leaves), proof,
+		func(level int, index uint64, hash [packets.HashSize]uint8) {
+			if _, err := treeFile.WriteAt(hash[:], merkleNodeOffset(numParts, level, index)); err != nil {
+				writeErr = err
+			}
+		})
+	return writeErr
+}
+
+// Reads a chunk of leaves and its proof out of a tree file. Fails if any of them haven't been stored yet.
+func readLeafChunk(treeFile *os.File, numParts uint64, chunk uint64) ([][packets.HashSize]uint8,
+	[][packets.HashSize]uint8, bool) {
+	var empty [packets.HashSize]uint8
+	if chunk >= numLeafChunks(numParts) {
+		return nil, nil, false
+	}
+	length := leafChunkLength(numParts, chunk)
+	buffer := make([]uint8, length*packets.HashSize)
+	if _, err := treeFile.ReadAt(buffer, merkleNodeOffset(numParts, 0, chunk*packets.LeavesPerChunk)); err != nil {
+		return nil, nil, false
+	}
+	leaves := make([][packets.HashSize]uint8, length)
+	for i := range leaves {
+		copy(leaves[i][:], buffer[i*packets.HashSize:])
+		if leaves[i] == empty {
+			return nil, nil, false
+		}
+	}
+	var proof [][packets.HashSize]uint8
+	index := chunk
+	sizes := merkleLevelSizes(numParts)
+	for level := leafChunkLevel(numParts); level < len(sizes)-1; level++ {
+		if sibling := index ^ 1; sibling < sizes[level] {
+			var hash [packets.HashSize]uint8
+			if _, err := treeFile.ReadAt(hash[:], merkleNodeOffset(numParts, level, sibling)); err != nil ||
+				hash == empty {
+				return nil, nil, false
+			}
+			proof = append(proof, hash)
+		}
+		index /= 2
+	}
+	return leaves, proof, true
+}
+
+// Reads a stored leaf
+func readMerkleLeaf(treeFile *os.File, numParts uint64, part uint64) ([packets.HashSize]uint8, bool) {
+	var hash [packets.HashSize]uint8
+	if _, err := treeFile.ReadAt(hash[:], merkleNodeOffset(numParts, 0, part)); err != nil {
+		return hash, false
+	}
+	return hash, hash != [packets.HashSize]uint8{}
+}
+
+// Reads the root from the end of a complete tree file
+func readMerkleRoot(treePath string, numParts uint64) ([packets.HashSize]uint8, bool) {
+	var root [packets.HashSize]uint8
+	if numParts == 0 {
+		return merkleLeaf(nil), true
+	}
+	treeFile, err := os.Open(treePath)
+	if err != nil {
+		return root, false
+	}
+	defer treeFile.Close()
+	sizes := merkleLevelSizes(numParts)
+	if _, err := treeFile.ReadAt(root[:], merkleNodeOffset(numParts, len(sizes)-1, 0)); err != nil {
+		return root, false
+	}
+	return root, true
+}
+
+// Hashes a file into a tree file of the given part size, a level at a time so that only a little of the tree is ever
+// in memory. Returns the root.
+func buildMerkleTree(path string, treePath string, partSize uint16) ([packets.HashSize]uint8, error) {
+	var root [packets.HashSize]uint8
+	file, err := os.Open(path)
+	if err != nil {
+		return root, err
+	}
+	defer file.Close()
+	treeFile, err := os.OpenFile(treePath+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return root, err
+	}
+	defer os.Remove(treePath + ".tmp")
+	defer treeFile.Close()
+
+	writer := bufio.NewWriter(treeFile)
+	numParts := uint64(0)
+	buffer := make([]uint8, partSize)
+	for {
+		bytesRead, err := io.ReadFull(file, buffer)
+		if bytesRead > 0 {
+			leaf := merkleLeaf(buffer[:bytesRead])
+			writer.Write(leaf[:])
+			numParts += 1
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return root, err
+		}
+	}
+	// Each level is read back from the file while the next is written after it
+	sizes := merkleLevelSizes(numParts)
+	for level := 0; level < len(sizes)-1; level++ {
+		if err := writer.Flush(); err != nil {
+			return root, err
+		}
+		start := merkleNodeOffset(numParts, level, 0)
+		reader := bufio.NewReader(io.NewSectionReader(treeFile, start, int64(sizes[level])*packets.HashSize))
+		var left, right [packets.HashSize]uint8
+		for i := uint64(0); i < sizes[level]; i += 2 {
+			if _, err := io.ReadFull(reader, left[:]); err != nil {
+				return root, err
+			}
+			node := left
+			if i+1 < sizes[level] {
+				if _, err := io.ReadFull(reader, right[:]); err != nil {
+					return root, err
+				}
+				node = merkleNode(left, right)
+			}
+			writer.Write(node[:])
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return root, err
+	}
+	if err := treeFile.Close(); err != nil {
+		return root, err
+	}
+	if err := os.Rename(treePath+".tmp", treePath); err != nil {
+		return root, err
+	}
+	root, ok := readMerkleRoot(treePath, numParts)
+	if !ok {
+		return root, fmt.Errorf("unable to read back the tree of %s", path)
+	}
+	return root, nil
+}
+
+// Trees of the files in share, built for this node's part size only
+func GetTreesPath() string {
+	treesPath := filepath.Join(GetSharePath(), "trees")
+
+	// Make the tree directory if it doesn't exist
+	os.MkdirAll(treesPath, 0700)
+
+	return treesPath
+}
+
+func shareTreePath(fileHash [packets.HashSize]uint8, partSize uint16) string {
+	return filepath.Join(GetTreesPath(), fmt.Sprintf("%s.%d", hex.EncodeToString(fileHash[:]), partSize))
+}
+
+// Removes the trees of a file, of every part size
+func removeShareTrees(fileID string) {
+	entries, _ := ioutil.ReadDir(GetTreesPath())
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), fileID+".") {
+			os.Remove(filepath.Join(GetTreesPath(), entry.Name()))
+		}
+	}
+}
+
+// Builds the tree of a file in share, replacing any built with a different part size. Waits for any other tree being
+// built first.
+func buildShareTree(fileHash [packets.HashSize]uint8, partSize uint16) ([packets.HashSize]uint8, error) {
+	merkleBuildSlot <- struct{}{}
+	defer func() { <-merkleBuildSlot }()
+	removeShareTrees(hex.EncodeToString(fileHash[:]))
+	return buildMerkleTree(GetBlobPath(fileHash), shareTreePath(fileHash, partSize), partSize)
+}
+
+// Reads a chunk of leaves for a file in share, false if its tree hasn't been built
+func readShareLeafChunk(fileHash [packets.HashSize]uint8, partSize uint16, fileSize uint64, chunk uint64) (
+	[][packets.HashSize]uint8, [][packets.HashSize]uint8, bool) {
+	treeFile, err := os.Open(shareTreePath(fileHash, partSize))
+	if err != nil {
+		return nil, nil, false
+	}
+	defer treeFile.Close()
+	return readLeafChunk(treeFile, partCount(fileSize, partSize), chunk)
+}
+
+func partCount(fileSize uint64, partSize uint16) uint64 {
+	return (fileSize + uint64(partSize) - 1) / uint64(partSize)
+}
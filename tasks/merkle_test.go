@@ -0,0 +1,291 @@
+package tasks
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"swarmd/packets"
+	"testing"
+)
+
+const testPartSize = 16
+
+// Writes a file of random data
+func writeTestFile(t *testing.T, size int) (string, []uint8) {
+	t.Helper()
+	data := make([]uint8, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+// Hashes data into a root the slow way, as a check on the tree files
+func naiveMerkleRoot(data []uint8, partSize int) [packets.HashSize]uint8 {
+	var nodes [][packets.HashSize]uint8
+	for start := 0; start < len(data); start += partSize {
+		end := start + partSize
+		if end > len(data) {
+			end = len(data)
+		}
+		nodes = append(nodes, sha256.Sum256(append([]uint8{0}, data[start:end]...)))
+	}
+	if len(nodes) == 0 {
+		return sha256.Sum256([]uint8{0})
+	}
+	for len(nodes) > 1 {
+		var next [][packets.HashSize]uint8
+		for i := 0; i < len(nodes); i += 2 {
+			if i+1 == len(nodes) {
+				next = append(next, nodes[i])
+				continue
+			}
+			pair := append([]uint8{1}, nodes[i][:]...)
+			next = append(next, sha256.Sum256(append(pair, nodes[i+1][:]...)))
+		}
+		nodes = next
+	}
+	return nodes[0]
+}
+
+// Builds the tree of a random file, checking its root
+func buildTestTree(t *testing.T, size int) (string, []uint8, [packets.HashSize]uint8) {
+	t.Helper()
+	path, data := writeTestFile(t, size)
+	treePath := filepath.Join(t.TempDir(), "tree")
+	root, err := buildMerkleTree(path, treePath, testPartSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != naiveMerkleRoot(data, testPartSize) {
+		t.Fatalf("root of a %d byte file doesn't match", size)
+	}
+	return treePath, data, root
+}
+
+var testTreeSizes = []int{
+	0,
+	5,
+	3*testPartSize + 1,
+	packets.LeavesPerChunk * testPartSize,
+	(packets.LeavesPerChunk + 1) * testPartSize,
+	(2*packets.LeavesPerChunk+452)*testPartSize + 7,
+}
+
+func TestBuildMerkleTree(t *testing.T) {
+	for _, size := range testTreeSizes {
+		treePath, data, root := buildTestTree(t, size)
+		numParts := partCount(uint64(size), testPartSize)
+		if stored, ok := readMerkleRoot(treePath, numParts); !ok || stored != root {
+			t.Errorf("stored root of a %d byte file doesn't match", size)
+		}
+		if numParts == 0 {
+			continue
+		}
+		treeFile, err := os.Open(treePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for part := uint64(0); part < numParts; part++ {
+			end := (part + 1) * testPartSize
+			if end > uint64(size) {
+				end = uint64(size)
+			}
+			leaf, ok := readMerkleLeaf(treeFile, numParts, part)
+			if !ok || leaf != merkleLeaf(data[part*testPartSize:end]) {
+				t.Errorf("leaf %d of a %d byte file doesn't match its part", part, size)
+			}
+		}
+		treeFile.Close()
+	}
+}
+
+func TestVerifyLeafChunk(t *testing.T) {
+	for _, size := range testTreeSizes[1:] {
+		treePath, _, root := buildTestTree(t, size)
+		numParts := partCount(uint64(size), testPartSize)
+		treeFile, err := os.Open(treePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer treeFile.Close()
+		for chunk := uint64(0); chunk < numLeafChunks(numParts); chunk++ {
+			leaves, proof, ok := readLeafChunk(treeFile, numParts, chunk)
+			if !ok {
+				t.Fatalf("unable to read chunk %d of a %d byte file", chunk, size)
+			}
+			if !verifyLeafChunk(root, numParts, chunk, leaves, proof) {
+				t.Errorf("chunk %d of a %d byte file doesn't verify", chunk, size)
+			}
+
+			tampered := append([][packets.HashSize]uint8(nil), leaves...)
+			tampered[len(tampered)-1][0] ^= 1
+			if verifyLeafChunk(root, numParts, chunk, tampered, proof) {
+				t.Errorf("tampered leaves of chunk %d of a %d byte file verified", chunk, size)
+			}
+			if verifyLeafChunk(root, numParts, chunk, leaves[:len(leaves)-1], proof) {
+				t.Errorf("short chunk %d of a %d byte file verified", chunk, size)
+			}
+			if chunk+1 < numLeafChunks(numParts) && verifyLeafChunk(root, numParts, chunk+1, leaves, proof) {
+				t.Errorf("chunk %d of a %d byte file verified as the next chunk", chunk, size)
+			}
+			if len(proof) > 0 {
+				badProof := append([][packets.HashSize]uint8(nil), proof...)
+				badProof[0][0] ^= 1
+				if verifyLeafChunk(root, numParts, chunk, leaves, badProof) {
+					t.Errorf("tampered proof of chunk %d of a %d byte file verified", chunk, size)
+				}
+				if verifyLeafChunk(root, numParts, chunk, leaves, proof[:len(proof)-1]) {
+					t.Errorf("truncated proof of chunk %d of a %d byte file verified", chunk, size)
+				}
+			}
+			if verifyLeafChunk(root, numParts, chunk, leaves, append(proof, root)) {
+				t.Errorf("padded proof of chunk %d of a %d byte file verified", chunk, size)
+			}
+		}
+		if verifyLeafChunk(root, numParts, numLeafChunks(numParts), nil, nil) {
+			t.Errorf("chunk past the end of a %d byte file verified", size)
+		}
+	}
+}
+
+func TestWriteLeafChunk(t *testing.T) {
+	size := testTreeSizes[len(testTreeSizes)-1]
+	treePath, _, root := buildTestTree(t, size)
+	numParts := partCount(uint64(size), testPartSize)
+	source, err := os.Open(treePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	treeFile, err := os.Create(filepath.Join(t.TempDir(), "tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer treeFile.Close()
+
+	// Chunks can only be read back once they have been written, in whatever order they arrive
+	for _, chunk := range []uint64{2, 0, 1} {
+		if _, _, ok := readLeafChunk(treeFile, numParts, chunk); ok {
+			t.Fatalf("chunk %d read back before it was written", chunk)
+		}
+		leaves, proof, _ := readLeafChunk(source, numParts, chunk)
+		if err := writeLeafChunk(treeFile, numParts, chunk, leaves, proof); err != nil {
+			t.Fatal(err)
+		}
+		leaves, proof, ok := readLeafChunk(treeFile, numParts, chunk)
+		if !ok || !verifyLeafChunk(root, numParts, chunk, leaves, proof) {
+			t.Errorf("chunk %d doesn't verify after being written", chunk)
+		}
+	}
+}
+
+func TestLoadDownloadedParts(t *testing.T) {
+	size := (packets.LeavesPerChunk+20)*testPartSize + 3
+	treePath, data, root := buildTestTree(t, size)
+	var fileInfo packets.FileDigestHeader
+	fileInfo.Initialize([packets.HashSize]uint8{1}, uint64(size), testPartSize, 0, root, "file")
+	numParts := fileInfo.NumParts()
+
+	// Only the first chunk of leaves made it to disk
+	source, err := os.Open(treePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	dir := t.TempDir()
+	treeFile, err := os.Create(filepath.Join(dir, merkleTreeFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer treeFile.Close()
+	leaves, proof, _ := readLeafChunk(source, numParts, 0)
+	if err := writeLeafChunk(treeFile, numParts, 0, leaves, proof); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bitmap claims parts 0-7 and the whole second chunk, but part 3 was corrupted
+	data[3*testPartSize] ^= 1
+	dataFile, err := os.Create(filepath.Join(dir, downloadDataFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dataFile.Close()
+	if _, err := dataFile.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	claimed := newPartBitmap(numParts)
+	for part := uint64(0); part < numParts; part++ {
+		if part < 8 || part >= packets.LeavesPerChunk {
+			claimed.Set(part)
+		}
+	}
+	bitmapFile, err := os.Create(filepath.Join(dir, downloadBitmapFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bitmapFile.Close()
+	if _, err := bitmapFile.Write(claimed.Bytes(0, int(numParts))); err != nil {
+		t.Fatal(err)
+	}
+
+	leavesHave := newPartBitmap(numLeafChunks(numParts))
+	loadLeafChunks(treeFile, fileInfo, leavesHave)
+	if !leavesHave.Has(0) || leavesHave.Has(1) {
+		t.Fatalf("expected only the first chunk of leaves, got %d", leavesHave.Count())
+	}
+	partsHave := newPartBitmap(numParts)
+	loadDownloadedParts(dataFile, bitmapFile, treeFile, fileInfo, partsHave, leavesHave)
+	for part := uint64(0); part < numParts; part++ {
+		expected := part < 8 && part != 3
+		if partsHave.Has(part) != expected {
+			t.Errorf("part %d: expected %v, got %v", part, expected, partsHave.Has(part))
+		}
+	}
+
+	// The bitmap on disk no longer claims the parts that didn't check out
+	reloaded := newPartBitmap(numParts)
+	loadDownloadedParts(dataFile, bitmapFile, treeFile, fileInfo, reloaded, leavesHave)
+	if reloaded.Count() != partsHave.Count() {
+		t.Errorf("expected %d parts after reloading, got %d", partsHave.Count(), reloaded.Count())
+	}
+	bits := make([]uint8, 2)
+	bitmapFile.ReadAt(bits, 0)
+	if bits[0] != 0xF7 || bits[1] != 0 {
+		t.Errorf("unexpected bitmap %x", bits)
+	}
+}
+
+func TestPartBitmap(t *testing.T) {
+	bitmap := newPartBitmap(20)
+	for part := uint64(0); part < 20; part++ {
+		if part != 9 && part != 17 {
+			bitmap.Set(part)
+		}
+	}
+	bitmap.Set(0)
+	if bitmap.Count() != 18 || bitmap.Missing() != 2 || bitmap.Complete() {
+		t.Fatalf("unexpected count %d", bitmap.Count())
+	}
+	for _, test := range []struct{ after, next uint64 }{{0, 9}, {9, 17}, {17, 9}, {19, 9}} {
+		if next, ok := bitmap.NextMissing(test.after); !ok || next != test.next {
+			t.Errorf("after %d: expected %d, got %d", test.after, test.next, next)
+		}
+	}
+	if bytes := bitmap.Bytes(8, 2); len(bytes) != 2 || bytes[0] != 0xFD || bytes[1] != 0x0D {
+		t.Errorf("unexpected bytes %x", bytes)
+	}
+	if bytes := bitmap.Bytes(24, 1); bytes != nil {
+		t.Errorf("expected nothing past the end, got %x", bytes)
+	}
+	bitmap.Set(9)
+	bitmap.Set(17)
+	if _, ok := bitmap.NextMissing(0); ok || !bitmap.Complete() {
+		t.Error("expected a complete bitmap")
+	}
+}
@@ -0,0 +1,300 @@
+package tasks
+
+import (
+	"swarmd/packets"
+	"swarmd/node"
+	"swarmd/util"
+	"swarmd/authentication"
+	"path/filepath"
+	"sync"
+	"io/ioutil"
+	"encoding/json"
+	"encoding/base64"
+	"log"
+	"os"
+	"fmt"
+	"strings"
+	"regexp"
+)
+
+// Config keys become environment variables, so they are restricted to valid variable names
+var configKeyRegex = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// Rendered into the module directory before each hook runs. Secrets are left out and only passed in the environment.
+const moduleConfigFile = ".SWARMD_CONFIG.json"
+
+// A single configuration value for a module. The scope is empty for every node, "label:<name>" for nodes carrying
+// that label or "node:<address>[:<port>]" for one node, with more specific scopes overriding less specific ones.
+type moduleSetting struct {
+	Module   string
+	Scope    string
+	Key      string
+	Value    string
+	Flags    uint8
+	Revision uint64
+}
+
+// Replicated store of module settings, merged last-writer-wins in the same way as the desired state. Secret values
+// are sealed with the swarm key by the node they are set on and are only ever stored and sent sealed. They are opened
+// when a node resolves them for one of its own modules, so the plaintext never leaves the nodes the setting targets.
+type moduleConfigStore struct {
+	lock     sync.Mutex
+	path     string
+	key      [32]byte
+	settings map[string]moduleSetting
+}
+
+func GetModuleConfigPath() string {
+	return filepath.Join(util.GetBasePath(), "moduleconfig.json")
+}
+
+func loadModuleConfig(key [32]byte) *moduleConfigStore {
+	store := &moduleConfigStore{
+		path:     GetModuleConfigPath(),
+		key:      key,
+		settings: make(map[string]moduleSetting),
+	}
+	file, err := ioutil.ReadFile(store.path)
+	if err != nil {
+		return store
+	}
+	if err := json.Unmarshal(file, &store.settings); err != nil {
+		log.Printf("Unable to parse module config, starting empty: %v", err)
+		store.settings = make(map[string]moduleSetting)
+	}
+	return store
+}
+
+func (s moduleSetting) id() string {
+	return strings.Join([]string{s.Module, s.Scope, s.Key}, "\x00")
+}
+
+func (s moduleSetting) IsSecret() bool {
+	return s.Flags&packets.ModuleConfigSecret != 0
+}
+
+func (s moduleSetting) IsDeleted() bool {
+	return s.Flags&packets.ModuleConfigDeleted != 0
+}
+
+// Merges a setting into the store, returning true if it was newer than what was already known
+func (s *moduleConfigStore) Update(setting moduleSetting) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if current, ok := s.settings[setting.id()]; ok && current.Revision >= setting.Revision {
+		return false
+	}
+	s.settings[setting.id()] = setting
+	s.save()
+	return true
+}
+
+func (s *moduleConfigStore) Get(module string, scope string, key string) (moduleSetting, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	setting, ok := s.settings[moduleSetting{Module: module, Scope: scope, Key: key}.id()]
+	return setting, ok
+}
+
+// Returns every setting as it is stored, with secrets still sealed
+func (s *moduleConfigStore) All() []moduleSetting {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	settings := make([]moduleSetting, 0, len(s.settings))
+	for _, setting := range s.settings {
+		settings = append(settings, setting)
+	}
+	return settings
+}
+
+// Seals a secret value so that it can be stored and sent to other nodes
+func (s *moduleConfigStore) Seal(value string) (string, error) {
+	sealed, err := authentication.Seal([]byte(value), s.key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Works out the effective settings of a module on this node. Returns the values and the set of keys that are
+// secret.
+func (s *moduleConfigStore) Resolve(module string, self node.Node, labels []string) (map[string]string,
+	map[string]bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	selected := make(map[string]moduleSetting)
+	precedence := make(map[string]int)
+	for _, setting := range s.settings {
+		if setting.Module != module || setting.IsDeleted() {
+			continue
+		}
+		level := scopeLevel(setting.Scope, self, labels)
+		if level < 0 {
+			continue
+		}
+		current, ok := selected[setting.Key]
+		if !ok || level > precedence[setting.Key] ||
+			(level == precedence[setting.Key] && setting.Revision > current.Revision) {
+			selected[setting.Key] = setting
+			precedence[setting.Key] = level
+		}
+	}
+	values := make(map[string]string)
+	secrets := make(map[string]bool)
+	for key, setting := range selected {
+		values[key] = s.reveal(setting)
+		if setting.IsSecret() {
+			secrets[key] = true
+		}
+	}
+	return values, secrets
+}
+
+// Ranks how specific a scope is for this node, or -1 if it doesn't apply
+func scopeLevel(scope string, self node.Node, labels []string) int {
+	if scope == "" {
+		return 0
+	}
+	if strings.HasPrefix(scope, "label:") {
+		for _, label := range labels {
+			if label == strings.TrimPrefix(scope, "label:") {
+				return 1
+			}
+		}
+		return -1
+	}
+	if strings.HasPrefix(scope, "node:") {
+		target := strings.TrimPrefix(scope, "node:")
+		if target == self.Address || target == fmt.Sprintf("%s:%d", self.Address, self.Port) {
+			return 2
+		}
+	}
+	return -1
+}
+
+// Decrypts a stored value if it is a secret. Must be called with the lock held.
+func (s *moduleConfigStore) reveal(setting moduleSetting) string {
+	if !setting.IsSecret() || setting.IsDeleted() {
+		return setting.Value
+	}
+	sealed, err := base64.StdEncoding.DecodeString(setting.Value)
+	if err != nil {
+		return ""
+	}
+	value, err := authentication.Open(sealed, s.key)
+	if err != nil {
+		log.Printf("Unable to decrypt secret %s for %s", setting.Key, setting.Module)
+		return ""
+	}
+	return string(value)
+}
+
+// Writes the store to disk. Must be called with the lock held.
+func (s *moduleConfigStore) save() {
+	data, err := json.MarshalIndent(s.settings, "", "  ")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	tempPath := s.path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0600); err != nil {
+		log.Printf("Unable to save module config: %v", err)
+		return
+	}
+	if err := os.Rename(tempPath, s.path); err != nil {
+		log.Printf("Unable to save module config: %v", err)
+	}
+}
+
+func (s moduleSetting) ToPacket() *packets.ModuleConfigHeader {
+	pkt := new(packets.ModuleConfigHeader)
+	pkt.Initialize(s.Module, s.Scope, s.Key, s.Value, s.Flags, s.Revision)
+	return pkt
+}
+
+func moduleSettingFromPacket(pkt *packets.ModuleConfigHeader) moduleSetting {
+	return moduleSetting{
+		Module:   pkt.ModuleName,
+		Scope:    pkt.Scope,
+		Key:      pkt.Key,
+		Value:    pkt.Value,
+		Flags:    pkt.Flags,
+		Revision: pkt.Revision,
+	}
+}
+
+func HandleModuleConfig(config *commonStruct, pkt packets.PeerPacket) {
+	setting := moduleSettingFromPacket(pkt.Packet.(*packets.ModuleConfigHeader))
+	if config.ModuleConfig.Update(setting) {
+		config.Broadcast <- pkt.Packet
+	}
+}
+
+// Handles a config change from the console:
+//   __CONFIG_SET <module> <scope> <secret> <key>=<value>
+//   __CONFIG_UNSET <module> <scope> <key>
+// where a scope of * applies to every node
+func handleConfigCommand(config *commonStruct, msg string) {
+	words := strings.SplitN(msg, " ", 5)
+	if len(words) < 4 {
+		return
+	}
+	setting := moduleSetting{Module: words[1], Scope: words[2]}
+	if setting.Scope == "*" {
+		setting.Scope = ""
+	}
+	switch {
+	case words[0] == "__CONFIG_SET" && len(words) == 5:
+		pair := strings.SplitN(words[4], "=", 2)
+		if len(pair) != 2 {
+			return
+		}
+		setting.Key = pair[0]
+		setting.Value = pair[1]
+		if words[3] == "1" {
+			setting.Flags |= packets.ModuleConfigSecret
+			sealed, err := config.ModuleConfig.Seal(setting.Value)
+			if err != nil {
+				log.Printf("Unable to seal secret %s for %s: %v", setting.Key, setting.Module, err)
+				return
+			}
+			setting.Value = sealed
+		}
+	case words[0] == "__CONFIG_UNSET" && len(words) == 4:
+		setting.Key = words[3]
+		setting.Flags |= packets.ModuleConfigDeleted
+	default:
+		return
+	}
+	if !configKeyRegex.MatchString(setting.Key) {
+		log.Printf("Ignoring invalid config key for %s: %s", setting.Module, setting.Key)
+		return
+	}
+	current, _ := config.ModuleConfig.Get(setting.Module, setting.Scope, setting.Key)
+	setting.Revision = nextRevision(current.Revision)
+	config.ModuleConfig.Update(setting)
+	config.Broadcast <- setting.ToPacket()
+}
+
+// Renders the module's settings for a hook: non-secret values are written to the module directory and everything is
+// returned as environment variables
+func renderModuleConfig(store *moduleConfigStore, self node.Node, labels []string, moduleName string,
+	moduleDir string) []string {
+	values, secrets := store.Resolve(moduleName, self, labels)
+	env := make([]string, 0, len(values))
+	public := make(map[string]string)
+	for key, value := range values {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+		if !secrets[key] {
+			public[key] = value
+		}
+	}
+	data, err := json.MarshalIndent(public, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(moduleDir, moduleConfigFile), data, 0600)
+	}
+	if err != nil {
+		log.Printf("Unable to write config for %s: %v", moduleName, err)
+	}
+	return env
+}
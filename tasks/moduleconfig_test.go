@@ -0,0 +1,110 @@
+package tasks
+
+import (
+	"path/filepath"
+	"strings"
+	"swarmd/node"
+	"swarmd/packets"
+	"testing"
+)
+
+func newTestModuleConfig(t *testing.T, key [32]byte) *moduleConfigStore {
+	return &moduleConfigStore{
+		path:     filepath.Join(t.TempDir(), "moduleconfig.json"),
+		key:      key,
+		settings: make(map[string]moduleSetting),
+	}
+}
+
+func TestModuleConfigResolvePrecedence(t *testing.T) {
+	store := newTestModuleConfig(t, [32]byte{1})
+	self := node.Node{Address: "10.0.0.1", Port: 51234}
+	for _, setting := range []moduleSetting{
+		{Module: "web", Key: "GLOBAL", Value: "global", Revision: 1},
+		{Module: "web", Key: "LABEL", Value: "global", Revision: 9},
+		{Module: "web", Scope: "label:edge", Key: "LABEL", Value: "edge", Revision: 1},
+		{Module: "web", Scope: "label:core", Key: "LABEL", Value: "core", Revision: 9},
+		{Module: "web", Scope: "label:edge", Key: "NODE", Value: "edge", Revision: 9},
+		{Module: "web", Scope: "node:10.0.0.1", Key: "NODE", Value: "host", Revision: 1},
+		{Module: "web", Scope: "node:10.0.0.12", Key: "OTHER", Value: "other", Revision: 1},
+		{Module: "web", Key: "SAME", Value: "old", Revision: 1},
+		{Module: "web", Scope: "node:10.0.0.1", Key: "SAME", Value: "host", Revision: 2},
+		{Module: "web", Scope: "node:10.0.0.1:51234", Key: "SAME", Value: "port", Revision: 3},
+		{Module: "web", Key: "GONE", Value: "old", Revision: 1},
+		{Module: "web", Scope: "node:10.0.0.1", Key: "GONE", Flags: packets.ModuleConfigDeleted, Revision: 2},
+		{Module: "db", Key: "GLOBAL", Value: "db", Revision: 5},
+	} {
+		store.Update(setting)
+	}
+
+	values, secrets := store.Resolve("web", self, []string{"edge"})
+	expected := map[string]string{"GLOBAL": "global", "LABEL": "edge", "NODE": "host", "SAME": "port", "GONE": "old"}
+	if len(values) != len(expected) {
+		t.Errorf("expected %d settings, got %v", len(expected), values)
+	}
+	for key, value := range expected {
+		if values[key] != value {
+			t.Errorf("expected %s=%s, got %q", key, value, values[key])
+		}
+	}
+	if len(secrets) != 0 {
+		t.Errorf("expected no secrets, got %v", secrets)
+	}
+
+	// A newer value at a less specific scope doesn't override a more specific one
+	store.Update(moduleSetting{Module: "web", Key: "NODE", Value: "global", Revision: 10})
+	if values, _ := store.Resolve("web", self, nil); values["NODE"] != "host" || values["LABEL"] != "global" {
+		t.Errorf("unexpected settings without labels: %v", values)
+	}
+}
+
+func TestModuleConfigSecrets(t *testing.T) {
+	key := [32]byte{2}
+	sender := newTestModuleConfig(t, key)
+	sealed, err := sender.Seal("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, "hunter2") {
+		t.Fatal("expected the secret to be sealed")
+	}
+	setting := moduleSetting{Module: "web", Scope: "node:10.0.0.1", Key: "PASSWORD", Value: sealed,
+		Flags: packets.ModuleConfigSecret, Revision: 1}
+	sender.Update(setting)
+
+	// What is shared with peers carries the sealed value only
+	for _, shared := range sender.All() {
+		pkt := new(packets.ModuleConfigHeader)
+		if !pkt.Deserialize(shared.ToPacket().Serialize()) {
+			t.Fatal("unable to deserialize the setting")
+		}
+		if strings.Contains(pkt.Value, "hunter2") || pkt.Value != sealed {
+			t.Errorf("expected the packet to carry the sealed value, got %q", pkt.Value)
+		}
+	}
+
+	// Nodes pass it on as they got it, and only the one it targets opens it
+	target := newTestModuleConfig(t, key)
+	bystander := newTestModuleConfig(t, key)
+	received := moduleSettingFromPacket(setting.ToPacket())
+	if !target.Update(received) || !bystander.Update(received) {
+		t.Fatal("expected the setting to be taken")
+	}
+	if stored, _ := bystander.Get("web", "node:10.0.0.1", "PASSWORD"); stored.Value != sealed {
+		t.Errorf("expected the value to be stored sealed, got %q", stored.Value)
+	}
+	values, secrets := target.Resolve("web", node.Node{Address: "10.0.0.1", Port: 1}, nil)
+	if values["PASSWORD"] != "hunter2" || !secrets["PASSWORD"] {
+		t.Errorf("expected the secret to be revealed on its node, got %v %v", values, secrets)
+	}
+	if values, _ := bystander.Resolve("web", node.Node{Address: "10.0.0.2", Port: 1}, nil); len(values) != 0 {
+		t.Errorf("expected nothing on another node, got %v", values)
+	}
+
+	// A node with a different swarm key can't open it
+	stranger := newTestModuleConfig(t, [32]byte{3})
+	stranger.Update(received)
+	if values, _ := stranger.Resolve("web", node.Node{Address: "10.0.0.1", Port: 1}, nil); values["PASSWORD"] != "" {
+		t.Errorf("expected the secret not to open with another key, got %q", values["PASSWORD"])
+	}
+}
@@ -0,0 +1,129 @@
+package tasks
+
+import (
+	"swarmd/packets"
+	"swarmd/node"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// How long an install or upgrade waits for its archive to arrive before giving up
+const moduleFetchTimeout = 5 * time.Minute
+
+// How long to wait for other nodes to say which archive they have for a module
+const archiveLookupWait = 3 * time.Second
+
+// Outcome statuses
+const (
+	outcomeFetching = "fetching"
+	outcomeDone     = "done"
+	outcomeFailed   = "failed"
+	// The module has no hooks for this node's platform
+	outcomeUnsupported = "unsupported"
+)
+
+// What happened the last time a module was installed or upgraded on this node, so the console can report it
+type moduleOutcome struct {
+	Module   string
+	Command  string
+	Status   string
+	Detail   string
+	Revision uint64
+	Updated  time.Time
+}
+
+var moduleOutcomes sync.Map
+
+func recordOutcome(config *commonStruct, moduleName string, command string, status string, detail string) {
+	module, _ := config.DesiredState.Get(moduleName)
+	moduleOutcomes.Store(moduleName, moduleOutcome{
+		Module:   moduleName,
+		Command:  command,
+		Status:   status,
+		Detail:   detail,
+		Revision: module.Revision,
+		Updated:  time.Now(),
+	})
+}
+
+// Finds the archive for a module, fetching it through the swarm if it isn't in share yet. The version is the hash
+// of the archive to use, or empty to use whichever archive the swarm has under the module's name.
+func fetchModuleArchive(config *commonStruct, self node.Node, moduleName string, version string,
+	command string) ([packets.HashSize]uint8, error) {
+	var fileHash [packets.HashSize]uint8
+	if version != "" {
+		decoded, err := hex.DecodeString(version)
+		if err != nil || len(decoded) != packets.HashSize {
+			return fileHash, fmt.Errorf("invalid version %s", version)
+		}
+		copy(fileHash[:], decoded)
+	} else if localHash, ok := LookupShareFile(fmt.Sprintf("%s.swm", moduleName)); ok {
+		return localHash, nil
+	} else {
+		var err error
+		if fileHash, err = lookupModuleArchive(config, self, moduleName); err != nil {
+			return fileHash, err
+		}
+	}
+	if blobExists(fileHash) {
+		return fileHash, nil
+	}
+
+	log.Printf("Fetching %s.swm (%s) for %s", moduleName, hex.EncodeToString(fileHash[:]), command)
+	recordOutcome(config, moduleName, command, outcomeFetching, hex.EncodeToString(fileHash[:]))
+	timeout := time.After(moduleFetchTimeout)
+	select {
+	case config.Fetch <- fileHash:
+	case <-timeout:
+		return fileHash, errors.New("timed out waiting to start the download")
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for !blobExists(fileHash) {
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			return fileHash, fmt.Errorf("timed out after %s waiting for %s.swm", moduleFetchTimeout, moduleName)
+		}
+	}
+	return fileHash, nil
+}
+
+// Asks the swarm which archive it has for a module, going with the one most nodes report
+func lookupModuleArchive(config *commonStruct, self node.Node, moduleName string) ([packets.HashSize]uint8, error) {
+	var fileHash [packets.HashSize]uint8
+	votes := make(map[string]int)
+	best := ""
+	for _, response := range askSwarm(config, self, fmt.Sprintf("archive %s", moduleName), archiveLookupWait) {
+		var answer struct {
+			Hash string
+		}
+		if err := json.Unmarshal([]byte(response.Response), &answer); err != nil || answer.Hash == "" {
+			continue
+		}
+		votes[answer.Hash] += 1
+		if votes[answer.Hash] > votes[best] {
+			best = answer.Hash
+		}
+	}
+	if best == "" {
+		return fileHash, fmt.Errorf("no node has %s.swm", moduleName)
+	}
+	decoded, err := hex.DecodeString(best)
+	if err != nil || len(decoded) != packets.HashSize {
+		return fileHash, fmt.Errorf("invalid archive hash for %s.swm", moduleName)
+	}
+	copy(fileHash[:], decoded)
+	return fileHash, nil
+}
+
+func blobExists(fileHash [packets.HashSize]uint8) bool {
+	_, err := os.Stat(GetBlobPath(fileHash))
+	return err == nil
+}
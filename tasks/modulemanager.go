@@ -5,12 +5,19 @@ import (
 	"path/filepath"
 	"swarmd/util"
 	"os"
-	"strings"
 	"fmt"
-	"os/exec"
-	"runtime"
+	"swarmd/node"
+	"swarmd/packets"
+	"time"
+	"math/rand"
+	"sync"
+	"io/ioutil"
+	"encoding/hex"
+	"swarmd/authentication"
 )
 
+var moduleLocks = new(sync.Map)
+
 func GetModulePath() string {
 	modulePath := filepath.Join(util.GetBasePath(), "modules/")
 
@@ -20,30 +27,177 @@ func GetModulePath() string {
 	return modulePath
 }
 
-func UnpackModule(archive string) {
-	moduleName := strings.TrimSuffix(filepath.Base(archive), filepath.Ext(archive))
+// Extracts a module archive into the module directory. The archive is unpacked into a scratch directory first so a
+// module that fails verification never appears in the module directory.
+func UnpackModule(archive string, moduleName string, limits util.ExtractLimits) error {
 	modulePath := filepath.Join(GetModulePath(), moduleName)
+	tempPath := filepath.Join(GetModulePath(), fmt.Sprintf(".%s.unpack", moduleName))
 
-	_, err := util.Unzip(archive, modulePath)
+	os.RemoveAll(tempPath)
+	_, err := util.Unzip(archive, tempPath, moduleName, limits.WithinFreeSpace(GetModulePath()), verifyPublisher)
 	if err != nil {
-		log.Print(archive)
-		log.Print(err)
+		os.RemoveAll(tempPath)
+		return err
+	}
+	return os.Rename(tempPath, modulePath)
+}
+
+func GetTrustStorePath() string {
+	return filepath.Join(util.GetBasePath(), "trusted_publishers")
+}
+
+// Only accepts manifests signed by a publisher listed in the trust store
+func verifyPublisher(manifest []byte, signature []byte) error {
+	trusted, err := authentication.LoadTrustStore(GetTrustStorePath())
+	if err != nil {
+		return err
+	}
+	return authentication.VerifyManifest(manifest, signature, trusted)
+}
+
+// Checks that files in an installed module still match its signed manifest, so nothing is run if the module
+// directory has been tampered with since it was unpacked
+func verifyInstalledFiles(moduleDir string, files ...string) error {
+	manifestData, err := ioutil.ReadFile(filepath.Join(moduleDir, util.ModuleManifestFile))
+	if err != nil {
+		return err
+	}
+	signature, err := ioutil.ReadFile(filepath.Join(moduleDir, util.ModuleSignatureFile))
+	if err != nil {
+		signature = nil
+	}
+	if err := verifyPublisher(manifestData, signature); err != nil {
+		return err
+	}
+	manifest, err := util.ParseManifest(manifestData, filepath.Base(moduleDir))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		relPath, err := filepath.Rel(moduleDir, file)
+		if err != nil {
+			return err
+		}
+		expected, listed := manifest.Files[filepath.ToSlash(relPath)]
+		if !listed {
+			if _, err := os.Stat(file); os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("%s is not listed in the manifest", relPath)
+		}
+		checksum, err := util.HashFile(file)
+		if err != nil {
+			return err
+		}
+		if checksum != expected {
+			return fmt.Errorf("%s has been modified", relPath)
+		}
 	}
+	return nil
 }
 
-func ModuleManager(config *commonStruct) {
+func ModuleManager(config *commonStruct, self node.Node) {
+	reconcileAfter := time.After(0 * time.Second)
+	syncAfter := time.After(30 * time.Second)
 	for !*config.KillFlag {
 		select {
 		case command := <-config.ModuleControl:
 			log.Printf("Received command for %s: %s", command.ModuleName, command.Command)
-			go handleCommand(command)
+			if command.Command == "reconcile" {
+				go reconcileModule(config, self, command.ModuleName)
+			} else {
+				go handleCommand(config, self, command)
+			}
+		case <-reconcileAfter:
+			// Periodically drive every module toward its desired state in case a command was missed or failed
+			for _, module := range config.DesiredState.All() {
+				go reconcileModule(config, self, module.Name)
+			}
+			reconcileAfter = time.After(300 * time.Second)
+		case <-syncAfter:
+			// Share the desired state and module config with a random peer so that nodes which missed an update
+			// catch up
+			shareDesiredState(config)
+			syncAfter = time.After(60 * time.Second)
 		}
 	}
 }
 
+func shareDesiredState(config *commonStruct) {
+	peers := make([]node.Node, 0)
+	config.PeerMap.Range(func(key, value interface{}) bool {
+		peers = append(peers, key.(node.Node))
+		return true
+	})
+	if len(peers) == 0 {
+		return
+	}
+	peer := peers[rand.Intn(len(peers))]
+	for _, module := range config.DesiredState.All() {
+		config.Output <- packets.PeerPacket{Packet: module.ToPacket(), Source: peer}
+	}
+	for _, setting := range config.ModuleConfig.All() {
+		config.Output <- packets.PeerPacket{Packet: setting.ToPacket(), Source: peer}
+	}
+}
+
+// Ensures that only one command runs against a module at a time
+func lockModule(moduleName string) func() {
+	lock, _ := moduleLocks.LoadOrStore(moduleName, new(sync.Mutex))
+	lock.(*sync.Mutex).Lock()
+	return lock.(*sync.Mutex).Unlock
+}
+
+func reconcileModule(config *commonStruct, self node.Node, moduleName string) {
+	defer lockModule(moduleName)()
+	module, ok := config.DesiredState.Get(moduleName)
+	if !ok {
+		return
+	}
+	desired := module.State
+	if !module.TargetsNode(self) {
+		desired = packets.ModuleStateAbsent
+	}
+	// Replace the module if the wrong version is installed
+	if desired != packets.ModuleStateAbsent && moduleInstalled(moduleName) && module.Version != "" &&
+		installedVersion(moduleName) != module.Version {
+		fileHash, err := fetchModuleArchive(config, self, moduleName, module.Version, "upgrade")
+		if err != nil {
+			log.Printf("Unable to upgrade %s to version %s: %v", moduleName, module.Version, err)
+			recordOutcome(config, moduleName, "upgrade", outcomeFailed, err.Error())
+			return
+		}
+		// Keep the installed version rather than removing it for one that can't run here
+		if supported, err := archiveSupportsPlatform(GetBlobPath(fileHash)); err != nil || !supported {
+			log.Printf("Not upgrading %s: version %s has no install hook for %s", moduleName, module.Version,
+				nodePlatform())
+			recordOutcome(config, moduleName, "upgrade", outcomeUnsupported,
+				fmt.Sprintf("no install hook for %s", nodePlatform()))
+			return
+		}
+		log.Printf("Upgrading %s to version %s", moduleName, module.Version)
+		if moduleStarted(moduleName) {
+			executeCommand(config, self, moduleCommand{ModuleName: moduleName, Command: "stop"})
+		}
+		executeCommand(config, self, moduleCommand{ModuleName: moduleName, Command: "uninstall"})
+	}
+	if desired != packets.ModuleStateAbsent && !moduleInstalled(moduleName) {
+		executeCommand(config, self, moduleCommand{ModuleName: moduleName, Command: "install"})
+	}
+	if desired == packets.ModuleStateRunning && moduleInstalled(moduleName) && !moduleStarted(moduleName) {
+		executeCommand(config, self, moduleCommand{ModuleName: moduleName, Command: "start"})
+	}
+	if desired != packets.ModuleStateRunning && moduleStarted(moduleName) {
+		executeCommand(config, self, moduleCommand{ModuleName: moduleName, Command: "stop"})
+	}
+	if desired == packets.ModuleStateAbsent && moduleInstalled(moduleName) {
+		executeCommand(config, self, moduleCommand{ModuleName: moduleName, Command: "uninstall"})
+	}
+}
+
 func moduleDataExists(moduleName string) bool {
-	_, err := os.Stat(filepath.Join(GetSharePath(), fmt.Sprintf("%s.swm", moduleName)))
-	return err == nil
+	_, ok := LookupShareFile(fmt.Sprintf("%s.swm", moduleName))
+	return ok
 }
 
 func moduleInstalled(moduleName string) bool {
@@ -56,29 +210,92 @@ func moduleStarted(moduleName string) bool {
 	return err == nil
 }
 
-func handleCommand(cmd moduleCommand) {
+func installedVersion(moduleName string) string {
+	version, err := ioutil.ReadFile(filepath.Join(GetModulePath(), moduleName, ".SWARMD_VERSION"))
+	if err != nil {
+		return ""
+	}
+	return string(version)
+}
+
+// Finds the archives that have to stay in share: the version each module meant for this node should be at, and the
+// version of each module that is installed
+func pinnedShareFiles(config *commonStruct, self node.Node) map[string]bool {
+	pinned := make(map[string]bool)
+	for _, module := range config.DesiredState.All() {
+		if module.State == packets.ModuleStateAbsent || !module.TargetsNode(self) {
+			continue
+		}
+		if module.Version != "" {
+			pinned[module.Version] = true
+		} else if fileHash, ok := LookupShareFile(fmt.Sprintf("%s.swm", module.Name)); ok {
+			pinned[hex.EncodeToString(fileHash[:])] = true
+		}
+	}
+	entries, _ := ioutil.ReadDir(GetModulePath())
+	for _, entry := range entries {
+		if version := installedVersion(entry.Name()); entry.IsDir() && version != "" {
+			pinned[version] = true
+		}
+	}
+	return pinned
+}
+
+func handleCommand(config *commonStruct, self node.Node, cmd moduleCommand) {
+	defer lockModule(cmd.ModuleName)()
+	executeCommand(config, self, cmd)
+}
+
+func executeCommand(config *commonStruct, self node.Node, cmd moduleCommand) {
 	moduleDir := filepath.Join(GetModulePath(), cmd.ModuleName)
+	runScript := func(hook string, workingDir string) error {
+		settings := renderModuleConfig(config.ModuleConfig, self, config.Labels, cmd.ModuleName, workingDir)
+		return runHook(hook, workingDir, settings, config.Sandbox)
+	}
 	switch cmd.Command {
 	case "install":
-		if !moduleDataExists(cmd.ModuleName) {
-			log.Printf("Skipping installation: %s.swm not found in share", cmd.ModuleName)
-			break
-		}
 		if moduleInstalled(cmd.ModuleName) {
 			log.Printf("Skiping installation: %s already installed", cmd.ModuleName)
 			break
 		}
-		UnpackModule(filepath.Join(GetSharePath(), fmt.Sprintf("%s.swm", cmd.ModuleName)))
-		installScript := filepath.Join(moduleDir, "install")
-		runScript(installScript, moduleDir)
+		// The install can outrun the archive, in which case it is fetched now
+		module, _ := config.DesiredState.Get(cmd.ModuleName)
+		fileHash, err := fetchModuleArchive(config, self, cmd.ModuleName, module.Version, "install")
+		if err != nil {
+			log.Printf("Skipping installation of %s: %v", cmd.ModuleName, err)
+			recordOutcome(config, cmd.ModuleName, "install", outcomeFailed, err.Error())
+			break
+		}
+		if supported, err := archiveSupportsPlatform(GetBlobPath(fileHash)); err != nil || !supported {
+			log.Printf("Skipping installation: %s has no install hook for %s", cmd.ModuleName, nodePlatform())
+			recordOutcome(config, cmd.ModuleName, "install", outcomeUnsupported,
+				fmt.Sprintf("no install hook for %s", nodePlatform()))
+			break
+		}
+		if err := UnpackModule(GetBlobPath(fileHash), cmd.ModuleName, config.Extract); err != nil {
+			log.Printf("Skipping installation: unable to unpack %s: %v", cmd.ModuleName, err)
+			recordOutcome(config, cmd.ModuleName, "install", outcomeFailed, fmt.Sprintf("unable to unpack: %v", err))
+			break
+		}
+		// Record which archive the module came from so reconciliation can detect upgrades
+		ioutil.WriteFile(filepath.Join(moduleDir, ".SWARMD_VERSION"), []byte(hex.EncodeToString(fileHash[:])), 0600)
+		if err := runScript("install", moduleDir); err != nil {
+			// Left uninstalled so that reconciliation tries again
+			log.Printf("Installation of %s failed: %v", cmd.ModuleName, err)
+			os.RemoveAll(moduleDir)
+			removeSandbox(cmd.ModuleName)
+			recordOutcome(config, cmd.ModuleName, "install", outcomeFailed, err.Error())
+			break
+		}
+		recordOutcome(config, cmd.ModuleName, "install", outcomeDone, hex.EncodeToString(fileHash[:]))
 	case "uninstall":
 		if !moduleInstalled(cmd.ModuleName) {
 			log.Printf("Skipping uninstallation: %s not installed", cmd.ModuleName)
 			break
 		}
-		uninstallScript := filepath.Join(moduleDir, "uninstall")
-		runScript(uninstallScript, moduleDir)
+		runScript("uninstall", moduleDir)
 		os.RemoveAll(moduleDir)
+		removeSandbox(cmd.ModuleName)
 	case "start":
 		if !moduleInstalled(cmd.ModuleName) {
 			log.Printf("Skipping activation: %s not installed", cmd.ModuleName)
@@ -88,8 +305,7 @@ func handleCommand(cmd moduleCommand) {
 			log.Printf("Skipping activation: %s already active", cmd.ModuleName)
 			break
 		}
-		startScript := filepath.Join(moduleDir, "start")
-		runScript(startScript, moduleDir)
+		runScript("start", moduleDir)
 		f, err := os.Create(filepath.Join(moduleDir, ".SWARMD_ACTIVE"))
 		if err != nil {
 			log.Print(err)
@@ -104,36 +320,74 @@ func handleCommand(cmd moduleCommand) {
 			log.Printf("Skipping deactivation: %s not active", cmd.ModuleName)
 			break
 		}
-		stopScript := filepath.Join(moduleDir, "stop")
-		runScript(stopScript, moduleDir)
+		runScript("stop", moduleDir)
 		os.Remove(filepath.Join(moduleDir, ".SWARMD_ACTIVE"))
 	case "delete":
 		if !moduleDataExists(cmd.ModuleName) {
 			log.Printf("Skipping cleanup: %s.swm not found in share", cmd.ModuleName)
 			break
 		}
-		os.Remove(filepath.Join(GetSharePath(), fmt.Sprintf("%s.swm", cmd.ModuleName)))
+		fileHash, found := LookupShareFile(fmt.Sprintf("%s.swm", cmd.ModuleName))
+		RemoveShareFile(fmt.Sprintf("%s.swm", cmd.ModuleName))
+		// Leave a tombstone so that anti-entropy doesn't bring the archive back
+		if found && !blobExists(fileHash) {
+			config.Replication.Delete(fileHash)
+		}
 	default:
 		log.Printf("Recieved unknown command: %s", cmd.Command)
 	}
 }
 
-func runScript(script string, workingDir string) {
-	var cmd *exec.Cmd
-	if runtime.GOOS == "windows" {
-		cmd = exec.Command("powershell", strings.Join([]string{script, "ps1"}, "."))
-	} else {
-		cmd = exec.Command("bash", strings.Join([]string{script, "sh"}, "."))
+// Modules installed before archives had manifests can't be verified, but are still allowed to stop and uninstall so
+// they can be replaced. Each of those runs once, as they clear the active flag and the module directory.
+func unsignedInstall(moduleDir string, hook string) bool {
+	if hook != "stop" && hook != "uninstall" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(moduleDir, util.ModuleManifestFile))
+	return os.IsNotExist(err)
+}
+
+// Runs one of a module's hooks, picking the one for this node's platform. Modules don't need to provide every hook,
+// a missing one is skipped. Returns an error if the hook couldn't be run or exited with one.
+func runHook(hook string, workingDir string, settings []string, policy SandboxPolicy) error {
+	moduleName := filepath.Base(workingDir)
+	scriptFile := resolveHook(workingDir, hook)
+	if scriptFile == "" {
+		log.Printf("Skipping %s hook for %s: none provided for %s", hook, moduleName, nodePlatform())
+		return nil
+	}
+	if err := verifyInstalledFiles(workingDir, scriptFile, filepath.Join(workingDir, moduleMetadataFile)); err != nil {
+		if !unsignedInstall(workingDir, hook) {
+			log.Printf("Refusing to run hook for %s: %v", moduleName, err)
+			return fmt.Errorf("refusing to run %s hook: %v", hook, err)
+		}
+		log.Printf("Running %s hook for %s unverified, it was installed before modules were signed", hook, moduleName)
+	}
+	metadata, err := loadModuleMetadata(workingDir)
+	if err != nil {
+		log.Printf("Refusing to run hook for %s: %v", moduleName, err)
+		return fmt.Errorf("refusing to run %s hook: %v", hook, err)
 	}
+	sandbox := policy.apply(metadata.Sandbox)
+	cmd := hookCommand(scriptFile)
 	cmd.Dir = workingDir
 	port, present := os.LookupEnv("SWARMD_LOCAL_PORT")
 	if !present {
 		port = "51234"
 	}
-	cmd.Env = append(os.Environ(), fmt.Sprintf("SWARMD_LOCAL_PORT=%s", port))
+	cmd.Env = append(moduleEnvironment(sandbox, port), settings...)
+	cleanup, err := applySandbox(cmd, moduleName, workingDir, sandbox)
+	defer cleanup()
+	if err != nil {
+		logSandboxError(moduleName, err)
+		return fmt.Errorf("unable to apply sandbox: %v", err)
+	}
 	output, err := cmd.Output()
+	log.Print(string(output))
 	if err != nil {
 		log.Print(err)
+		return fmt.Errorf("%s hook failed: %v", hook, err)
 	}
-	log.Print(string(output))
+	return nil
 }
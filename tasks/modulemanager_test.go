@@ -0,0 +1,77 @@
+package tasks
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"swarmd/node"
+	"swarmd/util"
+	"testing"
+)
+
+// Points the base path at a directory of its own for the test
+func useTestBasePath(t *testing.T) {
+	t.Setenv("SWARMD_DEBUG", "true")
+	t.Setenv("SWARMD_LOCAL_PORT", fmt.Sprintf("test-%d", os.Getpid()))
+	t.Cleanup(func() {
+		os.RemoveAll(util.GetBasePath())
+	})
+}
+
+// Signs a module with a trusted key and puts it in share
+func shareTestModule(t *testing.T, key ed25519.PrivateKey, moduleName string, installHook string) {
+	t.Helper()
+	hookPath := filepath.Join(t.TempDir(), "install.sh")
+	if err := ioutil.WriteFile(hookPath, []byte(installHook), 0755); err != nil {
+		t.Fatal(err)
+	}
+	entries := []util.ModuleEntry{{Name: "install.sh", Path: hookPath, Mode: 0755}}
+	archive := filepath.Join(GetSharePath(), moduleName+".swm")
+	if err := util.ZipModule(archive, moduleName, entries, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportShareFile(moduleName + ".swm"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInstallOutcome(t *testing.T) {
+	useTestBasePath(t)
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := base64.StdEncoding.EncodeToString(public) + "\n"
+	if err := ioutil.WriteFile(GetTrustStorePath(), []byte(trusted), 0600); err != nil {
+		t.Fatal(err)
+	}
+	shareTestModule(t, key, "working", "exit 0\n")
+	shareTestModule(t, key, "broken", "echo failing >&2\nexit 3\n")
+
+	config := &commonStruct{
+		DesiredState: &desiredStateStore{path: GetDesiredStatePath(), modules: make(map[string]desiredModule)},
+		ModuleConfig: newTestModuleConfig(t, [32]byte{1}),
+		Extract:      util.DefaultExtractLimits,
+	}
+	self := node.Node{Address: "10.0.0.1", Port: 51234}
+	for _, moduleName := range []string{"working", "broken"} {
+		executeCommand(config, self, moduleCommand{ModuleName: moduleName, Command: "install"})
+	}
+
+	outcome, _ := moduleOutcomes.Load("working")
+	if status := outcome.(moduleOutcome).Status; status != outcomeDone || !moduleInstalled("working") {
+		t.Errorf("expected a working install hook to succeed, got %s", status)
+	}
+	outcome, _ = moduleOutcomes.Load("broken")
+	if outcome.(moduleOutcome).Status != outcomeFailed || !strings.Contains(outcome.(moduleOutcome).Detail, "exit status 3") {
+		t.Errorf("expected a failing install hook to fail the install, got %+v", outcome)
+	}
+	if moduleInstalled("broken") {
+		t.Error("expected a failed install to be left uninstalled so it is tried again")
+	}
+}
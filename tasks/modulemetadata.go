@@ -0,0 +1,111 @@
+package tasks
+
+import (
+	"path/filepath"
+	"io/ioutil"
+	"encoding/json"
+	"log"
+	"os"
+	"fmt"
+	"swarmd/util"
+)
+
+// Optional file at the root of a module archive describing how the module should be run
+const moduleMetadataFile = "module.json"
+
+type moduleSandbox struct {
+	// Unprivileged user the hooks run as. Requires the daemon to run as root, and implies PrivateMounts.
+	User string
+	// Resource limits applied through cgroups v2 on Linux. Zero values mean unlimited.
+	CPU    float64
+	Memory string
+	Pids   int
+	// Run the hooks in their own mount and/or network namespace on Linux
+	PrivateMounts  bool
+	PrivateNetwork bool
+	// Pass the daemon's full environment to the hooks instead of a minimal one
+	InheritEnvironment bool
+}
+
+type moduleMetadata struct {
+	Sandbox moduleSandbox
+}
+
+func loadModuleMetadata(moduleDir string) (moduleMetadata, error) {
+	metadata := moduleMetadata{}
+	file, err := ioutil.ReadFile(filepath.Join(moduleDir, moduleMetadataFile))
+	if os.IsNotExist(err) {
+		return metadata, nil
+	} else if err != nil {
+		return metadata, err
+	}
+	if err := json.Unmarshal(file, &metadata); err != nil {
+		return metadata, fmt.Errorf("invalid %s: %v", moduleMetadataFile, err)
+	}
+	return metadata, nil
+}
+
+// The least sandboxing a node gives every module, whatever its module.json asks for. A module can ask for more but
+// never less, as a hostile module would simply leave its own settings out.
+type SandboxPolicy struct {
+	// User hooks run as when a module doesn't name one
+	User string
+	// Most a module may use. Modules asking for more, or for no limit, get these. Zero values mean no cap.
+	CPU    float64
+	Memory string
+	Pids   int
+	// Always run hooks with private mounts and/or network
+	PrivateMounts  bool
+	PrivateNetwork bool
+	// Never pass the daemon's environment through to hooks
+	DenyInheritEnvironment bool
+}
+
+// Raises a module's sandbox to the node's minimum
+func (p SandboxPolicy) apply(s moduleSandbox) moduleSandbox {
+	if s.User == "" {
+		s.User = p.User
+	}
+	if p.CPU > 0 && (s.CPU <= 0 || s.CPU > p.CPU) {
+		s.CPU = p.CPU
+	}
+	if p.Memory != "" {
+		capped, err := util.ParseSize(p.Memory)
+		requested, requestErr := util.ParseSize(s.Memory)
+		if err == nil && (s.Memory == "" || requestErr != nil || requested > capped) {
+			s.Memory = p.Memory
+		}
+	}
+	if p.Pids > 0 && (s.Pids <= 0 || s.Pids > p.Pids) {
+		s.Pids = p.Pids
+	}
+	s.PrivateMounts = s.PrivateMounts || p.PrivateMounts
+	s.PrivateNetwork = s.PrivateNetwork || p.PrivateNetwork
+	s.InheritEnvironment = s.InheritEnvironment && !p.DenyInheritEnvironment
+	return s
+}
+
+func (s moduleSandbox) hasLimits() bool {
+	return s.CPU > 0 || s.Memory != "" || s.Pids > 0
+}
+
+// Builds the environment for a hook. Unless the module asks otherwise only a handful of harmless variables are
+// passed through, so nothing the daemon was started with leaks into module scripts.
+func moduleEnvironment(sandbox moduleSandbox, port string) []string {
+	env := make([]string, 0)
+	if sandbox.InheritEnvironment {
+		env = append(env, os.Environ()...)
+	} else {
+		for _, key := range []string{"PATH", "LANG", "TZ", "HOME", "SYSTEMROOT", "TEMP", "TMP"} {
+			if value, present := os.LookupEnv(key); present {
+				env = append(env, fmt.Sprintf("%s=%s", key, value))
+			}
+		}
+	}
+	env = append(env, fmt.Sprintf("SWARMD_LOCAL_PORT=%s", port))
+	return env
+}
+
+func logSandboxError(moduleName string, err error) {
+	log.Printf("Refusing to run hook for %s: unable to apply sandbox: %v", moduleName, err)
+}
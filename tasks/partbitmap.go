@@ -0,0 +1,74 @@
+package tasks
+
+// Tracks which parts of a file are present, one bit per part
+type partBitmap struct {
+	bits  []uint8
+	size  uint64
+	count uint64
+}
+
+func newPartBitmap(size uint64) *partBitmap {
+	return &partBitmap{
+		bits: make([]uint8, (size+7)/8),
+		size: size,
+	}
+}
+
+func (b *partBitmap) Has(part uint64) bool {
+	return part < b.size && b.bits[part/8]&(1<<(part%8)) != 0
+}
+
+func (b *partBitmap) Set(part uint64) {
+	if part < b.size && !b.Has(part) {
+		b.bits[part/8] |= 1 << (part % 8)
+		b.count += 1
+	}
+}
+
+func (b *partBitmap) Len() uint64 {
+	return b.size
+}
+
+func (b *partBitmap) Count() uint64 {
+	return b.count
+}
+
+func (b *partBitmap) Missing() uint64 {
+	return b.size - b.count
+}
+
+func (b *partBitmap) Complete() bool {
+	return b.count == b.size
+}
+
+// Finds the first missing part after the given one, wrapping around to the start of the file
+func (b *partBitmap) NextMissing(after uint64) (uint64, bool) {
+	if b.Complete() {
+		return 0, false
+	}
+	for i := uint64(1); i <= b.size; i++ {
+		part := (after + i) % b.size
+		// Skip over whole bytes that are already full
+		if part%8 == 0 && part+8 <= b.size && b.bits[part/8] == 0xFF {
+			i += 7
+			continue
+		}
+		if !b.Has(part) {
+			return part, true
+		}
+	}
+	return 0, false
+}
+
+// Returns up to maxBytes of the bitmap starting at firstPart, which must be a multiple of 8
+func (b *partBitmap) Bytes(firstPart uint64, maxBytes int) []uint8 {
+	start := firstPart / 8
+	if start >= uint64(len(b.bits)) {
+		return nil
+	}
+	end := start + uint64(maxBytes)
+	if end > uint64(len(b.bits)) {
+		end = uint64(len(b.bits))
+	}
+	return b.bits[start:end]
+}
@@ -6,10 +6,61 @@ import (
 	"time"
 	"log"
 	"math/rand"
+	"sync"
 )
 
 const minPeers = 2
 
+// When a peer was last heard from and how long its last ping took, kept for reporting
+type peerActivity struct {
+	LastSeen time.Time
+	RTT      time.Duration
+	pingSent time.Time
+}
+
+var peerActivityLock sync.Mutex
+var peerActivityMap = make(map[node.Node]*peerActivity)
+
+func activityFor(peer node.Node) *peerActivity {
+	activity, ok := peerActivityMap[peer]
+	if !ok {
+		activity = new(peerActivity)
+		peerActivityMap[peer] = activity
+	}
+	return activity
+}
+
+func markPeerSeen(peer node.Node) {
+	peerActivityLock.Lock()
+	defer peerActivityLock.Unlock()
+	activityFor(peer).LastSeen = time.Now()
+}
+
+func markPingSent(peer node.Node) {
+	peerActivityLock.Lock()
+	defer peerActivityLock.Unlock()
+	activityFor(peer).pingSent = time.Now()
+}
+
+func markPingAcked(peer node.Node) {
+	peerActivityLock.Lock()
+	defer peerActivityLock.Unlock()
+	activity := activityFor(peer)
+	if !activity.pingSent.IsZero() {
+		activity.RTT = time.Since(activity.pingSent)
+		activity.pingSent = time.Time{}
+	}
+}
+
+func getPeerActivity(peer node.Node) peerActivity {
+	peerActivityLock.Lock()
+	defer peerActivityLock.Unlock()
+	if activity, ok := peerActivityMap[peer]; ok {
+		return *activity
+	}
+	return peerActivity{}
+}
+
 func PeerManager(config *commonStruct, bootstrapper *node.Node) {
 	threshold := uint8(minPeers)
 	bootstrapAfter := time.After(0 * time.Second)
@@ -66,6 +117,7 @@ func PeerManager(config *commonStruct, bootstrapper *node.Node) {
 				if pings == 3 {
 					deadPeers = append(deadPeers, peer)
 				} else {
+					markPingSent(peer)
 					config.Output <- packets.PeerPacket{Packet: pkt, Source: peer}
 					config.PeerMap.Store(peer, pings+1)
 				}
@@ -74,6 +126,9 @@ func PeerManager(config *commonStruct, bootstrapper *node.Node) {
 			// Remove dead peers (failed to respond to five pings)
 			for _, peer := range deadPeers {
 				config.PeerMap.Delete(peer)
+				peerActivityLock.Lock()
+				delete(peerActivityMap, peer)
+				peerActivityLock.Unlock()
 			}
 			duration := time.Duration(90 + rand.Int()%60) // 120 +/- 25%
 			pingAfter = time.After(duration * time.Second)
@@ -0,0 +1,195 @@
+package tasks
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"swarmd/node"
+	"swarmd/packets"
+)
+
+// The desired state each module signal sets
+var signalStates = map[string]uint8{
+	"install":   packets.ModuleStateInstalled,
+	"start":     packets.ModuleStateRunning,
+	"stop":      packets.ModuleStateInstalled,
+	"uninstall": packets.ModuleStateAbsent,
+}
+
+// The desired state a signal sets. Installing a module that is meant to be running leaves it running, in the same way
+// that installing an installed module never did anything.
+func signalState(command string, current desiredModule) (uint8, bool) {
+	state, ok := signalStates[command]
+	if ok && command == "install" && current.State == packets.ModuleStateRunning {
+		return packets.ModuleStateRunning, true
+	}
+	return state, ok
+}
+
+// Placeholder for an empty version or target list in a plan query
+const planNone = "-"
+
+// What a node would do if a signal or deployment were carried out, answer to the plan query
+type planReport struct {
+	Module    string
+	Command   string
+	Targeted  bool
+	Installed bool
+	Active    bool
+	Version   string
+	// Steps the node would take in order, empty if nothing would change
+	Actions []string
+	Detail  string `json:",omitempty"`
+}
+
+// The version a signal pins the module to: whatever archive the node receiving it has for the module
+func signalVersion(moduleName string, state uint8) string {
+	if state == packets.ModuleStateAbsent {
+		return ""
+	}
+	if fileHash, ok := LookupShareFile(fmt.Sprintf("%s.swm", moduleName)); ok {
+		return hex.EncodeToString(fileHash[:])
+	}
+	return ""
+}
+
+// Fills in a plan query from the console with the version the signal would pin, so that every node plans against
+// the same version: plan <command> <module> [targets] becomes plan <command> <module> <version> <targets>. Deploy
+// plans already name their archive and policy.
+func completePlanQuery(query string) string {
+	words := strings.Fields(query)
+	if len(words) < 3 || len(words) > 4 || words[1] == "deploy" {
+		return query
+	}
+	version := signalVersion(words[2], signalStates[words[1]])
+	if version == "" {
+		version = planNone
+	}
+	targets := planNone
+	if len(words) == 4 {
+		targets = words[3]
+	}
+	return strings.Join([]string{words[0], words[1], words[2], version, targets}, " ")
+}
+
+// Answers a plan query: plan <command> <module> <version> <targets>, or plan deploy <module> <archive> <policy>
+func answerPlan(config *commonStruct, self node.Node, words []string) (interface{}, error) {
+	if len(words) != 5 {
+		return nil, fmt.Errorf("usage: plan <command> <module> <version> <targets>")
+	}
+	command, moduleName, version, targets := words[1], words[2], words[3], words[4]
+	if version == planNone {
+		version = ""
+	}
+	if targets == planNone {
+		targets = ""
+	}
+	report := planReport{
+		Module:    moduleName,
+		Command:   command,
+		Targeted:  true,
+		Installed: moduleInstalled(moduleName),
+		Active:    moduleStarted(moduleName),
+		Version:   installedVersion(moduleName),
+		Actions:   make([]string, 0),
+	}
+	switch command {
+	case "deploy":
+		return planDeployment(config, self, report, version, targets)
+	case "delete":
+		if moduleDataExists(moduleName) {
+			report.Actions = append(report.Actions, "delete")
+		}
+		return report, nil
+	}
+	current, _ := config.DesiredState.Get(moduleName)
+	state, ok := signalState(command, current)
+	if !ok {
+		return nil, fmt.Errorf("unknown command: %s", command)
+	}
+	module := desiredModule{Name: moduleName, State: state, Version: version, Targets: targets}
+	report.Targeted = module.TargetsNode(self)
+	if !report.Targeted {
+		module.State = packets.ModuleStateAbsent
+	}
+	planReconcile(&report, module)
+	return report, nil
+}
+
+// Works out the steps reconcileModule would take to bring the module to the desired state
+func planReconcile(report *planReport, module desiredModule) {
+	installed, active := report.Installed, report.Active
+	upgrade := module.State != packets.ModuleStateAbsent && installed && module.Version != "" &&
+		report.Version != module.Version
+	if module.State != packets.ModuleStateAbsent && (upgrade || !installed) {
+		archive, available := planArchive(module)
+		if !available {
+			report.Actions = append(report.Actions, "fetch")
+			report.Detail = "platform support is checked once the archive arrives"
+		} else if supported, err := archiveSupportsPlatform(archive); err != nil || !supported {
+			// Nothing is installed, and an upgrade leaves the installed version alone
+			report.Detail = fmt.Sprintf("unsupported: no install hook for %s", nodePlatform())
+			return
+		}
+		if upgrade && active {
+			report.Actions = append(report.Actions, "stop")
+		}
+		if upgrade {
+			report.Actions = append(report.Actions, "uninstall")
+		}
+		report.Actions = append(report.Actions, "install")
+		installed, active = true, false
+	}
+	if module.State == packets.ModuleStateRunning && installed && !active {
+		report.Actions = append(report.Actions, "start")
+	}
+	if module.State != packets.ModuleStateRunning && active {
+		report.Actions = append(report.Actions, "stop")
+	}
+	if module.State == packets.ModuleStateAbsent && installed {
+		report.Actions = append(report.Actions, "uninstall")
+	}
+}
+
+// Finds the archive an install would use, and whether it is already in share
+func planArchive(module desiredModule) (string, bool) {
+	if module.Version == "" {
+		fileHash, ok := LookupShareFile(fmt.Sprintf("%s.swm", module.Name))
+		return GetBlobPath(fileHash), ok
+	}
+	var fileHash [packets.HashSize]uint8
+	decoded, err := hex.DecodeString(module.Version)
+	if err != nil || len(decoded) != packets.HashSize {
+		return "", false
+	}
+	copy(fileHash[:], decoded)
+	return GetBlobPath(fileHash), blobExists(fileHash)
+}
+
+// Works out whether a node would keep a copy of a new archive. Deploying doesn't change what is installed, nodes
+// running the module stay on their version until it is signalled again.
+func planDeployment(config *commonStruct, self node.Node, report planReport, archive string,
+	policyString string) (interface{}, error) {
+	var fileHash [packets.HashSize]uint8
+	decoded, err := hex.DecodeString(archive)
+	if err != nil || len(decoded) != packets.HashSize {
+		return nil, fmt.Errorf("invalid archive %s", archive)
+	}
+	copy(fileHash[:], decoded)
+	if policyString == planNone {
+		policyString = ""
+	}
+	policy, err := parseReplicationPolicy(policyString)
+	if err != nil {
+		return nil, err
+	}
+	report.Targeted = policy.Includes(fileHash, self, config.Labels, knownPeers(config))
+	if blobExists(fileHash) {
+		report.Detail = "already has this archive"
+	} else if report.Targeted {
+		report.Actions = append(report.Actions, "fetch")
+	} else {
+		report.Detail = fmt.Sprintf("fetched on demand, replication is %s", policy)
+	}
+	return report, nil
+}
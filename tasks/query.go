@@ -0,0 +1,314 @@
+package tasks
+
+import (
+	"swarmd/packets"
+	"swarmd/node"
+	"encoding/json"
+	"encoding/hex"
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"sort"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Queries this node has already answered, so a query that comes back around the swarm is only answered once
+var answeredQueries sync.Map
+
+// Queries this node asked itself, mapped to the channel collecting their responses
+var pendingQueries sync.Map
+
+// Reported by the status query, set at build time with -ldflags "-X swarmd/tasks.Version=..."
+var Version = "dev"
+
+var nodeStarted = time.Now()
+
+// Answer to the peers query
+type peerReport struct {
+	Peer        string
+	LastSeen    time.Time
+	RTT         time.Duration
+	MissedPings int
+}
+
+// Answer to the modules query
+type moduleReport struct {
+	Name      string
+	Installed bool
+	Active    bool
+	Version   string
+	Desired   string
+}
+
+// Answer to the transfers query
+type transferReport struct {
+	File      string
+	Name      string
+	Size      uint64
+	Parts     uint64
+	PartsHave uint64
+	Peers     int
+}
+
+// Answer to the status query
+type statusReport struct {
+	Version  string
+	Platform string
+	Uptime   time.Duration
+	Labels   []string
+	Peers    int
+	Modules  int
+	Active   int
+	Share    shareUsage
+}
+
+var desiredStateNames = map[uint8]string{
+	packets.ModuleStateAbsent:    "absent",
+	packets.ModuleStateInstalled: "installed",
+	packets.ModuleStateRunning:   "running",
+}
+
+// Starts a query from the console: __QUERY <id> <query>. The console's address is used as the requester so that
+// every node answers it directly.
+func handleQueryCommand(config *commonStruct, self node.Node, msg string, source node.Node) {
+	words := strings.SplitN(msg, " ", 3)
+	if len(words) != 3 {
+		return
+	}
+	queryID, err := strconv.ParseUint(words[1], 10, 64)
+	if err != nil {
+		return
+	}
+	question := words[2]
+	if strings.HasPrefix(question, "plan ") {
+		question = completePlanQuery(question)
+	}
+	query := new(packets.QueryHeader)
+	query.Initialize(queryID, source, question)
+	HandleQuery(config, self, *query)
+}
+
+func HandleQuery(config *commonStruct, self node.Node, query packets.QueryHeader) {
+	now := time.Now().Unix()
+	if _, ok := answeredQueries.LoadOrStore(query.QueryID, now); ok {
+		return
+	}
+	answeredQueries.Range(func(key, value interface{}) bool {
+		if now-value.(int64) > 60 {
+			answeredQueries.Delete(key)
+		}
+		return true
+	})
+	// Pass the query on before answering, and answer off the main loop since answering can take a while
+	config.Broadcast <- &query
+	go respondToQuery(config, self, query.QueryID, query.Query, query.GetRequester())
+}
+
+// Answers a query from a local tool about this node only, without passing it on: __QUERY_LOCAL <id> <query>
+func handleLocalQueryCommand(config *commonStruct, self node.Node, msg string, source node.Node) {
+	words := strings.SplitN(msg, " ", 3)
+	if len(words) != 3 {
+		return
+	}
+	queryID, err := strconv.ParseUint(words[1], 10, 64)
+	if err != nil {
+		return
+	}
+	question := words[2]
+	if strings.HasPrefix(question, "plan ") {
+		question = completePlanQuery(question)
+	}
+	go respondToQuery(config, self, queryID, question, source)
+}
+
+// Answers a query directly to the requester. Runs on its own goroutine, so it must only touch state that is safe to
+// share.
+func respondToQuery(config *commonStruct, self node.Node, queryID uint64, question string, requester node.Node) {
+	answer, err := answerQuery(config, self, question)
+	if err != nil {
+		answer = map[string]string{"Error": err.Error()}
+	} else if answer == nil {
+		// The query was meant for some other node
+		return
+	}
+	data, err := json.Marshal(answer)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if len(data) > packets.MaxQueryResponseSize {
+		data, _ = json.Marshal(map[string]string{
+			"Error": fmt.Sprintf("response too large: %d bytes, at most %d fit in a packet", len(data),
+				packets.MaxQueryResponseSize),
+		})
+	}
+	response := new(packets.QueryResponseHeader)
+	response.Initialize(queryID, fmt.Sprintf("%s:%d", self.Address, self.Port), string(data))
+	config.Output <- packets.PeerPacket{Packet: response, Source: requester}
+}
+
+func answerQuery(config *commonStruct, self node.Node, query string) (interface{}, error) {
+	words := strings.Fields(query)
+	if len(words) == 0 {
+		return nil, fmt.Errorf("empty query")
+	}
+	switch words[0] {
+	case "usage":
+		return GetShareUsage(pinnedShareFiles(config, self), config.ShareQuota), nil
+	case "peers":
+		reports := make([]peerReport, 0)
+		config.PeerMap.Range(func(key, value interface{}) bool {
+			peer := key.(node.Node)
+			activity := getPeerActivity(peer)
+			reports = append(reports, peerReport{
+				Peer:        fmt.Sprintf("%s:%d", peer.Address, peer.Port),
+				LastSeen:    activity.LastSeen,
+				RTT:         activity.RTT,
+				MissedPings: value.(int),
+			})
+			return true
+		})
+		return reports, nil
+	case "modules":
+		return moduleReports(config, self), nil
+	case "transfers":
+		reports := make([]transferReport, 0)
+		for _, transfer := range Transfers() {
+			reports = append(reports, transferReport{
+				File:      hex.EncodeToString(transfer.FileHash[:]),
+				Name:      transfer.FileName,
+				Size:      transfer.FileSize,
+				Parts:     transfer.NumParts,
+				PartsHave: transfer.PartsHave,
+				Peers:     len(transfer.Peers),
+			})
+		}
+		return reports, nil
+	case "status":
+		status := statusReport{
+			Version:  Version,
+			Platform: nodePlatform(),
+			Uptime:   time.Since(nodeStarted),
+			Labels:   config.Labels,
+			Share:    GetShareUsage(pinnedShareFiles(config, self), config.ShareQuota),
+		}
+		config.PeerMap.Range(func(key, value interface{}) bool {
+			status.Peers += 1
+			return true
+		})
+		for _, module := range moduleReports(config, self) {
+			if module.Installed {
+				status.Modules += 1
+			}
+			if module.Active {
+				status.Active += 1
+			}
+		}
+		return status, nil
+	case "ping":
+		// Only the named node answers, either by address and port or just by address
+		if len(words) != 2 {
+			return nil, fmt.Errorf("usage: ping <node>")
+		}
+		if words[1] != fmt.Sprintf("%s:%d", self.Address, self.Port) && words[1] != self.Address {
+			return nil, nil
+		}
+		return map[string]bool{"Pong": true}, nil
+	case "archive":
+		// Which archive this node has for a module, used to fetch modules by name
+		if len(words) != 2 {
+			return nil, fmt.Errorf("usage: archive <module>")
+		}
+		fileHash, ok := LookupShareFile(fmt.Sprintf("%s.swm", words[1]))
+		if !ok {
+			return nil, fmt.Errorf("%s.swm not found in share", words[1])
+		}
+		return map[string]string{"Hash": hex.EncodeToString(fileHash[:])}, nil
+	case "plan":
+		return answerPlan(config, self, words)
+	case "outcome":
+		if len(words) != 2 {
+			return nil, fmt.Errorf("usage: outcome <module>")
+		}
+		outcome, ok := moduleOutcomes.Load(words[1])
+		if !ok {
+			return nil, fmt.Errorf("no recent changes to %s", words[1])
+		}
+		return outcome, nil
+	}
+	return nil, fmt.Errorf("unknown query: %s", query)
+}
+
+// Asks the rest of the swarm a question on this node's behalf and collects the answers that arrive within the wait
+func askSwarm(config *commonStruct, self node.Node, question string,
+	wait time.Duration) []packets.QueryResponseHeader {
+	// Query IDs are shared by the whole swarm, so they have to be random across nodes and restarts
+	var idBytes [8]uint8
+	rand.Read(idBytes[:])
+	queryID := binary.BigEndian.Uint64(idBytes[:])
+	responses := make(chan packets.QueryResponseHeader, 64)
+	pendingQueries.Store(queryID, responses)
+	defer pendingQueries.Delete(queryID)
+	// Mark the query as answered so it isn't handled again when it comes back around
+	answeredQueries.Store(queryID, time.Now().Unix())
+	query := new(packets.QueryHeader)
+	query.Initialize(queryID, self, question)
+	config.Broadcast <- query
+
+	collected := make([]packets.QueryResponseHeader, 0)
+	timeout := time.After(wait)
+	for {
+		select {
+		case response := <-responses:
+			collected = append(collected, response)
+		case <-timeout:
+			return collected
+		}
+	}
+}
+
+func HandleQueryResponse(response packets.QueryResponseHeader) {
+	if responses, ok := pendingQueries.Load(response.QueryID); ok {
+		select {
+		case responses.(chan packets.QueryResponseHeader) <- response:
+		default:
+		}
+	}
+}
+
+// Describes every module that is installed on this node or has a desired state
+func moduleReports(config *commonStruct, self node.Node) []moduleReport {
+	modules := make(map[string]*moduleReport)
+	entries, _ := ioutil.ReadDir(GetModulePath())
+	for _, entry := range entries {
+		if entry.IsDir() {
+			modules[entry.Name()] = &moduleReport{Name: entry.Name()}
+		}
+	}
+	for _, desired := range config.DesiredState.All() {
+		if _, ok := modules[desired.Name]; !ok {
+			modules[desired.Name] = &moduleReport{Name: desired.Name}
+		}
+		if desired.TargetsNode(self) {
+			modules[desired.Name].Desired = desiredStateNames[desired.State]
+		} else {
+			modules[desired.Name].Desired = desiredStateNames[packets.ModuleStateAbsent]
+		}
+	}
+	reports := make([]moduleReport, 0, len(modules))
+	for name, report := range modules {
+		report.Installed = moduleInstalled(name)
+		report.Active = moduleStarted(name)
+		report.Version = installedVersion(name)
+		reports = append(reports, *report)
+	}
+	sort.Slice(reports, func(a, b int) bool {
+		return reports[a].Name < reports[b].Name
+	})
+	return reports
+}
@@ -0,0 +1,117 @@
+package tasks
+
+import (
+	"swarmd/node"
+	"sync"
+	"time"
+)
+
+// Smallest burst a bucket allows, large enough for any single packet
+const minBurst = 65536
+
+// Number of idle per-peer buckets kept before they start being cleaned up
+const maxIdleBuckets = 256
+
+// Classic token bucket: tokens are bytes, refilled at rate per second up to the burst size
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	burst := float64(rate) / 4
+	if burst < minBurst {
+		burst = minBurst
+	}
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// How long until n bytes are available
+func (b *tokenBucket) delay(n float64) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Limits transfers to a total rate and a rate per peer, either of which can be 0 for no limit. A nil limiter lets
+// everything through.
+type rateLimiter struct {
+	lock     sync.Mutex
+	total    *tokenBucket
+	peerRate int64
+	peers    map[node.Node]*tokenBucket
+}
+
+func newRateLimiter(rate int64, peerRate int64) *rateLimiter {
+	if rate <= 0 && peerRate <= 0 {
+		return nil
+	}
+	limiter := &rateLimiter{peerRate: peerRate, peers: make(map[node.Node]*tokenBucket)}
+	if rate > 0 {
+		limiter.total = newTokenBucket(rate)
+	}
+	return limiter
+}
+
+// Takes n bytes from the buckets if they are all available and returns 0. Otherwise takes nothing and returns how
+// long to wait before trying again.
+func (l *rateLimiter) Reserve(peer node.Node, n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	if l.total != nil {
+		l.total.refill(now)
+		wait = l.total.delay(float64(n))
+	}
+	var peerBucket *tokenBucket
+	if l.peerRate > 0 {
+		peerBucket = l.peers[peer]
+		if peerBucket == nil {
+			l.cleanup(now)
+			peerBucket = newTokenBucket(l.peerRate)
+			l.peers[peer] = peerBucket
+		}
+		peerBucket.refill(now)
+		if peerWait := peerBucket.delay(float64(n)); peerWait > wait {
+			wait = peerWait
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	if l.total != nil {
+		l.total.tokens -= float64(n)
+	}
+	if peerBucket != nil {
+		peerBucket.tokens -= float64(n)
+	}
+	return 0
+}
+
+// Drops buckets that have refilled completely, they are no different from new ones. Must be called with the lock held.
+func (l *rateLimiter) cleanup(now time.Time) {
+	if len(l.peers) < maxIdleBuckets {
+		return
+	}
+	for peer, bucket := range l.peers {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.burst {
+			delete(l.peers, peer)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package tasks
+
+import (
+	"swarmd/packets"
+	"swarmd/node"
+	"swarmd/util"
+	"path/filepath"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Replication modes. Nodes outside a file's policy still pass its announcement along, but only fetch it on demand.
+const (
+	replicateAll = iota
+	replicateCount
+	replicateLabels
+	replicateNone
+)
+
+// Recorded in place of a policy once a file has been deleted, so that the swarm doesn't bring it back
+const deletedPolicy = "deleted"
+
+// Which nodes keep a copy of a file: "all" (or empty), "replicas:<n>" or "labels:<name>[,<name>...]"
+type replicationPolicy struct {
+	Mode     int
+	Replicas int
+	Labels   []string
+}
+
+func parseReplicationPolicy(policy string) (replicationPolicy, error) {
+	if policy == "" || policy == "all" {
+		return replicationPolicy{Mode: replicateAll}, nil
+	}
+	if strings.HasPrefix(policy, "replicas:") {
+		replicas, err := strconv.Atoi(strings.TrimPrefix(policy, "replicas:"))
+		if err != nil || replicas < 1 {
+			return replicationPolicy{}, fmt.Errorf("invalid replica count in %s", policy)
+		}
+		return replicationPolicy{Mode: replicateCount, Replicas: replicas}, nil
+	}
+	if strings.HasPrefix(policy, "labels:") {
+		labels := make([]string, 0)
+		for _, label := range strings.Split(strings.TrimPrefix(policy, "labels:"), ",") {
+			if label != "" {
+				labels = append(labels, label)
+			}
+		}
+		if len(labels) == 0 {
+			return replicationPolicy{}, errors.New("no labels given")
+		}
+		return replicationPolicy{Mode: replicateLabels, Labels: labels}, nil
+	}
+	return replicationPolicy{}, fmt.Errorf("unknown replication policy: %s", policy)
+}
+
+func (p replicationPolicy) String() string {
+	switch p.Mode {
+	case replicateCount:
+		return fmt.Sprintf("replicas:%d", p.Replicas)
+	case replicateLabels:
+		return fmt.Sprintf("labels:%s", strings.Join(p.Labels, ","))
+	case replicateNone:
+		return "none"
+	}
+	return "all"
+}
+
+// Checks whether this node should keep a copy of the file. Replica holders are picked by rendezvous hashing over the
+// peers this node knows about, so every node makes roughly the same choice without coordinating.
+func (p replicationPolicy) Includes(fileHash [packets.HashSize]uint8, self node.Node, labels []string,
+	peers []node.Node) bool {
+	switch p.Mode {
+	case replicateCount:
+		if len(peers) < p.Replicas {
+			return true
+		}
+		selfScore := replicaScore(fileHash, self)
+		higher := 0
+		for _, peer := range peers {
+			if bytes.Compare(replicaScore(fileHash, peer), selfScore) > 0 {
+				higher += 1
+			}
+		}
+		return higher < p.Replicas
+	case replicateLabels:
+		for _, want := range p.Labels {
+			for _, label := range labels {
+				if label == want {
+					return true
+				}
+			}
+		}
+		return false
+	case replicateNone:
+		return false
+	}
+	return true
+}
+
+func replicaScore(fileHash [packets.HashSize]uint8, peer node.Node) []uint8 {
+	score := sha256.Sum256([]byte(fmt.Sprintf("%s%s:%d", fileHash[:], peer.Address, peer.Port)))
+	return score[:]
+}
+
+// Lists the peers that are currently known to be alive
+func knownPeers(config *commonStruct) []node.Node {
+	peers := make([]node.Node, 0)
+	config.PeerMap.Range(func(key, value interface{}) bool {
+		peers = append(peers, key.(node.Node))
+		return true
+	})
+	return peers
+}
+
+// A file's policy and the revision of the deployment it came from. Evicted is only ever set locally, once the file
+// has been evicted from this node's share to keep it within its quota.
+type replicationRecord struct {
+	Policy   string
+	Revision uint64
+	Evicted  bool
+}
+
+func (r replicationRecord) deleted() bool {
+	return r.Policy == deletedPolicy
+}
+
+// Whether a record should replace another. Later revisions win, and records of the same revision are ordered by
+// policy so that every node settles on the same one whatever order it hears about them in.
+func (r replicationRecord) newerThan(other replicationRecord) bool {
+	if r.Revision != other.Revision {
+		return r.Revision > other.Revision
+	}
+	return r.Policy > other.Policy
+}
+
+// Remembers the policy each file was deployed with, so that later announcements of the file are handled the same way
+type replicationStore struct {
+	lock     sync.Mutex
+	path     string
+	policies map[string]replicationRecord
+}
+
+func GetReplicationPath() string {
+	return filepath.Join(util.GetBasePath(), "replication.json")
+}
+
+func loadReplicationPolicies() *replicationStore {
+	store := &replicationStore{
+		path:     GetReplicationPath(),
+		policies: make(map[string]replicationRecord),
+	}
+	file, err := ioutil.ReadFile(store.path)
+	if err != nil {
+		return store
+	}
+	if err := json.Unmarshal(file, &store.policies); err != nil {
+		// Policies saved before revisions were added are plain strings
+		policies := make(map[string]string)
+		if json.Unmarshal(file, &policies) != nil {
+			log.Printf("Unable to parse replication policies, starting empty: %v", err)
+		}
+		store.policies = make(map[string]replicationRecord)
+		for fileID, policy := range policies {
+			store.policies[fileID] = replicationRecord{Policy: policy}
+		}
+	}
+	return store
+}
+
+// Looks up the policy a file was deployed with. Files that were never announced with one are replicated everywhere,
+// and files that have been deleted or evicted from this node aren't replicated to it again.
+func (s *replicationStore) Get(fileHash [packets.HashSize]uint8) replicationPolicy {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	record := s.policies[hex.EncodeToString(fileHash[:])]
+	if record.deleted() || record.Evicted {
+		return replicationPolicy{Mode: replicateNone}
+	}
+	policy, _ := parseReplicationPolicy(record.Policy)
+	return policy
+}
+
+// Returns the record of every file that has been announced, keyed by the hex file hash
+func (s *replicationStore) All() map[string]replicationRecord {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	policies := make(map[string]replicationRecord, len(s.policies))
+	for fileID, record := range s.policies {
+		policies[fileID] = record
+	}
+	return policies
+}
+
+// Records the policy of a file unless a newer one is already known. Returns whether the policy was taken.
+func (s *replicationStore) Merge(fileHash [packets.HashSize]uint8, policy replicationPolicy, revision uint64) bool {
+	return s.merge(fileHash, replicationRecord{Policy: policy.String(), Revision: revision})
+}
+
+// Records that a file was deleted elsewhere in the swarm unless it has been deployed again since
+func (s *replicationStore) MergeDeleted(fileHash [packets.HashSize]uint8, revision uint64) bool {
+	return s.merge(fileHash, replicationRecord{Policy: deletedPolicy, Revision: revision})
+}
+
+func (s *replicationStore) merge(fileHash [packets.HashSize]uint8, record replicationRecord) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := hex.EncodeToString(fileHash[:])
+	if current, ok := s.policies[key]; ok && !record.newerThan(current) {
+		return false
+	}
+	s.policies[key] = record
+	s.save()
+	return true
+}
+
+// Leaves a tombstone for a file deleted from this node that wins over every deployment of it so far
+func (s *replicationStore) Delete(fileHash [packets.HashSize]uint8) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := hex.EncodeToString(fileHash[:])
+	s.policies[key] = replicationRecord{Policy: deletedPolicy, Revision: nextRevision(s.policies[key].Revision)}
+	s.save()
+}
+
+// Remembers that a file was evicted from this node so that it isn't fetched straight back. Deploying the file again
+// replaces the record, and with it the eviction.
+func (s *replicationStore) Evict(fileHash [packets.HashSize]uint8) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := hex.EncodeToString(fileHash[:])
+	record, ok := s.policies[key]
+	if !ok || record.deleted() || record.Evicted {
+		return
+	}
+	record.Evicted = true
+	s.policies[key] = record
+	s.save()
+}
+
+// Writes the store to disk. Must be called with the lock held.
+func (s *replicationStore) save() {
+	data, err := json.MarshalIndent(s.policies, "", "  ")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if err := ioutil.WriteFile(s.path, data, 0600); err != nil {
+		log.Printf("Unable to save replication policies: %v", err)
+	}
+}
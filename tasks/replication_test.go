@@ -0,0 +1,130 @@
+package tasks
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"swarmd/node"
+	"swarmd/packets"
+	"sync"
+	"testing"
+)
+
+func newTestReplicationStore(t *testing.T) *replicationStore {
+	return &replicationStore{
+		path:     filepath.Join(t.TempDir(), "replication.json"),
+		policies: make(map[string]replicationRecord),
+	}
+}
+
+func TestReplicationMerge(t *testing.T) {
+	newStore := func() *replicationStore {
+		return newTestReplicationStore(t)
+	}
+	fileHash := [packets.HashSize]uint8{1}
+	all, _ := parseReplicationPolicy("all")
+	replicas, _ := parseReplicationPolicy("replicas:2")
+	labels, _ := parseReplicationPolicy("labels:edge")
+
+	store := newStore()
+	if !store.Merge(fileHash, replicas, 5) {
+		t.Fatal("expected the first policy to be taken")
+	}
+	if store.Merge(fileHash, all, 4) || store.Get(fileHash).String() != "replicas:2" {
+		t.Error("expected an older revision to be ignored")
+	}
+	if !store.Merge(fileHash, labels, 6) || store.Get(fileHash).String() != "labels:edge" {
+		t.Error("expected a newer revision to win")
+	}
+
+	// Two nodes hearing about conflicting policies of the same revision in opposite orders settle on the same one
+	first, second := newStore(), newStore()
+	first.Merge(fileHash, all, 7)
+	first.Merge(fileHash, replicas, 7)
+	second.Merge(fileHash, replicas, 7)
+	second.Merge(fileHash, all, 7)
+	if first.All()["0100000000000000000000000000000000000000000000000000000000000000"] !=
+		second.All()["0100000000000000000000000000000000000000000000000000000000000000"] {
+		t.Errorf("expected the same policy, got %s and %s", first.Get(fileHash), second.Get(fileHash))
+	}
+}
+
+func TestReplicationTombstones(t *testing.T) {
+	self := node.Node{Address: "10.0.0.1", Port: 51234}
+	deleted, evicted := [packets.HashSize]uint8{1}, [packets.HashSize]uint8{2}
+	all, _ := parseReplicationPolicy("all")
+	config := &commonStruct{Replication: newTestReplicationStore(t)}
+	config.Replication.Merge(deleted, all, 5)
+	config.Replication.Merge(evicted, all, 5)
+
+	// A deleted file stays deleted through replays of its deployment and is passed on as a tombstone
+	config.Replication.Delete(deleted)
+	if config.Replication.Merge(deleted, all, 5) || config.Replication.Get(deleted).Includes(deleted, self, nil, nil) {
+		t.Error("expected a deleted file not to be replicated again")
+	}
+	entries := knownShareEntries(config)
+	if len(entries) != 2 || entries[0].Policy != deletedPolicy {
+		t.Fatalf("expected the tombstone to be listed, got %+v", entries)
+	}
+	useTestBasePath(t)
+	other := &commonStruct{
+		Replication:  newTestReplicationStore(t),
+		PeerMap:      new(sync.Map),
+		DesiredState: &desiredStateStore{path: GetDesiredStatePath(), modules: make(map[string]desiredModule)},
+	}
+	other.Replication.Merge(deleted, all, 5)
+	if missing := learnShareEntries(other, self, entries[:1]); len(missing) != 0 {
+		t.Errorf("expected a peer to learn of the deletion, got %d missing", len(missing))
+	}
+
+	// An evicted file isn't fetched back, but is still listed for peers as it was
+	config.Replication.Evict(evicted)
+	if config.Replication.Get(evicted).Includes(evicted, self, nil, nil) {
+		t.Error("expected an evicted file not to be replicated again")
+	}
+	if entries := knownShareEntries(config); entries[1].Policy != "all" || entries[1].Revision != 5 {
+		t.Errorf("expected the eviction to stay local, got %+v", entries[1])
+	}
+
+	// Deploying either again brings it back
+	for _, fileHash := range [][packets.HashSize]uint8{deleted, evicted} {
+		revision := nextRevision(config.Replication.All()[hex.EncodeToString(fileHash[:])].Revision)
+		if !config.Replication.Merge(fileHash, all, revision) || !config.Replication.Get(fileHash).Includes(fileHash, self, nil, nil) {
+			t.Errorf("expected a new deployment of %x to be replicated", fileHash[:1])
+		}
+	}
+}
+
+func TestMissingShareFilesOverQuota(t *testing.T) {
+	useTestBasePath(t)
+	self := node.Node{Address: "10.0.0.1", Port: 51234}
+	config := &commonStruct{
+		Replication:  newTestReplicationStore(t),
+		PeerMap:      new(sync.Map),
+		DesiredState: &desiredStateStore{path: GetDesiredStatePath(), modules: make(map[string]desiredModule)},
+		ShareQuota:   1024,
+	}
+	wanted := [packets.HashSize]uint8{1}
+	all, _ := parseReplicationPolicy("all")
+	config.Replication.Merge(wanted, all, 5)
+	entries := knownShareEntries(config)
+	if missing := missingShareFiles(config, self, entries); len(missing) != 1 {
+		t.Fatalf("expected the file to be fetched, got %d missing", len(missing))
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(GetSharePath(), "big"), make([]byte, 2048), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportShareFile("big"); err != nil {
+		t.Fatal(err)
+	}
+	if missing := missingShareFiles(config, self, entries); len(missing) != 0 {
+		t.Error("expected nothing to be fetched while share is over its quota")
+	}
+	// Unless this node needs it
+	config.DesiredState.Update(desiredModule{Name: "web", State: packets.ModuleStateInstalled,
+		Version: hex.EncodeToString(wanted[:]), Revision: 1})
+	if missing := missingShareFiles(config, self, entries); len(missing) != 1 {
+		t.Error("expected a pinned file to be fetched while share is over its quota")
+	}
+}
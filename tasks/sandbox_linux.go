@@ -0,0 +1,219 @@
+package tasks
+
+import (
+	"os/exec"
+	"os/user"
+	"syscall"
+	"path/filepath"
+	"os"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"errors"
+	"strings"
+	"swarmd/util"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// Name hooks with private mounts are started under. The daemon runs itself under this name inside the hook's mount
+// namespace to hide the swarmd directory before dropping privileges and starting the hook, since Go can't run code
+// between creating the namespace and starting the hook.
+const sandboxInitName = "swarmd-sandbox-init"
+
+func init() {
+	if len(os.Args) > 0 && os.Args[0] == sandboxInitName {
+		err := sandboxInit(os.Args[1:])
+		fmt.Fprintf(os.Stderr, "Unable to start hook in sandbox: %v\n", err)
+		os.Exit(126)
+	}
+}
+
+// Runs inside the hook's new mount namespace: <base path> <module dir> <uid> <gid> <hook path> <hook args...>.
+// Everything under the base path, including the swarm key in config.json and other modules, is replaced by an empty
+// tmpfs with only the module's own directory mounted back into it. Only returns on failure.
+func sandboxInit(args []string) error {
+	if len(args) < 6 {
+		return errors.New("missing arguments")
+	}
+	basePath, moduleDir, hookPath, hookArgs := args[0], args[1], args[4], args[5:]
+	uid, err := strconv.Atoi(args[2])
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(args[3])
+	if err != nil {
+		return err
+	}
+	// Keep the mounts below from propagating back to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %v", err)
+	}
+	// Hold on to the module directory so it can be mounted back once the base path is hidden
+	moduleFd, err := syscall.Open(moduleDir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", basePath, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0711"); err != nil {
+		return fmt.Errorf("hiding %s: %v", basePath, err)
+	}
+	if err := os.MkdirAll(moduleDir, 0711); err != nil {
+		return err
+	}
+	source := fmt.Sprintf("/proc/self/fd/%d", moduleFd)
+	if err := syscall.Mount(source, moduleDir, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("mounting %s: %v", moduleDir, err)
+	}
+	syscall.Close(moduleFd)
+	if err := os.Chdir(moduleDir); err != nil {
+		return err
+	}
+	// The sandbox user may not be able to search the directories above the base path, so the hook is started
+	// relative to its module
+	if rel, err := filepath.Rel(moduleDir, hookPath); err == nil && !strings.HasPrefix(rel, "..") {
+		hookPath = "./" + rel
+	}
+	if uid >= 0 {
+		if err := syscall.Setgroups([]int{}); err != nil {
+			return err
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return err
+		}
+		if err := syscall.Setuid(uid); err != nil {
+			return err
+		}
+	}
+	return syscall.Exec(hookPath, hookArgs, os.Environ())
+}
+
+func getModuleCgroupPath(moduleName string) string {
+	return filepath.Join(cgroupRoot, "swarmd", moduleName)
+}
+
+// Configures the command to run inside the module's sandbox. The returned function must be called once the
+// command has been started or has failed to start.
+func applySandbox(cmd *exec.Cmd, moduleName string, moduleDir string, sandbox moduleSandbox) (func(), error) {
+	cleanup := func() {}
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+
+	if sandbox.User != "" {
+		// Every module runs as the same user, so each one only gets to see its own directory
+		sandbox.PrivateMounts = true
+		if os.Geteuid() != 0 {
+			return cleanup, errors.New("switching users requires the daemon to run as root")
+		}
+		usr, err := user.Lookup(sandbox.User)
+		if err != nil {
+			return cleanup, err
+		}
+		uid, _ := strconv.ParseUint(usr.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(usr.Gid, 10, 32)
+		if uid == 0 {
+			return cleanup, fmt.Errorf("sandbox user %s is privileged", sandbox.User)
+		}
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+		// The module needs to own its own directory. The rest of the swarmd directory stays private to the daemon,
+		// the hook reaches its directory through the mount set up by the helper.
+		if err := chownTree(moduleDir, int(uid), int(gid)); err != nil {
+			return cleanup, err
+		}
+		for i, value := range cmd.Env {
+			if strings.HasPrefix(value, "HOME=") {
+				cmd.Env[i] = fmt.Sprintf("HOME=%s", usr.HomeDir)
+			}
+		}
+	}
+
+	if sandbox.PrivateMounts {
+		if os.Geteuid() != 0 {
+			return cleanup, errors.New("private mounts require the daemon to run as root")
+		}
+		// The helper switches to the sandbox user itself once the mounts are set up
+		uid, gid := -1, -1
+		if credential := cmd.SysProcAttr.Credential; credential != nil {
+			uid, gid = int(credential.Uid), int(credential.Gid)
+			cmd.SysProcAttr.Credential = nil
+		}
+		args := []string{sandboxInitName, util.GetBasePath(), moduleDir, strconv.Itoa(uid), strconv.Itoa(gid), cmd.Path}
+		cmd.Args = append(args, cmd.Args...)
+		// Still the daemon even if its binary has been replaced since it started
+		cmd.Path = "/proc/self/exe"
+		cmd.SysProcAttr.Unshareflags |= syscall.CLONE_NEWNS
+	}
+	if sandbox.PrivateNetwork {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+
+	if sandbox.hasLimits() {
+		cgroupPath, err := setupCgroup(moduleName, sandbox)
+		if err != nil {
+			return cleanup, err
+		}
+		// Place the process into the cgroup as it is created so nothing it forks can escape the limits
+		cgroupDir, err := os.Open(cgroupPath)
+		if err != nil {
+			return cleanup, err
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cgroupDir.Fd())
+		cleanup = func() { cgroupDir.Close() }
+	}
+
+	return cleanup, nil
+}
+
+func setupCgroup(moduleName string, sandbox moduleSandbox) (string, error) {
+	parent := filepath.Join(cgroupRoot, "swarmd")
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return "", errors.New("cgroups v2 is not available")
+	}
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", err
+	}
+	// Delegate the controllers we need down to the per-module cgroups
+	for _, dir := range []string{cgroupRoot, parent} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+cpu +memory +pids"), 0644); err != nil {
+			return "", err
+		}
+	}
+	cgroupPath := getModuleCgroupPath(moduleName)
+	if err := os.MkdirAll(cgroupPath, 0755); err != nil {
+		return "", err
+	}
+
+	limits := map[string]string{"cpu.max": "max", "memory.max": "max", "pids.max": "max"}
+	if sandbox.CPU > 0 {
+		limits["cpu.max"] = fmt.Sprintf("%d 100000", int64(sandbox.CPU*100000))
+	}
+	if sandbox.Memory != "" {
+		memory, err := util.ParseSize(sandbox.Memory)
+		if err != nil {
+			return "", err
+		}
+		limits["memory.max"] = strconv.FormatInt(memory, 10)
+	}
+	if sandbox.Pids > 0 {
+		limits["pids.max"] = strconv.Itoa(sandbox.Pids)
+	}
+	for file, value := range limits {
+		if err := ioutil.WriteFile(filepath.Join(cgroupPath, file), []byte(value), 0644); err != nil {
+			return "", err
+		}
+	}
+	return cgroupPath, nil
+}
+
+// Removes the module's cgroup. This only succeeds once every process in it has exited.
+func removeSandbox(moduleName string) {
+	os.Remove(getModuleCgroupPath(moduleName))
+}
+
+func chownTree(root string, uid int, gid int) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
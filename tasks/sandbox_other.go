@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package tasks
+
+import (
+	"os/exec"
+	"errors"
+)
+
+// Sandboxing relies on cgroups and namespaces, so on other platforms modules that ask for it are refused rather
+// than silently run unconfined
+func applySandbox(cmd *exec.Cmd, moduleName string, moduleDir string, sandbox moduleSandbox) (func(), error) {
+	if sandbox.User != "" || sandbox.hasLimits() || sandbox.PrivateMounts || sandbox.PrivateNetwork {
+		return func() {}, errors.New("sandboxing is only supported on linux")
+	}
+	return func() {}, nil
+}
+
+func removeSandbox(moduleName string) {
+}
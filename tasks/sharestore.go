@@ -0,0 +1,542 @@
+package tasks
+
+import (
+	"swarmd/packets"
+	"path/filepath"
+	"os"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"encoding/json"
+	"encoding/hex"
+	"sync"
+	"log"
+	"fmt"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The share directory is a content addressed store:
+//   share/blobs/sha256/ab/abcd...  file contents, named by their SHA-256
+//   share/index.json               maps file names to hashes, caches blob hashes and records when blobs were last used
+// Files dropped directly into share (e.g. by the console) are imported into the store the next time it is scanned.
+// The index is kept in memory once read and only written back when it changes.
+
+type hashCacheEntry struct {
+	Size    int64
+	ModTime int64
+	Hash    string
+}
+
+type shareIndex struct {
+	Names    map[string]string
+	Hashes   map[string]hashCacheEntry
+	Accessed map[string]int64
+	// Set when the index differs from what is on disk
+	dirty bool
+	// The files in the store as of the last scan, nil when the store has changed since
+	files packets.FileManifest
+}
+
+// Guards the index and the blobs, which are used by the file share, module manager and deployments
+var shareLock sync.Mutex
+
+// The index, nil until it is first used
+var currentShareIndex *shareIndex
+
+const shareIndexFile = "index.json"
+
+func GetBlobsPath() string {
+	blobsPath := filepath.Join(GetSharePath(), "blobs", "sha256")
+
+	// Make the blob directory if it doesn't exist
+	os.MkdirAll(blobsPath, 0700)
+
+	return blobsPath
+}
+
+func GetBlobPath(fileHash [packets.HashSize]uint8) string {
+	fileID := hex.EncodeToString(fileHash[:])
+	return filepath.Join(GetBlobsPath(), fileID[:2], fileID)
+}
+
+// Returns the index, reading it from disk the first time. Must be called with shareLock held.
+func loadShareIndex() *shareIndex {
+	if currentShareIndex != nil {
+		return currentShareIndex
+	}
+	currentShareIndex = readShareIndex()
+	return currentShareIndex
+}
+
+func readShareIndex() *shareIndex {
+	index := &shareIndex{
+		Names:    make(map[string]string),
+		Hashes:   make(map[string]hashCacheEntry),
+		Accessed: make(map[string]int64),
+	}
+	file, err := ioutil.ReadFile(filepath.Join(GetSharePath(), shareIndexFile))
+	if err != nil {
+		return index
+	}
+	if err := json.Unmarshal(file, index); err != nil {
+		log.Printf("Unable to parse share index, rebuilding: %v", err)
+	}
+	if index.Names == nil {
+		index.Names = make(map[string]string)
+	}
+	if index.Hashes == nil {
+		index.Hashes = make(map[string]hashCacheEntry)
+	}
+	if index.Accessed == nil {
+		index.Accessed = make(map[string]int64)
+	}
+	return index
+}
+
+// Writes the index to disk if it has changed. Must be called with shareLock held.
+func (i *shareIndex) save() {
+	if !i.dirty {
+		return
+	}
+	data, err := json.MarshalIndent(i, "", "  ")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	indexPath := filepath.Join(GetSharePath(), shareIndexFile)
+	if err := ioutil.WriteFile(indexPath+".tmp", data, 0600); err != nil {
+		log.Printf("Unable to save share index: %v", err)
+		return
+	}
+	if err := os.Rename(indexPath+".tmp", indexPath); err != nil {
+		log.Printf("Unable to save share index: %v", err)
+		return
+	}
+	i.dirty = false
+}
+
+// Records that the blobs in the store have changed, so the next manifest rescans them. Must be called with shareLock
+// held.
+func (i *shareIndex) changed() {
+	i.dirty = true
+	i.files = nil
+}
+
+// Hashes a file, reusing the cached hash as long as the file's size and modification time haven't changed
+func (i *shareIndex) hash(path string) ([packets.HashSize]uint8, error) {
+	var fileHash [packets.HashSize]uint8
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileHash, err
+	}
+	relPath, err := filepath.Rel(GetSharePath(), path)
+	if err != nil {
+		return fileHash, err
+	}
+	if cached, ok := i.Hashes[relPath]; ok && cached.Size == info.Size() && cached.ModTime == info.ModTime().UnixNano() {
+		if decoded, err := hex.DecodeString(cached.Hash); err == nil && len(decoded) == packets.HashSize {
+			copy(fileHash[:], decoded)
+			return fileHash, nil
+		}
+	}
+	fileHash, err = hashFile(path)
+	if err != nil {
+		return fileHash, err
+	}
+	i.Hashes[relPath] = hashCacheEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Hash:    hex.EncodeToString(fileHash[:]),
+	}
+	i.dirty = true
+	return fileHash, nil
+}
+
+func hashFile(path string) ([packets.HashSize]uint8, error) {
+	var checksum [packets.HashSize]uint8
+	file, err := os.Open(path)
+	if err != nil {
+		return checksum, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return checksum, err
+	}
+	copy(checksum[:], hash.Sum(nil))
+	return checksum, nil
+}
+
+// Moves a file into the blob store under its hash. Must be called with shareLock held.
+func (i *shareIndex) addBlob(name string, path string, fileHash [packets.HashSize]uint8) error {
+	blobPath := GetBlobPath(fileHash)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0700); err != nil {
+		return err
+	}
+	if _, err := os.Stat(blobPath); err == nil {
+		// Already have this content, so the new copy isn't needed
+		os.Remove(path)
+	} else if err := os.Rename(path, blobPath); err != nil {
+		return err
+	}
+	relPath, _ := filepath.Rel(GetSharePath(), path)
+	delete(i.Hashes, relPath)
+	i.Names[name] = hex.EncodeToString(fileHash[:])
+	i.touch(fileHash)
+	i.changed()
+	return nil
+}
+
+func validShareName(name string) bool {
+	return name != "" && name == filepath.Base(name) && name != shareIndexFile && name[0] != '.'
+}
+
+// Imports a file that was written directly into share into the blob store, returning its hash
+func ImportShareFile(name string) ([packets.HashSize]uint8, error) {
+	var fileHash [packets.HashSize]uint8
+	if !validShareName(name) {
+		return fileHash, fmt.Errorf("invalid file name: %s", name)
+	}
+	shareLock.Lock()
+	defer shareLock.Unlock()
+	index := loadShareIndex()
+	defer index.save()
+	return index.importFile(name)
+}
+
+// Must be called with shareLock held
+func (i *shareIndex) importFile(name string) ([packets.HashSize]uint8, error) {
+	path := filepath.Join(GetSharePath(), name)
+	fileHash, err := i.hash(path)
+	if err != nil {
+		return fileHash, err
+	}
+	return fileHash, i.addBlob(name, path, fileHash)
+}
+
+// Adds a downloaded file to the store once its contents are confirmed to match the expected hash
+func AddShareBlob(name string, path string, fileHash [packets.HashSize]uint8) error {
+	actual, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	if actual != fileHash {
+		os.Remove(path)
+		return errors.New("file contents do not match hash")
+	}
+	shareLock.Lock()
+	defer shareLock.Unlock()
+	index := loadShareIndex()
+	defer index.save()
+	if !validShareName(name) {
+		// Keep the content, just without a usable name
+		name = hex.EncodeToString(fileHash[:])
+	}
+	return index.addBlob(name, path, fileHash)
+}
+
+// Records that a blob was used. Returns false if it was already marked recently, to save rewriting the index.
+// Must be called with shareLock held.
+func (i *shareIndex) touch(fileHash [packets.HashSize]uint8) bool {
+	fileID := hex.EncodeToString(fileHash[:])
+	now := time.Now().Unix()
+	if now-i.Accessed[fileID] < 60 {
+		return false
+	}
+	i.Accessed[fileID] = now
+	i.dirty = true
+	return true
+}
+
+// Marks a blob as recently used so that it is the last to be evicted
+func TouchShareFile(fileHash [packets.HashSize]uint8) {
+	shareLock.Lock()
+	defer shareLock.Unlock()
+	index := loadShareIndex()
+	if index.touch(fileHash) {
+		index.save()
+	}
+}
+
+// Finds the hash of the named file, if it is in the store
+func LookupShareFile(name string) ([packets.HashSize]uint8, bool) {
+	var fileHash [packets.HashSize]uint8
+	shareLock.Lock()
+	defer shareLock.Unlock()
+	index := loadShareIndex()
+	fileID, ok := index.Names[name]
+	if !ok {
+		return fileHash, false
+	}
+	decoded, err := hex.DecodeString(fileID)
+	if err != nil || len(decoded) != packets.HashSize {
+		return fileHash, false
+	}
+	copy(fileHash[:], decoded)
+	if _, err := os.Stat(GetBlobPath(fileHash)); err != nil {
+		return fileHash, false
+	}
+	if index.touch(fileHash) {
+		index.save()
+	}
+	return fileHash, true
+}
+
+// Removes a name from the store, along with its content if nothing else refers to it
+func RemoveShareFile(name string) bool {
+	shareLock.Lock()
+	defer shareLock.Unlock()
+	index := loadShareIndex()
+	fileID, ok := index.Names[name]
+	if !ok {
+		return false
+	}
+	delete(index.Names, name)
+	index.changed()
+	referenced := false
+	for _, other := range index.Names {
+		referenced = referenced || other == fileID
+	}
+	if !referenced {
+		if decoded, err := hex.DecodeString(fileID); err == nil && len(decoded) == packets.HashSize {
+			var fileHash [packets.HashSize]uint8
+			copy(fileHash[:], decoded)
+			os.Remove(GetBlobPath(fileHash))
+		}
+		removeShareTrees(fileID)
+	}
+	index.save()
+	return true
+}
+
+// Lists the files in the store. The store is only scanned again once it has changed, see RescanShare for picking up
+// changes made behind its back.
+func GetFileManifest() packets.FileManifest {
+	shareLock.Lock()
+	defer shareLock.Unlock()
+	index := loadShareIndex()
+	if index.files == nil {
+		index.files = index.scan()
+		index.save()
+	}
+	files := make(packets.FileManifest, len(index.files))
+	for fileHash, digest := range index.files {
+		files[fileHash] = digest
+	}
+	return files
+}
+
+// Scans share again, picking up files dropped into it by name and blobs that were removed or corrupted
+func RescanShare() {
+	shareLock.Lock()
+	defer shareLock.Unlock()
+	index := loadShareIndex()
+	index.files = index.scan()
+	index.save()
+}
+
+// Imports loose files, checks every blob against its name and forgets about blobs that are gone. Must be called with
+// shareLock held.
+func (i *shareIndex) scan() packets.FileManifest {
+	files := make(packets.FileManifest)
+
+	// Pull in anything that was dropped into share by name
+	entries, _ := ioutil.ReadDir(GetSharePath())
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && validShareName(entry.Name()) {
+			if _, err := i.importFile(entry.Name()); err != nil {
+				log.Printf("Unable to import %s into share: %v", entry.Name(), err)
+			}
+		}
+	}
+
+	names := make(map[string]string)
+	for name, fileID := range i.Names {
+		names[fileID] = name
+	}
+	// Build a function that will parse the relevant info from each blob
+	walkFunc := func(path string, info os.FileInfo, err error) error {
+		// Check that file info could be gathered
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		// Make sure the blob still matches its name, throwing it out if it has been corrupted
+		checksum, err := i.hash(path)
+		if err != nil {
+			return nil
+		}
+		fileID := hex.EncodeToString(checksum[:])
+		if fileID != info.Name() {
+			log.Printf("Removing corrupt blob from share: %s", info.Name())
+			os.Remove(path)
+			removeShareTrees(info.Name())
+			return nil
+		}
+		name, ok := names[fileID]
+		if !ok {
+			name = fileID
+		}
+		// Add the file digest to the file map
+		files[checksum] = packets.FileDigest{
+			RelativeFilePath: name,
+			FileSize:         uint64(info.Size()),
+		}
+		return nil
+	}
+	// Walk the directory using the above function
+	filepath.Walk(GetBlobsPath(), walkFunc)
+
+	// Forget about names and cached hashes for blobs that no longer exist
+	for name, fileID := range i.Names {
+		if decoded, err := hex.DecodeString(fileID); err == nil && len(decoded) == packets.HashSize {
+			var fileHash [packets.HashSize]uint8
+			copy(fileHash[:], decoded)
+			if _, ok := files[fileHash]; ok {
+				continue
+			}
+		}
+		delete(i.Names, name)
+		i.dirty = true
+	}
+	for relPath := range i.Hashes {
+		if _, err := os.Stat(filepath.Join(GetSharePath(), relPath)); err != nil {
+			delete(i.Hashes, relPath)
+			i.dirty = true
+		}
+	}
+	for fileID := range i.Accessed {
+		if decoded, err := hex.DecodeString(fileID); err == nil && len(decoded) == packets.HashSize {
+			var fileHash [packets.HashSize]uint8
+			copy(fileHash[:], decoded)
+			if _, ok := files[fileHash]; ok {
+				continue
+			}
+		}
+		delete(i.Accessed, fileID)
+		i.dirty = true
+	}
+	// Throw out the trees of blobs that are gone
+	trees, _ := ioutil.ReadDir(GetTreesPath())
+	for _, tree := range trees {
+		fileID := strings.SplitN(tree.Name(), ".", 2)[0]
+		if decoded, err := hex.DecodeString(fileID); err == nil && len(decoded) == packets.HashSize {
+			var fileHash [packets.HashSize]uint8
+			copy(fileHash[:], decoded)
+			if _, ok := files[fileHash]; ok {
+				continue
+			}
+		}
+		os.Remove(filepath.Join(GetTreesPath(), tree.Name()))
+	}
+	return files
+}
+
+type shareBlob struct {
+	fileID   string
+	path     string
+	size     int64
+	accessed int64
+}
+
+// Lists the blobs in the store. Must be called with shareLock held.
+func (i *shareIndex) blobs() []shareBlob {
+	var blobs []shareBlob
+	filepath.Walk(GetBlobsPath(), func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		accessed, ok := i.Accessed[info.Name()]
+		if !ok {
+			accessed = info.ModTime().Unix()
+		}
+		blobs = append(blobs, shareBlob{fileID: info.Name(), path: path, size: info.Size(), accessed: accessed})
+		return nil
+	})
+	return blobs
+}
+
+// Space used by share on this node
+type shareUsage struct {
+	Files       int
+	Bytes       int64
+	PinnedFiles int
+	PinnedBytes int64
+	Quota       int64
+}
+
+// Works out how much space share is using. Pinned holds the hex hashes of blobs that can't be evicted.
+func GetShareUsage(pinned map[string]bool, quota int64) shareUsage {
+	shareLock.Lock()
+	defer shareLock.Unlock()
+	usage := shareUsage{Quota: quota}
+	for _, blob := range loadShareIndex().blobs() {
+		usage.Files += 1
+		usage.Bytes += blob.size
+		if pinned[blob.fileID] {
+			usage.PinnedFiles += 1
+			usage.PinnedBytes += blob.size
+		}
+	}
+	return usage
+}
+
+// Evicts the least recently used blobs that aren't pinned until share fits in the quota. Pinned blobs are never
+// removed, even if they alone are over the quota. Returns the hashes of the blobs evicted.
+func CollectShareGarbage(quota int64, pinned map[string]bool) [][packets.HashSize]uint8 {
+	evicted := make([][packets.HashSize]uint8, 0)
+	if quota <= 0 {
+		return evicted
+	}
+	shareLock.Lock()
+	defer shareLock.Unlock()
+	index := loadShareIndex()
+	blobs := index.blobs()
+	used := int64(0)
+	for _, blob := range blobs {
+		used += blob.size
+	}
+	if used <= quota {
+		return evicted
+	}
+	sort.Slice(blobs, func(a, b int) bool {
+		return blobs[a].accessed < blobs[b].accessed
+	})
+	freed := int64(0)
+	for _, blob := range blobs {
+		if used-freed <= quota {
+			break
+		}
+		if pinned[blob.fileID] {
+			continue
+		}
+		if err := os.Remove(blob.path); err != nil {
+			log.Printf("Unable to evict %s from share: %v", blob.fileID, err)
+			continue
+		}
+		log.Printf("Evicted %s from share (%d bytes)", blob.fileID, blob.size)
+		removeShareTrees(blob.fileID)
+		freed += blob.size
+		if decoded, err := hex.DecodeString(blob.fileID); err == nil && len(decoded) == packets.HashSize {
+			var fileHash [packets.HashSize]uint8
+			copy(fileHash[:], decoded)
+			evicted = append(evicted, fileHash)
+		}
+		delete(index.Accessed, blob.fileID)
+		for name, fileID := range index.Names {
+			if fileID == blob.fileID {
+				delete(index.Names, name)
+			}
+		}
+		relPath, _ := filepath.Rel(GetSharePath(), blob.path)
+		delete(index.Hashes, relPath)
+		index.changed()
+	}
+	index.save()
+	if used-freed > quota {
+		log.Printf("Share is over its quota of %d bytes, the remaining %d bytes are pinned", quota, used-freed)
+	}
+	return evicted
+}
@@ -0,0 +1,52 @@
+package tasks
+
+import (
+	"swarmd/packets"
+	"swarmd/node"
+	"sync"
+	"time"
+)
+
+// Snapshot of one peer's part of a download
+type transferPeerStatus struct {
+	Peer        node.Node
+	Partial     bool
+	Window      int
+	Outstanding int
+	RTT         time.Duration
+	BaseRTT     time.Duration
+	Received    uint64
+}
+
+// Snapshot of a download in progress, published by its downloader for anyone wanting to report on it
+type transferStatus struct {
+	FileHash  [packets.HashSize]uint8
+	FileName  string
+	FileSize  uint64
+	NumParts  uint64
+	PartsHave uint64
+	Peers     []transferPeerStatus
+	Updated   time.Time
+}
+
+// Latest status of every running download, keyed by file hash
+var activeTransfers sync.Map
+
+func publishTransfer(status transferStatus) {
+	status.Updated = time.Now()
+	activeTransfers.Store(status.FileHash, status)
+}
+
+func finishTransfer(fileHash [packets.HashSize]uint8) {
+	activeTransfers.Delete(fileHash)
+}
+
+// Returns the status of every running download
+func Transfers() []transferStatus {
+	var transfers []transferStatus
+	activeTransfers.Range(func(key, value interface{}) bool {
+		transfers = append(transfers, value.(transferStatus))
+		return true
+	})
+	return transfers
+}
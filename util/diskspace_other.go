@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package util
+
+import "errors"
+
+// Free space isn't known on this platform
+func FreeDiskSpace(path string) (int64, error) {
+	return 0, errors.New("free disk space is not supported on this platform")
+}
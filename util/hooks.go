@@ -0,0 +1,46 @@
+package util
+
+import (
+	"path"
+	"strings"
+)
+
+// Directory in a module holding hooks for particular platforms, in subdirectories named <os> or <os>_<arch>, e.g.
+// hooks/linux_arm64/install.sh or hooks/windows/start.ps1. Hooks at the top of the module are used on any platform
+// without a more specific one.
+const HookDirectory = "hooks"
+
+// Operating systems a hook directory can be named after
+var hookOperatingSystems = []string{"linux", "windows", "darwin", "freebsd", "openbsd", "netbsd", "dragonfly",
+	"solaris", "illumos", "aix", "android", "ios", "plan9"}
+
+// Extensions a hook may have on an OS, in order of preference. A hook without an extension is run directly.
+func HookExtensions(goos string) []string {
+	if goos == "windows" {
+		return []string{".ps1", ".exe", ".cmd"}
+	}
+	return []string{".sh", ""}
+}
+
+// Lists where a hook for the platform may be found, as slash separated paths relative to the module, most specific
+// first
+func HookCandidates(hook string, goos string, goarch string) []string {
+	candidates := make([]string, 0)
+	for _, dir := range []string{path.Join(HookDirectory, goos+"_"+goarch), path.Join(HookDirectory, goos), ""} {
+		for _, extension := range HookExtensions(goos) {
+			candidates = append(candidates, path.Join(dir, hook+extension))
+		}
+	}
+	return candidates
+}
+
+// Checks that a directory under hooks is named after a platform, so a typo doesn't silently leave nodes without hooks
+func ValidHookPlatform(name string) bool {
+	goos := strings.SplitN(name, "_", 2)[0]
+	for _, known := range hookOperatingSystems {
+		if goos == known {
+			return true
+		}
+	}
+	return false
+}
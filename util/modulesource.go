@@ -0,0 +1,155 @@
+package util
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Chooses which files of a module source go into its archive. Patterns use path.Match syntax and are matched against
+// each slash separated path, its base name and each of its parent directories, so "*.log" drops log files anywhere
+// and "build" drops a build directory and everything in it. With no include patterns everything is included, and
+// excludes always win.
+type ModuleFilter struct {
+	Include []string
+	Exclude []string
+}
+
+func (f ModuleFilter) Validate() error {
+	for _, pattern := range append(append([]string(nil), f.Include...), f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+func (f ModuleFilter) excluded(name string) bool {
+	return matchAny(f.Exclude, name)
+}
+
+func (f ModuleFilter) included(name string) bool {
+	return len(f.Include) == 0 || matchAny(f.Include, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	parts := strings.Split(name, "/")
+	for _, pattern := range patterns {
+		for i := range parts {
+			prefix := strings.Join(parts[:i+1], "/")
+			if matched, _ := path.Match(pattern, prefix); matched {
+				return true
+			}
+			if matched, _ := path.Match(pattern, parts[i]); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Lists everything under root for archiving, keeping paths relative to root along with their permissions. Symlinks
+// and other special files are refused since nodes only extract regular files and directories.
+func ListModuleDirectory(root string, filter ModuleFilter) ([]ModuleEntry, error) {
+	entries := make([]ModuleEntry, 0)
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		name := filepath.ToSlash(relPath)
+		if filter.excluded(name) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return fmt.Errorf("%s: only regular files and directories can be archived", name)
+		}
+		if filter.included(name) {
+			entries = append(entries, ModuleEntry{Name: name, Path: filePath, Mode: info.Mode()})
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// Extracts a gzipped tarball into dest so it can be archived like a directory. Entries are held to the same rules as
+// module archives: nothing outside of dest and nothing but regular files and directories.
+func ExtractTarball(src string, dest string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name, err := cleanEntryName(header.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			continue
+		}
+		fpath := filepath.Join(dest, filepath.FromSlash(name))
+		perm := os.FileMode(header.Mode).Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(fpath, 0755); err != nil {
+				return err
+			}
+			if err := os.Chmod(fpath, perm|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+				return err
+			}
+			if err := extractTarFile(tarReader, fpath, perm); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: only regular files and directories can be archived", header.Name)
+		}
+	}
+}
+
+func extractTarFile(r io.Reader, fpath string, perm os.FileMode) error {
+	outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm|0600)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+	if _, err := io.Copy(outFile, r); err != nil {
+		return err
+	}
+	// The umask may have taken bits away
+	return outFile.Chmod(perm | 0600)
+}
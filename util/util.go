@@ -12,6 +12,17 @@ import (
 	"log"
 	"swarmd/packets"
 	"swarmd/authentication"
+	"strings"
+	"strconv"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"errors"
+	"path"
+	"crypto/ed25519"
+	"sort"
+	"time"
 )
 
 func GetBasePath() string {
@@ -34,53 +45,198 @@ func GetBasePath() string {
 	return basePath
 }
 
-func ZipFiles(filename string, files []string) error {
+// Name of the file inside a module archive listing the SHA-256 of every other file in it
+const ModuleManifestFile = ".SWARMD_MANIFEST"
+
+// Name of the file inside a module archive holding the publisher's signature over the manifest
+const ModuleSignatureFile = ".SWARMD_SIGNATURE"
+
+// Decides whether a manifest can be trusted given the archive's signature, which is nil for unsigned archives
+type ManifestVerifier func(manifest []byte, signature []byte) error
+
+type ModuleManifest struct {
+	// The module the archive was built for, so a signed archive can't be installed under another name
+	Module string
+	Files  map[string]string
+}
+
+// Parses a manifest, checking that it was made for the module
+func ParseManifest(data []byte, module string) (ModuleManifest, error) {
+	manifest := ModuleManifest{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if manifest.Module != module {
+		return manifest, fmt.Errorf("archive was built for module %q, not %q", manifest.Module, module)
+	}
+	return manifest, nil
+}
+
+// Bounds applied while extracting an archive, so a hostile archive can't exhaust the disk
+type ExtractLimits struct {
+	MaxFiles     int
+	MaxFileSize  int64
+	MaxTotalSize int64
+}
+
+// Plenty for a module, nodes can change them in their options
+var DefaultExtractLimits = ExtractLimits{
+	MaxFiles:     10000,
+	MaxFileSize:  1 << 30,
+	MaxTotalSize: 4 << 30,
+}
+
+// Space always left free on the disk archives are extracted to
+const extractHeadroom = 512 << 20
+
+// Lowers the total size limit to what the disk holding dir can take while leaving some space free. The limits are
+// left alone if the free space can't be found.
+func (l ExtractLimits) WithinFreeSpace(dir string) ExtractLimits {
+	free, err := FreeDiskSpace(dir)
+	if err != nil {
+		return l
+	}
+	available := free - extractHeadroom
+	if available < 0 {
+		available = 0
+	}
+	if available < l.MaxTotalSize {
+		l.MaxTotalSize = available
+	}
+	if l.MaxFileSize > l.MaxTotalSize {
+		l.MaxFileSize = l.MaxTotalSize
+	}
+	return l
+}
+
+// A file or directory to put in a module archive
+type ModuleEntry struct {
+	// Slash separated path inside the archive
+	Name string
+	// Where the contents are read from, unused for directories
+	Path string
+	Mode os.FileMode
+}
+
+// Timestamp given to every archive entry so that archiving the same files always gives the same archive, and so the
+// same hash in share. Zip can't store anything earlier.
+var moduleEpoch = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Archives the entries into a module archive along with a manifest of their hashes and the module's name, signed with
+// the publisher's key
+func ZipModule(filename string, module string, entries []ModuleEntry, signingKey ed25519.PrivateKey) error {
 	newfile, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
-	defer newfile.Close()
-
 	zipWriter := zip.NewWriter(newfile)
-	defer zipWriter.Close()
+	err = writeModule(zipWriter, module, entries, signingKey)
+	// Closing writes out the end of the archive, so it can fail as well
+	if closeErr := zipWriter.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := newfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+	}
+	return err
+}
 
-	// Add files to zip
-	for _, file := range files {
+// Modes are normalised the same way so that checkouts with different umasks archive identically: directories and
+// anything executable get 0755, everything else 0644
+func moduleEntryMode(mode os.FileMode) os.FileMode {
+	if mode.IsDir() || mode&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
 
-		zipfile, err := os.Open(file)
-		if err != nil {
-			return err
-		}
-		defer zipfile.Close()
+func writeModule(zipWriter *zip.Writer, module string, entries []ModuleEntry, signingKey ed25519.PrivateKey) error {
+	sorted := append([]ModuleEntry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
 
-		// Get the file information
-		info, err := zipfile.Stat()
+	manifest := ModuleManifest{Module: module, Files: make(map[string]string)}
+	// Add files to zip
+	for _, entry := range sorted {
+		name, err := cleanEntryName(entry.Name)
 		if err != nil {
 			return err
 		}
-
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return err
+		if name == ModuleManifestFile || name == ModuleSignatureFile {
+			return fmt.Errorf("%s: name is reserved for module metadata", entry.Name)
 		}
-
-		// Change to deflate to gain better compression
-		// see http://golang.org/pkg/archive/zip/#pkg-constants
-		header.Method = zip.Deflate
-
-		writer, err := zipWriter.CreateHeader(header)
-		if err != nil {
-			return err
+		if entry.Mode.IsDir() {
+			header := &zip.FileHeader{Name: name + "/", Method: zip.Store, Modified: moduleEpoch}
+			header.SetMode(os.ModeDir | moduleEntryMode(entry.Mode))
+			if _, err := zipWriter.CreateHeader(header); err != nil {
+				return err
+			}
+			continue
 		}
-		_, err = io.Copy(writer, zipfile)
+		checksum, err := addFileToZip(zipWriter, name, entry)
 		if err != nil {
 			return err
 		}
+		manifest.Files[name] = checksum
+	}
+
+	// Add the manifest last since it covers everything else
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	writer, err := zipWriter.Create(ModuleManifestFile)
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(data); err != nil {
+		return err
+	}
+	signature, err := authentication.SignManifest(data, signingKey)
+	if err != nil {
+		return err
+	}
+	writer, err = zipWriter.Create(ModuleSignatureFile)
+	if err != nil {
+		return err
 	}
-	return nil
+	_, err = writer.Write(signature)
+	return err
 }
 
-func Unzip(src string, dest string) ([]string, error) {
+func addFileToZip(zipWriter *zip.Writer, name string, entry ModuleEntry) (string, error) {
+	zipfile, err := os.Open(entry.Path)
+	if err != nil {
+		return "", err
+	}
+	defer zipfile.Close()
+
+	// Only the name and whether the file is executable are kept, anything else would make the archive differ between
+	// machines. Deflate gives better compression, see http://golang.org/pkg/archive/zip/#pkg-constants
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: moduleEpoch}
+	header.SetMode(moduleEntryMode(entry.Mode))
+
+	writer, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(writer, hash), zipfile)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Extracts a module archive into dest. The manifest must pass verify and name the module, every entry must stay inside
+// dest and match the checksum listed for it in the manifest, and the archive must stay within the limits. Nothing is extracted until
+// the manifest has been verified, and a failure part way through leaves dest in an undefined state, so callers
+// should extract into a scratch directory.
+func Unzip(src string, dest string, module string, limits ExtractLimits, verify ManifestVerifier) ([]string, error) {
 	var filenames []string
 
 	r, err := zip.OpenReader(src)
@@ -89,47 +245,175 @@ func Unzip(src string, dest string) ([]string, error) {
 	}
 	defer r.Close()
 
-	for _, f := range r.File {
+	if len(r.File) > limits.MaxFiles {
+		return filenames, fmt.Errorf("archive has %d entries, limit is %d", len(r.File), limits.MaxFiles)
+	}
+	manifestData, err := readArchiveEntry(r, ModuleManifestFile)
+	if err != nil {
+		return filenames, err
+	}
+	if manifestData == nil {
+		return filenames, errors.New("archive has no manifest")
+	}
+	signature, err := readArchiveEntry(r, ModuleSignatureFile)
+	if err != nil {
+		return filenames, err
+	}
+	if err := verify(manifestData, signature); err != nil {
+		return filenames, err
+	}
+	manifest, err := ParseManifest(manifestData, module)
+	if err != nil {
+		return filenames, err
+	}
 
-		rc, err := f.Open()
+	seen := make(map[string]bool)
+	var totalSize int64
+	for _, f := range r.File {
+		name, err := cleanEntryName(f.Name)
 		if err != nil {
 			return filenames, err
 		}
-		defer rc.Close()
 
 		// Store filename/path for returning and using later on
-		fpath := filepath.Join(dest, f.Name)
+		fpath := filepath.Join(dest, filepath.FromSlash(name))
 		filenames = append(filenames, fpath)
 
-		if f.FileInfo().IsDir() {
-
+		mode := f.FileInfo().Mode()
+		if mode.IsDir() {
 			// Make Folder
-			os.MkdirAll(fpath, os.ModePerm)
-
-		} else {
-
-			// Make File
-			if err = os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
+			if err := os.MkdirAll(fpath, 0755); err != nil {
 				return filenames, err
 			}
+			continue
+		}
+		if !mode.IsRegular() {
+			return filenames, fmt.Errorf("%s: only regular files and directories are allowed", f.Name)
+		}
 
-			outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-			if err != nil {
-				return filenames, err
-			}
+		expected, ok := manifest.Files[name]
+		metadata := name == ModuleManifestFile || name == ModuleSignatureFile
+		if !ok && !metadata {
+			return filenames, fmt.Errorf("%s: not listed in manifest", f.Name)
+		}
+		if seen[name] {
+			return filenames, fmt.Errorf("%s: duplicate entry", f.Name)
+		}
+		seen[name] = true
 
-			_, err = io.Copy(outFile, rc)
+		// Make File
+		if err = os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			return filenames, err
+		}
+		written, checksum, err := extractFile(f, fpath, mode.Perm(), limits.MaxFileSize)
+		if err != nil {
+			return filenames, err
+		}
+		totalSize += written
+		if totalSize > limits.MaxTotalSize {
+			return filenames, fmt.Errorf("archive expands past the %d byte limit", limits.MaxTotalSize)
+		}
+		if !metadata && checksum != expected {
+			return filenames, fmt.Errorf("%s: checksum does not match manifest", f.Name)
+		}
+	}
 
-			// Close the file without defer to close before next iteration of loop
-			outFile.Close()
+	for name := range manifest.Files {
+		if !seen[name] {
+			return filenames, fmt.Errorf("%s: listed in manifest but missing from archive", name)
+		}
+	}
+	return filenames, nil
+}
 
-			if err != nil {
-				return filenames, err
-			}
+// Reads a small metadata entry from an archive, returning nil if it isn't present
+func readArchiveEntry(r *zip.ReadCloser, name string) ([]byte, error) {
+	for _, f := range r.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(io.LimitReader(rc, 16<<20))
+	}
+	return nil, nil
+}
+
+// Checks that a file is an archive of the module with a manifest. Whether its publisher is trusted is up to each node.
+func CheckModuleArchive(src string, module string) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	manifestData, err := readArchiveEntry(r, ModuleManifestFile)
+	if err != nil {
+		return err
+	}
+	if manifestData == nil {
+		return errors.New("archive has no manifest")
+	}
+	_, err = ParseManifest(manifestData, module)
+	return err
+}
+
+// Returns the hex encoded SHA-256 of a file
+func HashFile(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
 
+// Normalises an entry name, rejecting anything that could resolve outside of the destination
+func cleanEntryName(name string) (string, error) {
+	slashed := strings.Replace(name, "\\", "/", -1)
+	if slashed == "" || strings.HasPrefix(slashed, "/") || filepath.IsAbs(name) || filepath.VolumeName(name) != "" ||
+		strings.Contains(slashed, ":") {
+		return "", fmt.Errorf("%s: absolute paths are not allowed", name)
+	}
+	for _, part := range strings.Split(slashed, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("%s: path traversal is not allowed", name)
 		}
 	}
-	return filenames, nil
+	return path.Clean(slashed), nil
+}
+
+// Writes a single entry to disk, never trusting the sizes in the zip headers. Returns the bytes written and their
+// SHA-256.
+func extractFile(f *zip.File, fpath string, perm os.FileMode, maxSize int64) (int64, string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return 0, "", err
+	}
+	defer rc.Close()
+
+	// Drop setuid/setgid and world write bits, but keep files usable by their owner
+	outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, (perm&0755)|0600)
+	if err != nil {
+		return 0, "", err
+	}
+	defer outFile.Close()
+
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(outFile, hash), io.LimitReader(rc, maxSize+1))
+	if err != nil {
+		return written, "", err
+	}
+	if written > maxSize {
+		return written, "", fmt.Errorf("%s: expands past the %d byte limit", f.Name, maxSize)
+	}
+	return written, hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 func GetAddr(n node.Node) net.Addr {
@@ -146,4 +430,21 @@ func SendPacket(conn net.PacketConn, addr net.Addr, key [32]uint8, pkt packets.P
 	if err != nil {
 		fmt.Printf("%v\n", err)
 	}
-}
\ No newline at end of file
+}
+// Parses a human readable size such as "512", "64K", "256M" or "2G" into bytes
+func ParseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	multiplier := int64(1)
+	for suffix, value := range map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40} {
+		if strings.HasSuffix(size, suffix) || strings.HasSuffix(size, suffix+"B") || strings.HasSuffix(size, suffix+"IB") {
+			size = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(size, "B"), "I"), suffix)
+			multiplier = value
+			break
+		}
+	}
+	value, err := strconv.ParseInt(strings.TrimSuffix(size, "B"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	return value * multiplier, nil
+}
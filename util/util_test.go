@@ -0,0 +1,242 @@
+package util
+
+import (
+	"archive/zip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"swarmd/authentication"
+	"testing"
+	"time"
+)
+
+type testEntry struct {
+	name string
+	data string
+}
+
+func acceptAll(manifest []byte, signature []byte) error {
+	return nil
+}
+
+// Writes an archive holding the entries and a manifest listing the given checksums
+func writeTestArchive(t *testing.T, entries []testEntry, files map[string]string) string {
+	t.Helper()
+	archive := filepath.Join(t.TempDir(), "module.swm")
+	out, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	writer := zip.NewWriter(out)
+	for _, entry := range entries {
+		w, err := writer.Create(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(entry.data))
+	}
+	if files != nil {
+		data, _ := json.Marshal(ModuleManifest{Module: "module", Files: files})
+		w, err := writer.Create(ModuleManifestFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func checksum(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// Lists every entry in the manifest with its real checksum
+func manifestFor(entries []testEntry) map[string]string {
+	files := make(map[string]string)
+	for _, entry := range entries {
+		files[entry.name] = checksum(entry.data)
+	}
+	return files
+}
+
+func TestUnzip(t *testing.T) {
+	entries := []testEntry{{"install.sh", "echo install"}, {"bin/tool", "tool"}}
+	archive := writeTestArchive(t, entries, manifestFor(entries))
+	dest := filepath.Join(t.TempDir(), "module")
+	if _, err := Unzip(archive, dest, "module", DefaultExtractLimits, acceptAll); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dest, "bin", "tool"))
+	if err != nil || string(data) != "tool" {
+		t.Errorf("bin/tool = %q, %v", data, err)
+	}
+}
+
+func TestUnzipRejectsTraversal(t *testing.T) {
+	for _, name := range []string{"../escape", "a/../../escape", "/etc/escape", "..\\escape", "C:/escape"} {
+		entries := []testEntry{{name, "escaped"}}
+		archive := writeTestArchive(t, entries, manifestFor(entries))
+		parent := t.TempDir()
+		dest := filepath.Join(parent, "module")
+		if _, err := Unzip(archive, dest, "module", DefaultExtractLimits, acceptAll); err == nil {
+			t.Errorf("%s: extracted", name)
+		}
+		if _, err := os.Stat(filepath.Join(parent, "escape")); err == nil {
+			t.Errorf("%s: written outside of the destination", name)
+		}
+	}
+}
+
+func TestUnzipChecksManifest(t *testing.T) {
+	entries := []testEntry{{"install.sh", "echo install"}, {"extra", "extra"}}
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{"no manifest", nil},
+		{"unlisted file", map[string]string{"install.sh": checksum("echo install")}},
+		{"wrong checksum", map[string]string{"install.sh": checksum("echo changed"), "extra": checksum("extra")}},
+		{"missing file", map[string]string{"install.sh": checksum("echo install"), "extra": checksum("extra"),
+			"gone": checksum("gone")}},
+	}
+	for _, test := range tests {
+		archive := writeTestArchive(t, entries, test.files)
+		dest := filepath.Join(t.TempDir(), "module")
+		if _, err := Unzip(archive, dest, "module", DefaultExtractLimits, acceptAll); err == nil {
+			t.Errorf("%s: extracted", test.name)
+		}
+	}
+}
+
+func TestUnzipChecksModuleName(t *testing.T) {
+	entries := []testEntry{{"install.sh", "echo install"}}
+	archive := writeTestArchive(t, entries, manifestFor(entries))
+	dest := filepath.Join(t.TempDir(), "other")
+	if _, err := Unzip(archive, dest, "other", DefaultExtractLimits, acceptAll); err == nil {
+		t.Error("extracted an archive built for another module")
+	}
+	if err := CheckModuleArchive(archive, "other"); err == nil {
+		t.Error("archive built for another module passed the check")
+	}
+	if err := CheckModuleArchive(archive, "module"); err != nil {
+		t.Error(err)
+	}
+}
+
+// The same files archived twice, with different times on disk, give the same archive, and it unpacks with the
+// publisher's signature
+func TestZipModule(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same files checked out with different permissions and times archive identically
+	hashes := make([]string, 0)
+	for i, perm := range []os.FileMode{0700, 0775} {
+		dir := t.TempDir()
+		script := filepath.Join(dir, "install.sh")
+		data := filepath.Join(dir, "data.txt")
+		os.WriteFile(script, []byte("echo install"), perm)
+		os.WriteFile(data, []byte("data"), perm&0666)
+		os.Chmod(script, perm)
+		os.Chmod(data, perm&0666)
+		os.Chtimes(data, time.Now(), time.Now().Add(time.Duration(i)*time.Hour))
+		entries := []ModuleEntry{
+			{Name: "install.sh", Path: script, Mode: perm},
+			{Name: "lib", Mode: os.ModeDir | perm},
+			{Name: "data.txt", Path: data, Mode: perm & 0666},
+		}
+		archive := filepath.Join(dir, "module.swm")
+		if err := ZipModule(archive, "module", entries, key); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := HashFile(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+
+		trusted := []ed25519.PublicKey{key.Public().(ed25519.PublicKey)}
+		verify := func(manifest []byte, signature []byte) error {
+			return authentication.VerifyManifest(manifest, signature, trusted)
+		}
+		if _, err := Unzip(archive, filepath.Join(dir, "unpacked"), "module", DefaultExtractLimits, verify); err != nil {
+			t.Fatal(err)
+		}
+		for name, expected := range map[string]os.FileMode{"install.sh": 0755, "data.txt": 0644} {
+			info, err := os.Stat(filepath.Join(dir, "unpacked", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != expected {
+				t.Errorf("%s unpacked with mode %v, expected %v", name, info.Mode().Perm(), expected)
+			}
+		}
+	}
+	if hashes[0] != hashes[1] {
+		t.Error("archives of the same files differ")
+	}
+}
+
+func TestUnzipRejectsUnverifiedManifest(t *testing.T) {
+	entries := []testEntry{{"install.sh", "echo install"}}
+	archive := writeTestArchive(t, entries, manifestFor(entries))
+	dest := filepath.Join(t.TempDir(), "module")
+	_, err := Unzip(archive, dest, "module", DefaultExtractLimits, func(manifest []byte, signature []byte) error {
+		return errors.New("untrusted")
+	})
+	if err == nil {
+		t.Fatal("extracted")
+	}
+	if _, err := os.Stat(dest); err == nil {
+		t.Error("extracted before the manifest was verified")
+	}
+}
+
+func TestUnzipLimits(t *testing.T) {
+	entries := []testEntry{{"a", strings.Repeat("a", 100)}, {"b", strings.Repeat("b", 100)}}
+	archive := writeTestArchive(t, entries, manifestFor(entries))
+	tests := []struct {
+		name   string
+		limits ExtractLimits
+	}{
+		{"files", ExtractLimits{MaxFiles: 2, MaxFileSize: 1000, MaxTotalSize: 1000}},
+		{"file size", ExtractLimits{MaxFiles: 10, MaxFileSize: 99, MaxTotalSize: 1000}},
+		{"total size", ExtractLimits{MaxFiles: 10, MaxFileSize: 1000, MaxTotalSize: 150}},
+	}
+	for _, test := range tests {
+		if _, err := Unzip(archive, filepath.Join(t.TempDir(), "module"), "module", test.limits, acceptAll); err == nil {
+			t.Errorf("%s: extracted past the limit", test.name)
+		}
+	}
+	limits := ExtractLimits{MaxFiles: 3, MaxFileSize: 1000, MaxTotalSize: 1000}
+	if _, err := Unzip(archive, filepath.Join(t.TempDir(), "module"), "module", limits, acceptAll); err != nil {
+		t.Errorf("within the limits: %v", err)
+	}
+}
+
+func TestWithinFreeSpace(t *testing.T) {
+	free, err := FreeDiskSpace(t.TempDir())
+	if err != nil {
+		t.Skip(err)
+	}
+	limits := ExtractLimits{MaxFiles: 1, MaxFileSize: free * 2, MaxTotalSize: free * 2}.WithinFreeSpace(t.TempDir())
+	if limits.MaxTotalSize >= free || limits.MaxFileSize > limits.MaxTotalSize {
+		t.Errorf("limits %+v not lowered to %d bytes free", limits, free)
+	}
+	small := ExtractLimits{MaxFiles: 1, MaxFileSize: 1, MaxTotalSize: 1}
+	if small.WithinFreeSpace(t.TempDir()) != small {
+		t.Error("limits below the free space were changed")
+	}
+}